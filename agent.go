@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"pikotunnel/client"
+)
+
+// agentState survives restarts so the agent keeps its peer and key
+type agentState struct {
+	Server     string `json:"server"`
+	PeerID     string `json:"peer_id"`
+	PrivateKey string `json:"private_key"`
+	// PeerToken is returned by enrollment, it only grants access to this peer
+	PeerToken string `json:"peer_token,omitempty"`
+}
+
+type agent struct {
+	client    *client.Client
+	apiToken  string
+	iface     string
+	stateDir  string
+	keepalive int
+	state     agentState
+	// config is the last config applied to the interface
+	config *client.WireguardConfig
+	// endpoint is the relay in use, it moves along config.Endpoints when handshakes stop
+	endpoint      string
+	endpointSince time.Time
+	// directPeers are the direct peers installed on the interface, keyed by public key
+	directPeers map[string]directPeerState
+	// fallbackUntil holds the direct peers which did not answer, they go through the relay until then
+	fallbackUntil map[string]time.Time
+	// pinnedRoutes keep the relays and direct peers off the tunnel when it carries all traffic
+	pinnedRoutes []string
+}
+
+type directPeerState struct {
+	peer  client.DirectPeer
+	since time.Time
+}
+
+const (
+	// relayFailoverAfter is how long the agent waits for a relay handshake before trying the next relay
+	relayFailoverAfter = 3 * time.Minute
+	// a direct peer without a handshake for that long is reached through the relay again
+	directHandshakeTimeout = 3 * time.Minute
+	directRetryAfter       = 15 * time.Minute
+)
+
+// runAgent implements `pikotunnel agent`, it runs on the peer instead of the setup script
+func runAgent(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	serverURL := flags.String("server", envOrDefault("PIKOTUNNEL_SERVER_URL", "http://localhost:8080"), "pikotunnel server url")
+	token := flags.String("token", os.Getenv("PIKOTUNNEL_API_TOKEN"), "api token, only needed without an enrollment token")
+	enrollmentToken := flags.String("enrollment-token", os.Getenv("PIKOTUNNEL_ENROLLMENT_TOKEN"), "one time enrollment token, only used on the first run")
+	network := flags.String("network", "", "network id when registering with the api token, the default network if not set")
+	name := flags.String("name", "", "peer name when registering with the api token")
+	label := flags.String("label", "", "peer label when registering with the api token")
+	iface := flags.String("interface", "pikotunnel0", "wireguard interface to create")
+	stateDir := flags.String("state-dir", "/var/lib/pikotunnel-agent", "directory where the peer id and private key are kept")
+	interval := flags.Duration("interval", 30*time.Second, "how often the config is synced")
+	keepalive := flags.Int("keepalive", 25, "persistent keepalive in seconds, 0 to disable")
+	deregister := flags.Bool("deregister", false, "delete the peer on exit, a new one is registered on the next run")
+	direct := flags.Bool("direct", false, "connect directly to the peers with access rules which also run with --direct, the relay stays the fallback")
+	flags.Parse(args)
+
+	if os.Geteuid() != 0 {
+		log.Fatal("Please run as root")
+	}
+	checkForToolInEnvironment("wg")
+	checkForToolInEnvironment("ip")
+
+	a := &agent{
+		client:        client.New(*serverURL, *token),
+		apiToken:      *token,
+		iface:         *iface,
+		stateDir:      *stateDir,
+		keepalive:     *keepalive,
+		directPeers:   map[string]directPeerState{},
+		fallbackUntil: map[string]time.Time{},
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err := a.register(ctx, *serverURL, *enrollmentToken, *network, *name, *label)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to register peer: %s", err)
+	}
+	log.Printf("[INFO] Waiting for peer %s to be created", a.state.PeerID)
+	peer, err := a.client.WaitForPeerCreated(ctx, a.state.PeerID, 2*time.Second)
+	if err != nil {
+		log.Fatalf("[ERROR] Peer %s was not created: %s", a.state.PeerID, err)
+	}
+	if peer.Direct != *direct {
+		if _, err := a.client.SetPeerDirect(ctx, a.state.PeerID, *direct); err != nil {
+			log.Fatalf("[ERROR] Failed to set direct mode of peer %s: %s", a.state.PeerID, err)
+		}
+	}
+
+	err = a.sync(ctx)
+	if err != nil {
+		a.teardown()
+		log.Fatalf("[ERROR] Failed to bring up %s: %s", a.iface, err)
+	}
+	log.Printf("[DONE] %s is up with ip %s", a.iface, a.config.IP)
+
+	changed := make(chan struct{}, 1)
+	go a.watch(ctx, changed)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("[INFO] Shutting down agent")
+			a.teardown()
+			if *deregister {
+				a.deregister()
+			}
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+		err := a.sync(ctx)
+		if a.isPeerGone(err) {
+			// the peer was deleted by an admin, there is nothing left to sync
+			log.Printf("[ERROR] Peer %s no longer exists, shutting down", a.state.PeerID)
+			a.teardown()
+			os.Remove(a.statePath())
+			os.Exit(1)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] Failed to sync config: %s", err)
+		}
+	}
+}
+
+func (a *agent) statePath() string {
+	return filepath.Join(a.stateDir, "agent.json")
+}
+
+func (a *agent) privateKeyPath() string {
+	return filepath.Join(a.stateDir, "private_key")
+}
+
+func (a *agent) saveState() error {
+	if err := os.MkdirAll(a.stateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(a.privateKeyPath(), []byte(a.state.PrivateKey+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(a.statePath(), data, 0600)
+}
+
+// register reuses the peer from a previous run, or generates a key pair locally and
+// registers the public key, with the enrollment token if there is one. The private key
+// never leaves this machine.
+func (a *agent) register(ctx context.Context, serverURL string, enrollmentToken string, networkID string, name string, label string) error {
+	data, err := os.ReadFile(a.statePath())
+	if err == nil {
+		if err := json.Unmarshal(data, &a.state); err != nil {
+			return fmt.Errorf("invalid state file %s: %w", a.statePath(), err)
+		}
+		if a.state.PeerToken != "" {
+			a.client.Token = a.state.PeerToken
+		}
+		if a.state.Server == serverURL && a.state.PeerID != "" {
+			_, err := a.client.GetPeer(ctx, a.state.PeerID)
+			if err == nil {
+				log.Printf("[INFO] Reusing peer %s", a.state.PeerID)
+				return a.saveState()
+			}
+			if !a.isPeerGone(err) {
+				return err
+			}
+			log.Printf("[INFO] Peer %s no longer exists, registering a new one", a.state.PeerID)
+			a.client.Token = a.apiToken
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	privateKey, err := generateWireguardPrivateKey()
+	if err != nil {
+		return err
+	}
+	publicKey, err := generateWireguardPublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+	if enrollmentToken != "" {
+		response, err := a.client.Enroll(ctx, client.EnrollRequest{Token: enrollmentToken, PublicKey: publicKey})
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] Enrolled peer %s", response.Peer.ID)
+		a.client.Token = response.PeerToken
+		a.state = agentState{Server: serverURL, PeerID: response.Peer.ID, PrivateKey: privateKey, PeerToken: response.PeerToken}
+		return a.saveState()
+	}
+	if a.client.Token == "" {
+		return errors.New("an enrollment token or an api token is required to register")
+	}
+	peer, err := a.client.CreatePeer(ctx, client.CreatePeerRequest{NetworkID: networkID, Name: name, Label: label, PublicKey: publicKey})
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Registered peer %s", peer.ID)
+	a.state = agentState{Server: serverURL, PeerID: peer.ID, PrivateKey: privateKey}
+	return a.saveState()
+}
+
+// isPeerGone reports whether err means the peer was deleted. With a peer token the
+// api answers 401 instead of 404, as the token went away with the peer.
+func (a *agent) isPeerGone(err error) bool {
+	return client.IsNotFound(err) || (a.state.PeerToken != "" && client.IsUnauthorized(err))
+}
+
+func (a *agent) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.client.DeletePeer(ctx, a.state.PeerID); err != nil {
+		log.Printf("[ERROR] Failed to delete peer %s: %s", a.state.PeerID, err)
+		return
+	}
+	os.Remove(a.statePath())
+	os.Remove(a.privateKeyPath())
+	log.Printf("[DONE] Deleted peer %s", a.state.PeerID)
+}
+
+func runIPCommand(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sync fetches the config and applies whatever changed since the last sync
+func (a *agent) sync(ctx context.Context) error {
+	config, err := a.client.GetPeerConfig(ctx, a.state.PeerID)
+	if err != nil {
+		// the relays may be fine while the api is not
+		if a.config != nil {
+			a.failover()
+		}
+		return err
+	}
+	if a.config != nil && reflect.DeepEqual(a.config, config) {
+		a.failover()
+		a.checkDirectPeers()
+		// retries the direct peers whose fallback is over
+		return a.applyDirectPeers(config)
+	}
+	if a.config == nil {
+		if err := a.bringUp(config); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[INFO] Config of %s changed, updating", a.iface)
+	}
+	return a.apply(config)
+}
+
+func (a *agent) bringUp(config *client.WireguardConfig) error {
+	// start from a clean interface, a previous run may have been killed
+	runIPCommand("link", "delete", "dev", a.iface)
+	a.directPeers = map[string]directPeerState{}
+	if err := runIPCommand("link", "add", "dev", a.iface, "type", "wireguard"); err != nil {
+		return err
+	}
+	if _, err := runWireguardCommand(nil, "set", a.iface, "private-key", a.privateKeyPath()); err != nil {
+		return err
+	}
+	return runIPCommand("link", "set", "up", "dev", a.iface)
+}
+
+func (a *agent) apply(config *client.WireguardConfig) error {
+	previous := a.config
+	if previous == nil || previous.IPWithMask != config.IPWithMask {
+		if previous != nil {
+			runIPCommand("address", "delete", previous.IPWithMask, "dev", a.iface)
+		}
+		if err := runIPCommand("address", "add", config.IPWithMask, "dev", a.iface); err != nil {
+			return err
+		}
+	}
+	if previous != nil && previous.RelayPublicKey != config.RelayPublicKey {
+		runWireguardCommand(nil, "set", a.iface, "peer", previous.RelayPublicKey, "remove")
+	}
+	endpoint := a.endpoint
+	if !slices.Contains(splitList(config.Endpoints), endpoint) {
+		endpoint = config.Endpoint
+	}
+	args := []string{"set", a.iface, "peer", config.RelayPublicKey, "endpoint", endpoint, "allowed-ips", config.AllowedIPs}
+	if a.keepalive > 0 {
+		args = append(args, "persistent-keepalive", fmt.Sprint(a.keepalive))
+	}
+	if _, err := runWireguardCommand(nil, args...); err != nil {
+		return err
+	}
+	a.reclaimDirectPeerIPs()
+
+	if err := a.pinRoutes(config); err != nil {
+		return err
+	}
+	routes := kernelRoutes(config.AllowedIPs)
+	for _, route := range routes {
+		if err := runIPCommand("route", "replace", route, "dev", a.iface); err != nil {
+			return err
+		}
+	}
+	if previous != nil {
+		for _, route := range kernelRoutes(previous.AllowedIPs) {
+			if !slices.Contains(routes, route) {
+				runIPCommand("route", "delete", route, "dev", a.iface)
+			}
+		}
+	}
+	if previous == nil || previous.DNS != config.DNS || previous.DNSDomain != config.DNSDomain {
+		applyDNS(a.iface, config)
+	}
+	a.config = config
+	if endpoint != a.endpoint {
+		a.endpoint = endpoint
+		a.endpointSince = time.Now()
+	}
+	return a.applyDirectPeers(config)
+}
+
+// applyDNS sends the queries for the network's domain to the relay through systemd-resolved,
+// failures are only logged as the tunnel works without names
+func applyDNS(iface string, config *client.WireguardConfig) {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		if config.DNS != "" {
+			log.Printf("[ERROR] resolvectl not found, add nameserver %s for %s to the resolver", config.DNS, config.DNSDomain)
+		}
+		return
+	}
+	commands := [][]string{{"revert", iface}}
+	if config.DNS != "" {
+		commands = [][]string{{"dns", iface, config.DNS}, {"domain", iface, config.DNSDomain}}
+	}
+	for _, args := range commands {
+		if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+			log.Printf("[ERROR] resolvectl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// kernelRoutes turns the allowed ips of the relay into routes of the interface. With egress the
+// default route is split in two halves, they win over the current default route without replacing it.
+func kernelRoutes(allowedIPs string) []string {
+	routes := []string{}
+	for _, route := range splitList(allowedIPs) {
+		if route == "0.0.0.0/0" {
+			routes = append(routes, "0.0.0.0/1", "128.0.0.0/1")
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// pinRoutes routes the relays and direct peers through the current default route when the tunnel
+// carries all traffic, wireguard would send its own packets into the tunnel otherwise
+func (a *agent) pinRoutes(config *client.WireguardConfig) error {
+	hosts := []string{}
+	if slices.Contains(splitList(config.AllowedIPs), "0.0.0.0/0") {
+		endpoints := append(splitList(config.Endpoints), config.Endpoint)
+		for _, peer := range config.DirectPeers {
+			endpoints = append(endpoints, peer.Endpoint)
+		}
+		for _, endpoint := range endpoints {
+			host, _, err := net.SplitHostPort(endpoint)
+			if err == nil && !slices.Contains(hosts, host+"/32") {
+				hosts = append(hosts, host+"/32")
+			}
+		}
+	}
+	if len(hosts) > 0 {
+		out, err := exec.Command("ip", "route", "show", "default").Output()
+		// e.g. default via 192.168.1.1 dev eth0 proto dhcp metric 100
+		fields := strings.Fields(strings.SplitN(string(out), "\n", 2)[0])
+		if err != nil || len(fields) < 2 {
+			return errors.New("no default route to reach the relay through, egress needs one")
+		}
+		for _, host := range hosts {
+			if err := runIPCommand(append([]string{"route", "replace", host}, fields[1:]...)...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, host := range a.pinnedRoutes {
+		if !slices.Contains(hosts, host) {
+			runIPCommand("route", "delete", host)
+		}
+	}
+	a.pinnedRoutes = hosts
+	return nil
+}
+
+// applyDirectPeers installs the direct peers of the config and removes the ones which are gone,
+// the peers which fell back to the relay are left out until their retry time
+func (a *agent) applyDirectPeers(config *client.WireguardConfig) error {
+	wanted := map[string]client.DirectPeer{}
+	for _, peer := range config.DirectPeers {
+		if time.Now().Before(a.fallbackUntil[peer.PublicKey]) {
+			continue
+		}
+		wanted[peer.PublicKey] = peer
+	}
+	removed := false
+	for publicKey, state := range a.directPeers {
+		if _, ok := wanted[publicKey]; !ok {
+			runWireguardCommand(nil, "set", a.iface, "peer", publicKey, "remove")
+			delete(a.directPeers, publicKey)
+			removed = true
+			log.Printf("[INFO] Removed direct peer %s", state.peer.PeerID)
+		}
+	}
+	if removed {
+		a.restoreRelayAllowedIPs()
+	}
+	for publicKey, peer := range wanted {
+		if state, ok := a.directPeers[publicKey]; ok && state.peer == peer {
+			continue
+		}
+		args := []string{"set", a.iface, "peer", publicKey, "endpoint", peer.Endpoint, "allowed-ips", peer.AllowedIPs}
+		if a.keepalive > 0 {
+			args = append(args, "persistent-keepalive", fmt.Sprint(a.keepalive))
+		}
+		if _, err := runWireguardCommand(nil, args...); err != nil {
+			return err
+		}
+		a.directPeers[publicKey] = directPeerState{peer: peer, since: time.Now()}
+		log.Printf("[INFO] Connecting directly to peer %s at %s", peer.PeerID, peer.Endpoint)
+	}
+	return nil
+}
+
+// checkDirectPeers sends the traffic of direct peers which stopped answering back through the relay
+func (a *agent) checkDirectPeers() {
+	if len(a.directPeers) == 0 {
+		return
+	}
+	handshakes, err := getWireguardLatestHandshakes(&Network{Interface: a.iface})
+	if err != nil {
+		log.Printf("[ERROR] Failed to read the handshakes of %s: %s", a.iface, err)
+		return
+	}
+	for publicKey, state := range a.directPeers {
+		lastSeen := handshakes[publicKey]
+		if lastSeen.Before(state.since) {
+			lastSeen = state.since
+		}
+		if time.Since(lastSeen) < directHandshakeTimeout {
+			continue
+		}
+		runWireguardCommand(nil, "set", a.iface, "peer", publicKey, "remove")
+		delete(a.directPeers, publicKey)
+		a.fallbackUntil[publicKey] = time.Now().Add(directRetryAfter)
+		log.Printf("[INFO] No handshake with direct peer %s since %s, using the relay", state.peer.PeerID, lastSeen.Format(time.RFC3339))
+		a.restoreRelayAllowedIPs()
+	}
+}
+
+// restoreRelayAllowedIPs gives the relay back the ips of removed direct peers. With narrow allowed ips
+// the relay and the direct peers share /32s, and wireguard keeps an ip on the peer it was set on last.
+func (a *agent) restoreRelayAllowedIPs() {
+	_, err := runWireguardCommand(nil, "set", a.iface, "peer", a.config.RelayPublicKey, "allowed-ips", a.config.AllowedIPs)
+	if err != nil {
+		log.Printf("[ERROR] Failed to restore the allowed ips of the relay: %s", err)
+		return
+	}
+	a.reclaimDirectPeerIPs()
+}
+
+// reclaimDirectPeerIPs moves the ips of the installed direct peers back from the relay
+func (a *agent) reclaimDirectPeerIPs() {
+	for publicKey, state := range a.directPeers {
+		_, err := runWireguardCommand(nil, "set", a.iface, "peer", publicKey, "allowed-ips", state.peer.AllowedIPs)
+		if err != nil {
+			log.Printf("[ERROR] Failed to set the allowed ips of direct peer %s: %s", state.peer.PeerID, err)
+		}
+	}
+}
+
+// watch triggers a sync as soon as the server reports a config change, the ticker stays as a safety net
+func (a *agent) watch(ctx context.Context, changed chan<- struct{}) {
+	var cursor uint64
+	for ctx.Err() == nil {
+		var err error
+		cursor, err = a.client.StreamPeerEvents(ctx, a.state.PeerID, cursor, func(event client.Event) error {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] Event stream of peer %s failed: %s", a.state.PeerID, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// failover moves to the next relay of the cluster when the current one stopped answering
+func (a *agent) failover() {
+	endpoints := splitList(a.config.Endpoints)
+	if len(endpoints) < 2 {
+		return
+	}
+	handshakes, err := getWireguardLatestHandshakes(&Network{Interface: a.iface})
+	if err != nil {
+		log.Printf("[ERROR] Failed to read the handshakes of %s: %s", a.iface, err)
+		return
+	}
+	lastSeen := handshakes[a.config.RelayPublicKey]
+	if lastSeen.Before(a.endpointSince) {
+		lastSeen = a.endpointSince
+	}
+	if time.Since(lastSeen) < relayFailoverAfter {
+		return
+	}
+	next := endpoints[(slices.Index(endpoints, a.endpoint)+1)%len(endpoints)]
+	if _, err := runWireguardCommand(nil, "set", a.iface, "peer", a.config.RelayPublicKey, "endpoint", next); err != nil {
+		log.Printf("[ERROR] Failed to switch to relay %s: %s", next, err)
+		return
+	}
+	log.Printf("[INFO] No handshake through %s since %s, switching to %s", a.endpoint, lastSeen.Format(time.RFC3339), next)
+	a.endpoint = next
+	a.endpointSince = time.Now()
+}
+
+// teardown removes the interface, its address and routes go with it
+func (a *agent) teardown() {
+	for _, host := range a.pinnedRoutes {
+		runIPCommand("route", "delete", host)
+	}
+	if err := runIPCommand("link", "delete", "dev", a.iface); err != nil {
+		log.Printf("[ERROR] Failed to remove %s: %s", a.iface, err)
+		return
+	}
+	log.Printf("[DONE] Removed %s", a.iface)
+}
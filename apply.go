@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"pikotunnel/client"
+)
+
+// runApply implements `pikotunnel apply -f state.yaml [--dry-run]` against a running server
+func runApply(args []string) {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	file := flags.String("f", "", "path of the desired state file (yaml or json)")
+	dryRun := flags.Bool("dry-run", false, "only print the plan")
+	f := addCLIFlags(flags)
+	flags.Parse(args)
+
+	if *file == "" {
+		fmt.Println("Usage: pikotunnel apply -f <state.yaml|state.json> [--dry-run] [--server url] [--token token]")
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		fmt.Println("Failed to read state file:", err)
+		os.Exit(1)
+	}
+	data, err = stateFileJSON(*file, data)
+	if err != nil {
+		fmt.Println("Invalid state file:", err)
+		os.Exit(1)
+	}
+	// validate locally, so a typo does not need a round trip
+	var state DesiredState
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&state); err != nil {
+		fmt.Println("Invalid state file:", err)
+		os.Exit(1)
+	}
+	if err := state.Validate(); err != nil {
+		fmt.Println("Invalid state file:", err)
+		os.Exit(1)
+	}
+
+	var request client.DesiredState
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Println("Invalid state file:", err)
+		os.Exit(1)
+	}
+	response, err := f.client().ApplyState(context.Background(), request, *dryRun)
+	if err != nil {
+		fmt.Println("Apply failed:", err)
+		os.Exit(1)
+	}
+	printStatePlan(response)
+	if response.Results != nil && !response.Results.Success {
+		os.Exit(1)
+	}
+}
+
+// stateFileJSON returns the state file as json, yaml files (.yaml, .yml or anything not starting
+// with {) are converted so both go through the same strict json decoding
+func stateFileJSON(path string, data []byte) ([]byte, error) {
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension != ".yaml" && extension != ".yml" && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return data, nil
+	}
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return nil, fmt.Errorf("the state file is empty")
+	}
+	return json.Marshal(document)
+}
+
+func printStatePlan(response *client.StateResponse) {
+	if len(response.Plan) == 0 {
+		fmt.Println("No changes, state is up to date")
+		return
+	}
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-"}
+	for _, item := range response.Plan {
+		fmt.Printf("%s %s %s\n", symbols[item.Action], item.Kind, item.Summary)
+	}
+	if response.DryRun {
+		fmt.Printf("\n%d change(s) planned, nothing applied (dry run)\n", len(response.Plan))
+		return
+	}
+	if response.Results == nil || !response.Results.Success {
+		fmt.Println("\nApply failed, nothing has been changed:")
+		if response.Results != nil {
+			for _, result := range response.Results.Results {
+				if result.Status == BatchResultError {
+					item := response.Plan[result.Index]
+					fmt.Printf("  %s %s %s: %s\n", item.Action, item.Kind, item.Summary, result.Error)
+				}
+			}
+		}
+		return
+	}
+	fmt.Printf("\n%d change(s) applied\n", len(response.Plan))
+}
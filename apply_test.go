@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStateFileJSON(t *testing.T) {
+	yamlState := `
+network: default
+peers:
+  - name: web
+    label: frontend
+  - name: db
+access_rules:
+  - peer_a: web
+    peer_b: db
+`
+	jsonState := `{"network":"default","peers":[{"name":"web","label":"frontend"},{"name":"db"}],"access_rules":[{"peer_a":"web","peer_b":"db"}]}`
+	for _, test := range []struct {
+		path string
+		data string
+	}{
+		{"state.yaml", yamlState},
+		{"state.yml", yamlState},
+		{"state", yamlState},
+		{"state.json", jsonState},
+		// json is yaml too
+		{"state.yaml", jsonState},
+	} {
+		data, err := stateFileJSON(test.path, []byte(test.data))
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		var state DesiredState
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		if state.Network != "default" || len(state.Peers) != 2 || state.Peers[0].Label != "frontend" || len(state.AccessRules) != 1 || state.AccessRules[0].PeerB != "db" {
+			t.Fatalf("%s: unexpected state %+v", test.path, state)
+		}
+	}
+
+	for _, invalid := range []string{"", "peers: [", "- web\n- db\n"} {
+		if _, err := stateFileJSON("state.yaml", []byte(invalid)); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
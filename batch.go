@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	BatchOpCreatePeer       = "create_peer"
+	BatchOpUpdatePeer       = "update_peer"
+	BatchOpDeletePeer       = "delete_peer"
+	BatchOpCreateAccessRule = "create_access_rule"
+	BatchOpDeleteAccessRule = "delete_access_rule"
+
+	maxBatchOperations = 1000
+)
+
+type BatchOperation struct {
+	Op string `json:"op"`
+	// Ref names a peer created by this batch, later operations can use "$<ref>" in place of a peer id
+	Ref       string     `json:"ref"`
+	NetworkID string     `json:"network_id"`
+	Name      string     `json:"name"`
+	Label     string     `json:"label"`
+	PeerID    string     `json:"peer_id"`
+	PeerAID   string     `json:"peer_a_id"`
+	PeerBID   string     `json:"peer_b_id"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Routes are the routed subnets a create_access_rule operation opens
+	Routes []string `json:"routes"`
+}
+
+type BatchRequest struct {
+	// Atomic rolls back every operation if one of them fails
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+type BatchResult struct {
+	Index      int                    `json:"index"`
+	Op         string                 `json:"op"`
+	Status     string                 `json:"status"`
+	Code       string                 `json:"code,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Peer       map[string]interface{} `json:"peer,omitempty"`
+	AccessRule map[string]interface{} `json:"access_rule,omitempty"`
+}
+
+type BatchResponse struct {
+	Success bool          `json:"success"`
+	Results []BatchResult `json:"results"`
+}
+
+const (
+	BatchResultOK         = "ok"
+	BatchResultError      = "error"
+	BatchResultRolledBack = "rolled_back"
+)
+
+// batchExecution tracks what has to happen once the transaction commits
+type batchExecution struct {
+	refs        map[string]string
+	jobs        []QueueJob
+	deletePeers []*Peer
+	// keys are generated before the transaction, one for every create_peer operation
+	keys []*wireguardKeyPair
+}
+
+func (b *batchExecution) resolvePeerID(id string) (string, error) {
+	id = strings.TrimSpace(id)
+	if !strings.HasPrefix(id, "$") {
+		return id, nil
+	}
+	peerID, ok := b.refs[strings.TrimPrefix(id, "$")]
+	if !ok {
+		return "", invalidError("unknown_ref", "unknown ref %s", id)
+	}
+	return peerID, nil
+}
+
+func (request *BatchRequest) Validate() error {
+	if len(request.Operations) == 0 {
+		return invalidError("invalid_batch", "operations are required")
+	}
+	if len(request.Operations) > maxBatchOperations {
+		return invalidError("invalid_batch", "a batch can have at most %d operations", maxBatchOperations)
+	}
+	return nil
+}
+
+// ExecuteBatch applies all operations in a single transaction and queues the resulting jobs after commit.
+// In non atomic mode every operation runs in its own savepoint, so a failed one does not affect the others.
+func ExecuteBatch(request BatchRequest) (*BatchResponse, error) {
+	response := &BatchResponse{Success: true, Results: make([]BatchResult, len(request.Operations))}
+	execution := &batchExecution{refs: map[string]string{}}
+	for _, operation := range request.Operations {
+		if operation.Op == BatchOpCreatePeer {
+			keys, err := generateWireguardKeyPair()
+			if err != nil {
+				return nil, err
+			}
+			execution.keys = append(execution.keys, keys)
+		}
+	}
+
+	err := GetDB().Transaction(func(tx *gorm.DB) error {
+		for i, operation := range request.Operations {
+			savepoint := fmt.Sprintf("op_%d", i)
+			if !request.Atomic {
+				if err := tx.SavePoint(savepoint).Error; err != nil {
+					return err
+				}
+			}
+			result, err := execution.apply(tx, operation)
+			result.Index = i
+			result.Op = operation.Op
+			if err != nil {
+				response.Success = false
+				result.Status = BatchResultError
+				result.Code = toDomainError(err).Code
+				result.Error = err.Error()
+				response.Results[i] = result
+				if request.Atomic {
+					return err
+				}
+				if err := tx.RollbackTo(savepoint).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			result.Status = BatchResultOK
+			response.Results[i] = result
+		}
+		return nil
+	})
+	if err != nil && !request.Atomic {
+		return nil, err
+	}
+	if err != nil {
+		// everything has been rolled back
+		for i := range response.Results {
+			if response.Results[i].Status == BatchResultError {
+				continue
+			}
+			response.Results[i] = BatchResult{Index: i, Op: request.Operations[i].Op, Status: BatchResultRolledBack}
+		}
+		return response, nil
+	}
+
+	for _, job := range execution.jobs {
+		workerQueueChannel <- job
+	}
+	for _, peer := range execution.deletePeers {
+		emitEvent(EventPeerDeleting, peerEventData(peer))
+	}
+	return response, nil
+}
+
+func (b *batchExecution) apply(tx *gorm.DB, operation BatchOperation) (BatchResult, error) {
+	result := BatchResult{}
+	switch operation.Op {
+	case BatchOpCreatePeer:
+		if operation.Ref != "" {
+			if _, ok := b.refs[operation.Ref]; ok {
+				return result, invalidError("duplicate_ref", "duplicate ref %s", operation.Ref)
+			}
+		}
+		keys := b.keys[0]
+		b.keys = b.keys[1:]
+		peer, err := createPeerTx(tx, operation.NetworkID, operation.Name, operation.Label, "", keys)
+		if err != nil {
+			return result, err
+		}
+		if operation.Ref != "" {
+			b.refs[operation.Ref] = peer.ID
+		}
+		b.jobs = append(b.jobs, QueueJob{Type: "peer", ID: peer.ID})
+		result.Peer = peerResponse(peer)
+	case BatchOpUpdatePeer:
+		peerID, err := b.resolvePeerID(operation.PeerID)
+		if err != nil {
+			return result, err
+		}
+		var peer Peer
+		err = tx.First(&peer, "id = ?", peerID).Error
+		if err != nil {
+			return result, wrapNotFound(err, peerNotFoundError(peerID))
+		}
+		// only the label can change, everything else is tied to the data plane
+		peer.Label = strings.TrimSpace(operation.Label)
+		err = tx.Model(&Peer{}).Where("id = ?", peer.ID).Update("label", peer.Label).Error
+		if err != nil {
+			return result, err
+		}
+		result.Peer = peerResponse(&peer)
+	case BatchOpDeletePeer:
+		peerID, err := b.resolvePeerID(operation.PeerID)
+		if err != nil {
+			return result, err
+		}
+		var peer Peer
+		err = tx.First(&peer, "id = ?", peerID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// already gone, same as DELETE /peers/:id
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		if peer.Status != PeerStatusDeleting {
+			err = tx.Model(&Peer{}).Where("id = ?", peer.ID).Update("status", PeerStatusDeleting).Error
+			if err != nil {
+				return result, err
+			}
+			peer.Status = PeerStatusDeleting
+			b.jobs = append(b.jobs, QueueJob{Type: "peer", ID: peer.ID})
+			b.deletePeers = append(b.deletePeers, &peer)
+		}
+		result.Peer = peerResponse(&peer)
+	case BatchOpCreateAccessRule, BatchOpDeleteAccessRule:
+		peerAID, err := b.resolvePeerID(operation.PeerAID)
+		if err != nil {
+			return result, err
+		}
+		peerBID, err := b.resolvePeerID(operation.PeerBID)
+		if err != nil {
+			return result, err
+		}
+		if operation.Op == BatchOpCreateAccessRule {
+			rule, isNew, err := createAccessRuleTx(tx, peerAID, peerBID, operation.ExpiresAt, operation.Routes)
+			if err != nil {
+				return result, err
+			}
+			if isNew {
+				b.jobs = append(b.jobs, QueueJob{Type: "access_rule", ID: rule.ID})
+			}
+			result.AccessRule = accessRuleResponse(rule, nil)
+			return result, nil
+		}
+		rule, err := getAccessRuleTx(tx, peerAID, peerBID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return result, notFoundError("access_rule_not_found", "access rule between %s and %s not found", peerAID, peerBID)
+			}
+			return result, err
+		}
+		if rule.Status != AccessRuleStatusDeleting {
+			err = tx.Model(&AccessRule{}).Where("id = ?", rule.ID).Update("status", AccessRuleStatusDeleting).Error
+			if err != nil {
+				return result, err
+			}
+			rule.Status = AccessRuleStatusDeleting
+			b.jobs = append(b.jobs, QueueJob{Type: "access_rule", ID: rule.ID})
+		}
+		result.AccessRule = accessRuleResponse(rule, nil)
+	default:
+		return result, invalidError("unknown_op", "unknown op %s", operation.Op)
+	}
+	return result, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeWireguard puts a wg on the path that prints random keys, enough for create_peer operations
+func fakeWireguard(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat > /dev/null\nhead -c 32 /dev/urandom | base64\n"
+	if err := os.WriteFile(filepath.Join(dir, "wg"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestAtomicBatchRollsBackWhenALaterOperationFails(t *testing.T) {
+	fakeWireguard(t)
+	network, err := GetDefaultNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := ExecuteBatch(BatchRequest{Atomic: true, Operations: []BatchOperation{
+		{Op: BatchOpCreatePeer, Ref: "web", Name: "batch-rollback-web"},
+		{Op: BatchOpCreatePeer, Ref: "db", Name: "batch-rollback-db"},
+		{Op: BatchOpCreateAccessRule, PeerAID: "$web", PeerBID: "$missing"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Success {
+		t.Fatal("expected the batch to fail")
+	}
+	for i, status := range []string{BatchResultRolledBack, BatchResultRolledBack, BatchResultError} {
+		if response.Results[i].Status != status {
+			t.Fatalf("expected operation %d to be %s, got %+v", i, status, response.Results[i])
+		}
+	}
+	if response.Results[2].Code != "unknown_ref" {
+		t.Fatalf("expected unknown_ref, got %s", response.Results[2].Code)
+	}
+	for _, name := range []string{"batch-rollback-web", "batch-rollback-db"} {
+		peer, err := GetPeerByName(network.ID, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer != nil {
+			DeletePeer(peer.ID)
+			t.Fatalf("expected %s to be rolled back", name)
+		}
+	}
+}
+
+func TestBatchResolvesRefsToPeersCreatedEarlier(t *testing.T) {
+	fakeWireguard(t)
+
+	response, err := ExecuteBatch(BatchRequest{Atomic: true, Operations: []BatchOperation{
+		{Op: BatchOpCreatePeer, Ref: "web", Name: "batch-ref-web"},
+		{Op: BatchOpCreatePeer, Ref: "db", Name: "batch-ref-db"},
+		{Op: BatchOpCreateAccessRule, PeerAID: "$web", PeerBID: "$db"},
+		{Op: BatchOpUpdatePeer, PeerID: "$db", Label: "database"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range response.Results {
+		if result.Peer != nil {
+			defer DeletePeer(result.Peer["id"].(string))
+		}
+		if result.AccessRule != nil {
+			defer DeleteAccessRule(result.AccessRule["id"].(string))
+		}
+	}
+	if !response.Success {
+		t.Fatalf("expected the batch to succeed, got %+v", response.Results)
+	}
+
+	webID := response.Results[0].Peer["id"].(string)
+	dbID := response.Results[1].Peer["id"].(string)
+	rule, err := GetAccessRule(webID, dbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.ID != response.Results[2].AccessRule["id"] {
+		t.Fatalf("expected rule %v between the created peers, got %s", response.Results[2].AccessRule["id"], rule.ID)
+	}
+	db, err := GetPeer(dbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Label != "database" {
+		t.Fatalf("expected the label of the ref'd peer to be updated, got %q", db.Label)
+	}
+}
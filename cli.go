@@ -0,0 +1,719 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+
+	"pikotunnel/client"
+)
+
+// cliFlags are shared by every command which talks to a running server
+type cliFlags struct {
+	serverURL *string
+	token     *string
+	output    *string
+}
+
+func addCLIFlags(flags *flag.FlagSet) *cliFlags {
+	return &cliFlags{
+		serverURL: flags.String("server", envOrDefault("PIKOTUNNEL_SERVER_URL", "http://localhost:8080"), "pikotunnel server url"),
+		token:     flags.String("token", os.Getenv("PIKOTUNNEL_API_TOKEN"), "api token"),
+		output:    flags.String("o", "table", "output format: table or json"),
+	}
+}
+
+func (f *cliFlags) client() *client.Client {
+	return client.New(*f.serverURL, *f.token)
+}
+
+// parseCLIFlags parses flags placed before, between or after positional arguments
+// and returns the positional ones
+func parseCLIFlags(flags *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func exitWithError(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(1)
+}
+
+// printOutput prints value as json, or calls table with a tab separated writer
+func printOutput(f *cliFlags, value any, table func(w *tabwriter.Writer)) {
+	switch *f.output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(value); err != nil {
+			exitWithError(err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		table(w)
+		w.Flush()
+	default:
+		exitWithError(fmt.Errorf("unknown output format %s, use table or json", *f.output))
+	}
+}
+
+// resolvePeerID accepts a peer id or a peer name
+func resolvePeerID(ctx context.Context, c *client.Client, peer string) (string, error) {
+	if _, err := uuid.Parse(peer); err == nil {
+		return peer, nil
+	}
+	list, err := c.ListPeers(ctx, client.ListPeersOptions{Name: peer})
+	if err != nil {
+		return "", err
+	}
+	// a deleting peer has given up its name
+	ids := []string{}
+	for _, item := range list.Items {
+		if item.Status != client.PeerStatusDeleting {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("peer %s not found", peer)
+	}
+	// names are unique per network only
+	if len(ids) > 1 {
+		return "", fmt.Errorf("several networks have a peer named %s, use the peer id", peer)
+	}
+	return ids[0], nil
+}
+
+// resolveNetworkID accepts a network id or a network name
+func resolveNetworkID(ctx context.Context, c *client.Client, network string) (string, error) {
+	if network == "" {
+		return "", nil
+	}
+	if _, err := uuid.Parse(network); err == nil {
+		return network, nil
+	}
+	networks, err := c.ListNetworks(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range networks {
+		if item.Name == network {
+			return item.ID, nil
+		}
+	}
+	return "", fmt.Errorf("network %s not found", network)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func printPeerTable(w *tabwriter.Writer, peers []client.Peer) {
+	fmt.Fprintln(w, "ID\tNAME\tLABEL\tIP\tSTATUS\tCREATED")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", peer.ID, orDash(peer.Name), orDash(peer.Label), peer.IP, peer.Status, peer.CreatedAt.Format(time.RFC3339))
+	}
+}
+
+func printAccessRuleTable(w *tabwriter.Writer, rules []client.AccessRule) {
+	fmt.Fprintln(w, "ID\tPEER A\tPEER B\tSTATUS\tEXPIRES")
+	for _, rule := range rules {
+		expires := "-"
+		if rule.ExpiresAt != nil {
+			expires = rule.ExpiresAt.Format(time.RFC3339)
+		}
+		peerA := fmt.Sprintf("%s (%s)", orDash(rule.PeerAName), rule.PeerAIP)
+		peerB := fmt.Sprintf("%s (%s)", orDash(rule.PeerBName), rule.PeerBIP)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", rule.ID, peerA, peerB, rule.Status, expires)
+	}
+}
+
+const peerUsage = `Usage: pikotunnel peer <command> [flags]
+
+Commands:
+  create [--network network] [--name name] [--label label] [--wait]
+  list [--network network] [--status status] [--label label] [--name name] [--ip ip]
+  get <peer>
+  delete <peer>
+  config <peer>
+  script <peer>
+  routes <peer> [subnet...]
+  egress <peer> on|off
+  limits <peer> [--ingress kbit] [--egress kbit]
+  usage <peer>
+
+<peer> is a peer id or name, <network> a network id or name. Every command accepts --server, --token and -o table|json.`
+
+// runPeerCommand implements `pikotunnel peer ...` against a running server
+func runPeerCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(peerUsage)
+		os.Exit(1)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("peer "+command, flag.ExitOnError)
+	f := addCLIFlags(flags)
+	ctx := context.Background()
+
+	switch command {
+	case "create":
+		network := flags.String("network", "", "network of the peer, the default network if not set")
+		name := flags.String("name", "", "peer name, a lowercase dns label")
+		label := flags.String("label", "", "peer label")
+		wait := flags.Bool("wait", false, "wait until the peer is added to wireguard")
+		parseCLIFlags(flags, args[1:])
+		c := f.client()
+		networkID, err := resolveNetworkID(ctx, c, *network)
+		if err != nil {
+			exitWithError(err)
+		}
+		peer, err := c.CreatePeer(ctx, client.CreatePeerRequest{NetworkID: networkID, Name: *name, Label: *label})
+		if err != nil {
+			exitWithError(err)
+		}
+		if *wait {
+			waitCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			peer, err = c.WaitForPeerCreated(waitCtx, peer.ID, time.Second)
+			cancel()
+			if err != nil {
+				exitWithError(err)
+			}
+		}
+		printOutput(f, peer, func(w *tabwriter.Writer) { printPeerTable(w, []client.Peer{*peer}) })
+
+	case "list":
+		network := flags.String("network", "", "filter by network")
+		status := flags.String("status", "", "filter by status")
+		label := flags.String("label", "", "filter by label")
+		name := flags.String("name", "", "filter by name")
+		ip := flags.String("ip", "", "filter by ip")
+		parseCLIFlags(flags, args[1:])
+		c := f.client()
+		networkID, err := resolveNetworkID(ctx, c, *network)
+		if err != nil {
+			exitWithError(err)
+		}
+		options := client.ListPeersOptions{NetworkID: networkID, Status: client.PeerStatus(*status), Label: *label, Name: *name, IP: *ip}
+		peers := []client.Peer{}
+		for {
+			list, err := c.ListPeers(ctx, options)
+			if err != nil {
+				exitWithError(err)
+			}
+			peers = append(peers, list.Items...)
+			if list.NextCursor == "" {
+				break
+			}
+			options.Cursor = list.NextCursor
+		}
+		printOutput(f, peers, func(w *tabwriter.Writer) { printPeerTable(w, peers) })
+
+	case "egress":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 2 || (positional[1] != "on" && positional[1] != "off") {
+			fmt.Println(peerUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		id, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		peer, err := c.SetPeerEgress(ctx, id, positional[1] == "on")
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, peer, func(w *tabwriter.Writer) { printPeerTable(w, []client.Peer{*peer}) })
+
+	case "limits":
+		ingress := flags.Int("ingress", 0, "limit of the traffic sent by the peer in kbit/s, 0 is unlimited")
+		egress := flags.Int("egress", 0, "limit of the traffic received by the peer in kbit/s, 0 is unlimited")
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(peerUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		id, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		peer, err := c.SetPeerRateLimits(ctx, id, *ingress, *egress)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, peer, func(w *tabwriter.Writer) { printPeerTable(w, []client.Peer{*peer}) })
+
+	case "usage":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(peerUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		id, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		usage, err := c.GetPeerUsage(ctx, id)
+		if err != nil {
+			exitWithError(err)
+		}
+		limit := func(kbit int) string {
+			if kbit == 0 {
+				return "-"
+			}
+			return fmt.Sprintf("%d kbit/s", kbit)
+		}
+		printOutput(f, usage, func(w *tabwriter.Writer) {
+			fmt.Fprintln(w, "DIRECTION\tBYTES\tRATE\tLIMIT")
+			fmt.Fprintf(w, "ingress\t%d\t%d kbit/s\t%s\n", usage.IngressBytes, usage.IngressKbit, limit(usage.IngressLimitKbit))
+			fmt.Fprintf(w, "egress\t%d\t%d kbit/s\t%s\n", usage.EgressBytes, usage.EgressKbit, limit(usage.EgressLimitKbit))
+		})
+
+	case "routes":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) == 0 {
+			fmt.Println(peerUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		id, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		// no subnet removes the routes of the peer
+		peer, err := c.SetPeerRoutes(ctx, id, positional[1:])
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, peer, func(w *tabwriter.Writer) { printPeerTable(w, []client.Peer{*peer}) })
+
+	case "get", "delete", "config", "script":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(peerUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		id, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		switch command {
+		case "get":
+			peer, err := c.GetPeer(ctx, id)
+			if err != nil {
+				exitWithError(err)
+			}
+			printOutput(f, peer, func(w *tabwriter.Writer) { printPeerTable(w, []client.Peer{*peer}) })
+		case "delete":
+			if err := c.DeletePeer(ctx, id); err != nil {
+				exitWithError(err)
+			}
+			fmt.Printf("Peer %s marked for deletion\n", id)
+		case "config":
+			config, err := c.GetPeerConfig(ctx, id)
+			if err != nil {
+				exitWithError(err)
+			}
+			printOutput(f, config, func(w *tabwriter.Writer) {
+				fmt.Fprintf(w, "IP\t%s\n", config.IPWithMask)
+				fmt.Fprintf(w, "PUBLIC KEY\t%s\n", config.PublicKey)
+				fmt.Fprintf(w, "PRIVATE KEY\t%s\n", config.PrivateKey)
+				fmt.Fprintf(w, "RELAY PUBLIC KEY\t%s\n", config.RelayPublicKey)
+				fmt.Fprintf(w, "ENDPOINT\t%s\n", config.Endpoint)
+				fmt.Fprintf(w, "ALLOWED IPS\t%s\n", config.AllowedIPs)
+			})
+		case "script":
+			script, err := c.GetPeerScript(ctx, id)
+			if err != nil {
+				exitWithError(err)
+			}
+			// the script is meant to be piped into a shell, so it is printed raw in table mode
+			printOutput(f, script, func(w *tabwriter.Writer) { fmt.Print(script) })
+		}
+
+	default:
+		fmt.Println(peerUsage)
+		os.Exit(1)
+	}
+}
+
+const ruleUsage = `Usage: pikotunnel rule <command> [flags]
+
+Commands:
+  create <peer a> <peer b> [--expires-in duration] [--routes subnet,...]
+  list [--network network] [--peer peer] [--status status]
+  delete <peer a> <peer b>
+
+<peer> is a peer id or name, <network> a network id or name. Every command accepts --server, --token and -o table|json.`
+
+// runRuleCommand implements `pikotunnel rule ...` against a running server
+func runRuleCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(ruleUsage)
+		os.Exit(1)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("rule "+command, flag.ExitOnError)
+	f := addCLIFlags(flags)
+	ctx := context.Background()
+
+	switch command {
+	case "create", "delete":
+		expiresIn := flags.Duration("expires-in", 0, "revoke the rule automatically after this duration, e.g. 8h")
+		routes := flags.String("routes", "", "comma separated routed subnets of either peer to open to the other one")
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 2 {
+			fmt.Println(ruleUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		peerAID, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		peerBID, err := resolvePeerID(ctx, c, positional[1])
+		if err != nil {
+			exitWithError(err)
+		}
+		if command == "delete" {
+			if err := c.DeleteAccessRule(ctx, peerAID, peerBID); err != nil {
+				exitWithError(err)
+			}
+			fmt.Println("Access rule revoked")
+			return
+		}
+		request := client.CreateAccessRuleRequest{Routes: splitList(*routes)}
+		if *expiresIn > 0 {
+			expiresAt := time.Now().Add(*expiresIn).UTC()
+			request.ExpiresAt = &expiresAt
+		}
+		rule, err := c.CreateAccessRule(ctx, peerAID, peerBID, request)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, rule, func(w *tabwriter.Writer) { printAccessRuleTable(w, []client.AccessRule{*rule}) })
+
+	case "list":
+		network := flags.String("network", "", "filter by network")
+		peer := flags.String("peer", "", "only rules of this peer")
+		status := flags.String("status", "", "filter by status")
+		parseCLIFlags(flags, args[1:])
+		c := f.client()
+		networkID, err := resolveNetworkID(ctx, c, *network)
+		if err != nil {
+			exitWithError(err)
+		}
+		options := client.ListAccessRulesOptions{NetworkID: networkID, Status: client.AccessRuleStatus(*status)}
+		if *peer != "" {
+			id, err := resolvePeerID(ctx, c, *peer)
+			if err != nil {
+				exitWithError(err)
+			}
+			options.PeerID = id
+		}
+		rules := []client.AccessRule{}
+		for {
+			list, err := c.ListAccessRules(ctx, options)
+			if err != nil {
+				exitWithError(err)
+			}
+			rules = append(rules, list.Items...)
+			if list.NextCursor == "" {
+				break
+			}
+			options.Cursor = list.NextCursor
+		}
+		printOutput(f, rules, func(w *tabwriter.Writer) { printAccessRuleTable(w, rules) })
+
+	default:
+		fmt.Println(ruleUsage)
+		os.Exit(1)
+	}
+}
+
+// stringListFlag collects a flag given several times
+type stringListFlag []string
+
+func (l *stringListFlag) String() string {
+	return fmt.Sprint([]string(*l))
+}
+
+func (l *stringListFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+const tokenUsage = `Usage: pikotunnel token <command> [flags]
+
+Commands:
+  create [--network network] [--name name] [--label label] [--rule peer]... [--expires-in duration]
+  list
+  delete <token id>
+
+Enrollment tokens are single use, the enrolled peer gets the name, label and access rules of the token.
+Every command accepts --server, --token and -o table|json.`
+
+// runTokenCommand implements `pikotunnel token ...` to manage enrollment tokens
+func runTokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(tokenUsage)
+		os.Exit(1)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("token "+command, flag.ExitOnError)
+	f := addCLIFlags(flags)
+	ctx := context.Background()
+
+	printTokenTable := func(w *tabwriter.Writer, tokens []client.EnrollmentToken) {
+		fmt.Fprintln(w, "ID\tNAME\tLABEL\tRULES\tEXPIRES\tUSED BY")
+		for _, token := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", token.ID, orDash(token.Name), orDash(token.Label), len(token.AccessRulePeerIDs), token.ExpiresAt.Format(time.RFC3339), orDash(token.PeerID))
+		}
+	}
+
+	switch command {
+	case "create":
+		network := flags.String("network", "", "network of the enrolled peer, the default network if not set")
+		name := flags.String("name", "", "name of the enrolled peer")
+		label := flags.String("label", "", "label of the enrolled peer")
+		expiresIn := flags.Duration("expires-in", 24*time.Hour, "token lifetime")
+		var rules stringListFlag
+		flags.Var(&rules, "rule", "peer the enrolled peer gets an access rule with, can be repeated")
+		parseCLIFlags(flags, args[1:])
+		c := f.client()
+		networkID, err := resolveNetworkID(ctx, c, *network)
+		if err != nil {
+			exitWithError(err)
+		}
+		request := client.CreateEnrollmentTokenRequest{NetworkID: networkID, Name: *name, Label: *label}
+		for _, peer := range rules {
+			id, err := resolvePeerID(ctx, c, peer)
+			if err != nil {
+				exitWithError(err)
+			}
+			request.AccessRulePeerIDs = append(request.AccessRulePeerIDs, id)
+		}
+		expiresAt := time.Now().Add(*expiresIn).UTC()
+		request.ExpiresAt = &expiresAt
+		token, err := c.CreateEnrollmentToken(ctx, request)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, token, func(w *tabwriter.Writer) {
+			printTokenTable(w, []client.EnrollmentToken{*token})
+			fmt.Fprintf(w, "\nToken (shown once): %s\n", token.Token)
+		})
+
+	case "list":
+		parseCLIFlags(flags, args[1:])
+		tokens, err := f.client().ListEnrollmentTokens(ctx)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, tokens, func(w *tabwriter.Writer) { printTokenTable(w, tokens) })
+
+	case "delete":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(tokenUsage)
+			os.Exit(1)
+		}
+		if err := f.client().DeleteEnrollmentToken(ctx, positional[0]); err != nil {
+			exitWithError(err)
+		}
+		fmt.Println("Enrollment token revoked")
+
+	default:
+		fmt.Println(tokenUsage)
+		os.Exit(1)
+	}
+}
+
+const networkUsage = `Usage: pikotunnel network <command> [flags]
+
+Commands:
+  create <name> --subnet 10.1.0.1/16 --listen-port 51821 [--interface name]
+  list
+  get <network>
+  delete <network>
+
+<network> is a network id or name. Only empty networks can be deleted.
+Every command accepts --server, --token and -o table|json.`
+
+// runNetworkCommand implements `pikotunnel network ...` against a running server
+func runNetworkCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(networkUsage)
+		os.Exit(1)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("network "+command, flag.ExitOnError)
+	f := addCLIFlags(flags)
+	ctx := context.Background()
+
+	printNetworkTable := func(w *tabwriter.Writer, networks []client.Network) {
+		fmt.Fprintln(w, "ID\tNAME\tSUBNET\tPORT\tINTERFACE\tSTATUS")
+		for _, network := range networks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", network.ID, network.Name, network.Subnet, network.ListenPort, network.Interface, network.Status)
+		}
+	}
+
+	switch command {
+	case "create":
+		subnet := flags.String("subnet", "", "relay address and prefix of the network, e.g. 10.1.0.1/16")
+		listenPort := flags.Int("listen-port", 0, "udp port of the network interface")
+		iface := flags.String("interface", "", "interface name, pt-<name> if not set")
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(networkUsage)
+			os.Exit(1)
+		}
+		network, err := f.client().CreateNetwork(ctx, client.CreateNetworkRequest{Name: positional[0], Subnet: *subnet, ListenPort: *listenPort, Interface: *iface})
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, network, func(w *tabwriter.Writer) { printNetworkTable(w, []client.Network{*network}) })
+
+	case "list":
+		parseCLIFlags(flags, args[1:])
+		networks, err := f.client().ListNetworks(ctx)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, networks, func(w *tabwriter.Writer) { printNetworkTable(w, networks) })
+
+	case "get", "delete":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(networkUsage)
+			os.Exit(1)
+		}
+		c := f.client()
+		id, err := resolveNetworkID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		if command == "delete" {
+			if err := c.DeleteNetwork(ctx, id); err != nil {
+				exitWithError(err)
+			}
+			fmt.Printf("Network %s marked for deletion\n", id)
+			return
+		}
+		network, err := c.GetNetwork(ctx, id)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, network, func(w *tabwriter.Writer) { printNetworkTable(w, []client.Network{*network}) })
+
+	default:
+		fmt.Println(networkUsage)
+		os.Exit(1)
+	}
+}
+
+const forwardUsage = `Usage: pikotunnel forward <command> [flags]
+
+Commands:
+  create <peer> <public port> [--peer-port port] [--protocol tcp|udp]
+  list [--peer peer]
+  delete <port forward id>
+
+<peer> is a peer id or name. The public port is opened on the relay and forwarded to the peer.
+Every command accepts --server, --token and -o table|json.`
+
+// runForwardCommand implements `pikotunnel forward ...` to manage port forwards
+func runForwardCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(forwardUsage)
+		os.Exit(1)
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("forward "+command, flag.ExitOnError)
+	f := addCLIFlags(flags)
+	ctx := context.Background()
+
+	printForwardTable := func(w *tabwriter.Writer, forwards []client.PortForward) {
+		fmt.Fprintln(w, "ID\tPEER\tPROTOCOL\tPUBLIC PORT\tPEER PORT\tSTATUS")
+		for _, forward := range forwards {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", forward.ID, forward.PeerID, forward.Protocol, forward.PublicPort, forward.PeerPort, forward.Status)
+		}
+	}
+
+	switch command {
+	case "create":
+		peerPort := flags.Int("peer-port", 0, "port of the peer, the public port if not set")
+		protocol := flags.String("protocol", "tcp", "tcp or udp")
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 2 {
+			fmt.Println(forwardUsage)
+			os.Exit(1)
+		}
+		publicPort, err := strconv.Atoi(positional[1])
+		if err != nil {
+			exitWithError(fmt.Errorf("invalid public port %s", positional[1]))
+		}
+		c := f.client()
+		peerID, err := resolvePeerID(ctx, c, positional[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		forward, err := c.CreatePortForward(ctx, client.CreatePortForwardRequest{PeerID: peerID, Protocol: *protocol, PublicPort: publicPort, PeerPort: *peerPort})
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, forward, func(w *tabwriter.Writer) { printForwardTable(w, []client.PortForward{*forward}) })
+
+	case "list":
+		peer := flags.String("peer", "", "only the port forwards of this peer")
+		parseCLIFlags(flags, args[1:])
+		c := f.client()
+		peerID := ""
+		if *peer != "" {
+			id, err := resolvePeerID(ctx, c, *peer)
+			if err != nil {
+				exitWithError(err)
+			}
+			peerID = id
+		}
+		forwards, err := c.ListPortForwards(ctx, peerID)
+		if err != nil {
+			exitWithError(err)
+		}
+		printOutput(f, forwards, func(w *tabwriter.Writer) { printForwardTable(w, forwards) })
+
+	case "delete":
+		positional := parseCLIFlags(flags, args[1:])
+		if len(positional) != 1 {
+			fmt.Println(forwardUsage)
+			os.Exit(1)
+		}
+		if err := f.client().DeletePortForward(ctx, positional[0]); err != nil {
+			exitWithError(err)
+		}
+		fmt.Printf("Port forward %s marked for deletion\n", positional[0])
+
+	default:
+		fmt.Println(forwardUsage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,592 @@
+// Package client is the Go client for the pikotunnel api.
+//
+//	c := client.New("http://localhost:8080", os.Getenv("PIKOTUNNEL_API_TOKEN"))
+//	peer, err := c.CreatePeer(ctx, client.CreatePeerRequest{Name: "web-1"})
+//	peer, err = c.WaitForPeerCreated(ctx, peer.ID, time.Second)
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPeerFailed  = errors.New("peer failed to be created")
+	ErrPeerDeleted = errors.New("peer is being deleted")
+)
+
+// APIError is the uniform error body returned by the api
+type APIError struct {
+	StatusCode int      `json:"-"`
+	Code       string   `json:"code"`
+	Message    string   `json:"message"`
+	Details    []string `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if len(e.Details) > 0 {
+		return fmt.Sprintf("%s (%d %s): %s", e.Message, e.StatusCode, e.Code, strings.Join(e.Details, "; "))
+	}
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// IsNotFound reports whether err is a 404 from the api
+func IsNotFound(err error) bool {
+	var apiError *APIError
+	return errors.As(err, &apiError) && apiError.StatusCode == http.StatusNotFound
+}
+
+// IsUnauthorized reports whether err is a 401 from the api
+func IsUnauthorized(err error) bool {
+	var apiError *APIError
+	return errors.As(err, &apiError) && apiError.StatusCode == http.StatusUnauthorized
+}
+
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+func New(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Token:      token,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// do sends the request and decodes the response into out. Statuses in accept are
+// decoded as success, everything else is returned as *APIError.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, idempotencyKey string, in any, out any, accept ...int) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		request.Header.Set("Authorization", c.Token)
+	}
+	if idempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(accept) == 0 {
+		accept = []int{http.StatusOK}
+	}
+	for _, status := range accept {
+		if response.StatusCode != status {
+			continue
+		}
+		if out == nil || len(data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+	apiError := &APIError{StatusCode: response.StatusCode}
+	if err := json.Unmarshal(data, apiError); err != nil || apiError.Code == "" {
+		apiError.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(response.StatusCode), " ", "_"))
+		apiError.Message = strings.TrimSpace(string(data))
+	}
+	return apiError
+}
+
+func (options ListOptions) values() url.Values {
+	query := url.Values{}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Cursor != "" {
+		query.Set("cursor", options.Cursor)
+	}
+	if options.Sort != "" {
+		query.Set("sort", options.Sort)
+	}
+	if options.Order != "" {
+		query.Set("order", options.Order)
+	}
+	if options.CreatedAfter != nil {
+		query.Set("created_after", options.CreatedAfter.Format(time.RFC3339))
+	}
+	if options.CreatedBefore != nil {
+		query.Set("created_before", options.CreatedBefore.Format(time.RFC3339))
+	}
+	return query
+}
+
+func setIfNotEmpty(query url.Values, key string, value string) {
+	if value != "" {
+		query.Set(key, value)
+	}
+}
+
+// OpenAPISpec returns the raw OpenAPI document served by the api
+func (c *Client) OpenAPISpec(ctx context.Context) (json.RawMessage, error) {
+	var spec json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/openapi.json", nil, "", nil, &spec)
+	return spec, err
+}
+
+// CreateNetwork creates a pending network, the server then sets up its interface
+func (c *Client) CreateNetwork(ctx context.Context, request CreateNetworkRequest) (*Network, error) {
+	var network Network
+	err := c.do(ctx, http.MethodPost, "/networks", nil, request.IdempotencyKey, request, &network, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
+
+func (c *Client) ListNetworks(ctx context.Context) ([]Network, error) {
+	var networks []Network
+	err := c.do(ctx, http.MethodGet, "/networks", nil, "", nil, &networks)
+	return networks, err
+}
+
+func (c *Client) GetNetwork(ctx context.Context, id string) (*Network, error) {
+	var network Network
+	err := c.do(ctx, http.MethodGet, "/networks/"+url.PathEscape(id), nil, "", nil, &network)
+	if err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
+
+// DeleteNetwork removes an empty network, the default network cannot be deleted
+func (c *Client) DeleteNetwork(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/networks/"+url.PathEscape(id), nil, "", nil, nil, http.StatusNoContent)
+}
+
+func (c *Client) CreatePeer(ctx context.Context, request CreatePeerRequest) (*Peer, error) {
+	var peer Peer
+	err := c.do(ctx, http.MethodPost, "/peers", nil, request.IdempotencyKey, request, &peer, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+func (c *Client) ListPeers(ctx context.Context, options ListPeersOptions) (*List[Peer], error) {
+	query := options.ListOptions.values()
+	setIfNotEmpty(query, "network_id", options.NetworkID)
+	setIfNotEmpty(query, "status", string(options.Status))
+	setIfNotEmpty(query, "ip", options.IP)
+	setIfNotEmpty(query, "label", options.Label)
+	setIfNotEmpty(query, "name", options.Name)
+	var list List[Peer]
+	err := c.do(ctx, http.MethodGet, "/peers", query, "", nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c *Client) GetPeer(ctx context.Context, id string) (*Peer, error) {
+	var peer Peer
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id), nil, "", nil, &peer)
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+func (c *Client) GetPeerStatus(ctx context.Context, id string) (PeerStatus, error) {
+	var response struct {
+		Status PeerStatus `json:"status"`
+	}
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/status", nil, "", nil, &response)
+	return response.Status, err
+}
+
+func (c *Client) GetPeerConfig(ctx context.Context, id string) (*WireguardConfig, error) {
+	var config WireguardConfig
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/config", nil, "", nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// GetPeerScript returns the shell script which sets up wireguard on the peer
+func (c *Client) GetPeerScript(ctx context.Context, id string) (string, error) {
+	var script string
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/script", nil, "", nil, &script)
+	return script, err
+}
+
+func (c *Client) ListPeerAccessRules(ctx context.Context, id string) ([]AccessRule, error) {
+	var rules []AccessRule
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/access-rules", nil, "", nil, &rules)
+	return rules, err
+}
+
+func (c *Client) ListPeerReachableBy(ctx context.Context, id string) ([]ReachablePeer, error) {
+	var peers []ReachablePeer
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/reachable-by", nil, "", nil, &peers)
+	return peers, err
+}
+
+// SetPeerDirect opts the peer in or out of direct connections with the peers it has access rules with
+func (c *Client) SetPeerDirect(ctx context.Context, id string, direct bool) (*Peer, error) {
+	var peer Peer
+	err := c.do(ctx, http.MethodPut, "/peers/"+url.PathEscape(id)+"/direct", nil, "", map[string]bool{"direct": direct}, &peer)
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// SetPeerRoutes makes the peer the gateway of the given subnets, an empty list removes them
+func (c *Client) SetPeerRoutes(ctx context.Context, id string, routes []string) (*Peer, error) {
+	var peer Peer
+	err := c.do(ctx, http.MethodPut, "/peers/"+url.PathEscape(id)+"/routes", nil, "", map[string][]string{"routes": routes}, &peer)
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// SetPeerEgress allows or stops the peer reaching the internet through the relay
+func (c *Client) SetPeerEgress(ctx context.Context, id string, egress bool) (*Peer, error) {
+	var peer Peer
+	err := c.do(ctx, http.MethodPut, "/peers/"+url.PathEscape(id)+"/egress", nil, "", map[string]bool{"egress": egress}, &peer)
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// SetPeerRateLimits limits the bandwidth of the peer in kbit/s, 0 removes a limit
+func (c *Client) SetPeerRateLimits(ctx context.Context, id string, ingressKbit int, egressKbit int) (*Peer, error) {
+	var peer Peer
+	body := map[string]int{"ingress_limit_kbit": ingressKbit, "egress_limit_kbit": egressKbit}
+	err := c.do(ctx, http.MethodPut, "/peers/"+url.PathEscape(id)+"/limits", nil, "", body, &peer)
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+func (c *Client) GetPeerUsage(ctx context.Context, id string) (*PeerUsage, error) {
+	var usage PeerUsage
+	err := c.do(ctx, http.MethodGet, "/peers/"+url.PathEscape(id)+"/usage", nil, "", nil, &usage)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// DeletePeer marks the peer for deletion, the worker removes it from wireguard
+func (c *Client) DeletePeer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/peers/"+url.PathEscape(id), nil, "", nil, nil, http.StatusNoContent)
+}
+
+// WaitForPeerCreated polls the peer status every interval until the worker has added it to
+// wireguard. It returns ErrPeerFailed or ErrPeerDeleted if the peer will never be created.
+func (c *Client) WaitForPeerCreated(ctx context.Context, id string, interval time.Duration) (*Peer, error) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := c.GetPeerStatus(ctx, id)
+		if err != nil {
+			if IsNotFound(err) {
+				return nil, ErrPeerDeleted
+			}
+			return nil, err
+		}
+		switch status {
+		case PeerStatusCreated:
+			return c.GetPeer(ctx, id)
+		case PeerStatusFailed:
+			return nil, ErrPeerFailed
+		case PeerStatusDeleting:
+			return nil, ErrPeerDeleted
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func accessRulePath(peerAID string, peerBID string) string {
+	return "/access-rule/" + url.PathEscape(peerAID) + "/" + url.PathEscape(peerBID)
+}
+
+// CreateAccessRule allows traffic between two peers, an existing rule is returned as is
+func (c *Client) CreateAccessRule(ctx context.Context, peerAID string, peerBID string, request CreateAccessRuleRequest) (*AccessRule, error) {
+	var rule AccessRule
+	err := c.do(ctx, http.MethodPost, accessRulePath(peerAID, peerBID), nil, request.IdempotencyKey, request, &rule, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (c *Client) GetAccessRule(ctx context.Context, peerAID string, peerBID string) (*AccessRule, error) {
+	var rule AccessRule
+	err := c.do(ctx, http.MethodGet, accessRulePath(peerAID, peerBID), nil, "", nil, &rule)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (c *Client) DeleteAccessRule(ctx context.Context, peerAID string, peerBID string) error {
+	return c.do(ctx, http.MethodDelete, accessRulePath(peerAID, peerBID), nil, "", nil, nil, http.StatusNoContent)
+}
+
+func (c *Client) ListAccessRules(ctx context.Context, options ListAccessRulesOptions) (*List[AccessRule], error) {
+	query := options.ListOptions.values()
+	setIfNotEmpty(query, "network_id", options.NetworkID)
+	setIfNotEmpty(query, "status", string(options.Status))
+	setIfNotEmpty(query, "peer_id", options.PeerID)
+	var list List[AccessRule]
+	err := c.do(ctx, http.MethodGet, "/access-rules", query, "", nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Batch runs the operations in one transaction. A failed atomic batch is not an error,
+// the per operation results are returned with Success set to false.
+func (c *Client) Batch(ctx context.Context, request BatchRequest) (*BatchResponse, error) {
+	var response BatchResponse
+	err := c.do(ctx, http.MethodPost, "/batch", nil, request.IdempotencyKey, request, &response, http.StatusOK, http.StatusUnprocessableEntity)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// ApplyState converges the server to the desired state, with dryRun only the plan is returned
+func (c *Client) ApplyState(ctx context.Context, state DesiredState, dryRun bool) (*StateResponse, error) {
+	query := url.Values{}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+	var response StateResponse
+	err := c.do(ctx, http.MethodPut, "/state", query, "", state, &response, http.StatusOK, http.StatusUnprocessableEntity)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// CreatePortForward exposes a port of a peer on the relay, a public port can only be forwarded once
+func (c *Client) CreatePortForward(ctx context.Context, request CreatePortForwardRequest) (*PortForward, error) {
+	var forward PortForward
+	err := c.do(ctx, http.MethodPost, "/port-forwards", nil, request.IdempotencyKey, request, &forward, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &forward, nil
+}
+
+// ListPortForwards lists the port forwards of the peer, or all of them when peerID is empty
+func (c *Client) ListPortForwards(ctx context.Context, peerID string) ([]PortForward, error) {
+	query := url.Values{}
+	setIfNotEmpty(query, "peer_id", peerID)
+	var forwards []PortForward
+	err := c.do(ctx, http.MethodGet, "/port-forwards", query, "", nil, &forwards)
+	return forwards, err
+}
+
+func (c *Client) GetPortForward(ctx context.Context, id string) (*PortForward, error) {
+	var forward PortForward
+	err := c.do(ctx, http.MethodGet, "/port-forwards/"+url.PathEscape(id), nil, "", nil, &forward)
+	if err != nil {
+		return nil, err
+	}
+	return &forward, nil
+}
+
+// DeletePortForward marks the port forward for deletion, the worker removes its rules
+func (c *Client) DeletePortForward(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/port-forwards/"+url.PathEscape(id), nil, "", nil, nil, http.StatusNoContent)
+}
+
+func (c *Client) CreateWebhook(ctx context.Context, request CreateWebhookRequest) (*Webhook, error) {
+	var webhook Webhook
+	err := c.do(ctx, http.MethodPost, "/webhooks", nil, request.IdempotencyKey, request, &webhook, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (c *Client) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	var webhooks []Webhook
+	err := c.do(ctx, http.MethodGet, "/webhooks", nil, "", nil, &webhooks)
+	return webhooks, err
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/webhooks/"+url.PathEscape(id), nil, "", nil, nil, http.StatusNoContent)
+}
+
+// CreateEnrollmentToken mints a single use token, the plain token is only returned here. It is not
+// idempotent, retrying mints another token.
+func (c *Client) CreateEnrollmentToken(ctx context.Context, request CreateEnrollmentTokenRequest) (*EnrollmentToken, error) {
+	var token EnrollmentToken
+	err := c.do(ctx, http.MethodPost, "/enrollment-tokens", nil, "", request, &token, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (c *Client) ListEnrollmentTokens(ctx context.Context) ([]EnrollmentToken, error) {
+	var tokens []EnrollmentToken
+	err := c.do(ctx, http.MethodGet, "/enrollment-tokens", nil, "", nil, &tokens)
+	return tokens, err
+}
+
+func (c *Client) DeleteEnrollmentToken(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/enrollment-tokens/"+url.PathEscape(id), nil, "", nil, nil, http.StatusNoContent)
+}
+
+// Enroll exchanges an enrollment token for a peer, it does not need the api token.
+// Leave PublicKey empty to have the relay generate the key pair.
+func (c *Client) Enroll(ctx context.Context, request EnrollRequest) (*EnrollResponse, error) {
+	var response EnrollResponse
+	err := c.do(ctx, http.MethodPost, "/enroll", nil, "", request, &response, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// ListRelays returns the relays of the cluster with the time they were last seen
+func (c *Client) ListRelays(ctx context.Context) ([]Relay, error) {
+	var relays []Relay
+	err := c.do(ctx, http.MethodGet, "/cluster/relays", nil, "", nil, &relays)
+	return relays, err
+}
+
+// SendRelayHeartbeat registers a follower relay with the leader
+func (c *Client) SendRelayHeartbeat(ctx context.Context, request RelayHeartbeatRequest) error {
+	return c.do(ctx, http.MethodPost, "/cluster/heartbeat", nil, "", request, nil)
+}
+
+// GetClusterSnapshot returns the raw state followers replicate, including the network private keys
+func (c *Client) GetClusterSnapshot(ctx context.Context) (json.RawMessage, error) {
+	var snapshot json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/cluster/snapshot", nil, "", nil, &snapshot)
+	return snapshot, err
+}
+
+// StreamEvents calls handler for every event after cursor (0 replays the retained backlog)
+// until ctx is cancelled, the handler returns an error or the server closes the stream.
+// The returned cursor is the id of the last handled event, pass it back in to resume.
+func (c *Client) StreamEvents(ctx context.Context, cursor uint64, types []string, handler func(Event) error) (uint64, error) {
+	query := url.Values{}
+	if len(types) > 0 {
+		query.Set("types", strings.Join(types, ","))
+	}
+	return c.streamEvents(ctx, "/events", query, cursor, handler)
+}
+
+// StreamPeerEvents is StreamEvents for a single peer: its peer.config_changed events and
+// its own lifecycle events. It works with the peer token.
+func (c *Client) StreamPeerEvents(ctx context.Context, id string, cursor uint64, handler func(Event) error) (uint64, error) {
+	return c.streamEvents(ctx, "/peers/"+url.PathEscape(id)+"/events", nil, cursor, handler)
+}
+
+func (c *Client) streamEvents(ctx context.Context, path string, query url.Values, cursor uint64, handler func(Event) error) (uint64, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return cursor, err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if c.Token != "" {
+		request.Header.Set("Authorization", c.Token)
+	}
+	if cursor > 0 {
+		request.Header.Set("Last-Event-ID", strconv.FormatUint(cursor, 10))
+	}
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return cursor, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		apiError := &APIError{StatusCode: response.StatusCode}
+		if err := json.NewDecoder(response.Body).Decode(apiError); err != nil {
+			apiError.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(response.StatusCode), " ", "_"))
+		}
+		return cursor, apiError
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		case line == "":
+			// a blank line ends the event, comments (heartbeats) have no data
+			if data.Len() == 0 {
+				continue
+			}
+			var event Event
+			err := json.Unmarshal([]byte(data.String()), &event)
+			data.Reset()
+			if err != nil {
+				return cursor, err
+			}
+			if err := handler(event); err != nil {
+				return cursor, err
+			}
+			cursor = event.ID
+		}
+	}
+	if ctx.Err() != nil {
+		return cursor, ctx.Err()
+	}
+	return cursor, scanner.Err()
+}
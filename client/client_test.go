@@ -0,0 +1,310 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pikotunnel/client"
+	"pikotunnel/client/fake"
+)
+
+func newClient(t *testing.T) (*fake.Server, *client.Client) {
+	t.Helper()
+	server := fake.NewServer()
+	t.Cleanup(server.Close)
+	return server, server.Client()
+}
+
+func TestCreatePeerAndWait(t *testing.T) {
+	server, c := newClient(t)
+	ctx := context.Background()
+	peer, err := c.CreatePeer(ctx, client.CreatePeerRequest{Name: "web-1", Label: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Status != client.PeerStatusPending || peer.NetworkID != fake.DefaultNetworkID || peer.PrivateKey == "" {
+		t.Fatalf("unexpected peer %+v", peer)
+	}
+	server.SetPeerStatus(peer.ID, client.PeerStatusCreated)
+	created, err := c.WaitForPeerCreated(ctx, peer.ID, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != peer.ID || created.Status != client.PeerStatusCreated {
+		t.Fatalf("unexpected peer %+v", created)
+	}
+
+	// names are unique per network
+	_, err = c.CreatePeer(ctx, client.CreatePeerRequest{Name: "web-1"})
+	var apiError *client.APIError
+	if !errors.As(err, &apiError) || apiError.StatusCode != 409 || apiError.Code != "peer_name_taken" {
+		t.Fatalf("expected a peer_name_taken conflict, got %v", err)
+	}
+}
+
+func TestWaitForPeerCreatedFailed(t *testing.T) {
+	server, c := newClient(t)
+	ctx := context.Background()
+	peer, err := c.CreatePeer(ctx, client.CreatePeerRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetPeerStatus(peer.ID, client.PeerStatusFailed)
+	if _, err := c.WaitForPeerCreated(ctx, peer.ID, time.Millisecond); !errors.Is(err, client.ErrPeerFailed) {
+		t.Fatalf("expected ErrPeerFailed, got %v", err)
+	}
+	if err := c.DeletePeer(ctx, peer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WaitForPeerCreated(ctx, peer.ID, time.Millisecond); !errors.Is(err, client.ErrPeerDeleted) {
+		t.Fatalf("expected ErrPeerDeleted, got %v", err)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	server, c := newClient(t)
+	ctx := context.Background()
+	if _, err := c.GetPeer(ctx, "missing"); !client.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	unauthorized := client.New(server.URL, "wrong")
+	if _, err := unauthorized.ListPeers(ctx, client.ListPeersOptions{}); !client.IsUnauthorized(err) {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+}
+
+func TestListPeersPagination(t *testing.T) {
+	_, c := newClient(t)
+	ctx := context.Background()
+	for range 5 {
+		if _, err := c.CreatePeer(ctx, client.CreatePeerRequest{Label: "batch"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.CreatePeer(ctx, client.CreatePeerRequest{Label: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	options := client.ListPeersOptions{ListOptions: client.ListOptions{Limit: 2}, Label: "batch"}
+	seen := map[string]bool{}
+	pages := 0
+	for {
+		list, err := c.ListPeers(ctx, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		if list.Total != 5 || len(list.Items) > 2 {
+			t.Fatalf("unexpected page %+v", list)
+		}
+		for _, peer := range list.Items {
+			if seen[peer.ID] {
+				t.Fatalf("peer %s listed twice", peer.ID)
+			}
+			seen[peer.ID] = true
+		}
+		if list.NextCursor == "" {
+			break
+		}
+		options.Cursor = list.NextCursor
+	}
+	if pages != 3 || len(seen) != 5 {
+		t.Fatalf("expected 5 peers on 3 pages, got %d on %d", len(seen), pages)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	_, c := newClient(t)
+	ctx := context.Background()
+	a, err := c.CreatePeer(ctx, client.CreatePeerRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.CreatePeer(ctx, client.CreatePeerRequest{Name: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := c.CreateAccessRule(ctx, a.ID, b.ID, client.CreateAccessRuleRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.PeerAName != "a" || rule.PeerBIP != b.IP || rule.NetworkID != fake.DefaultNetworkID {
+		t.Fatalf("unexpected rule %+v", rule)
+	}
+	// rules are not directed
+	same, err := c.GetAccessRule(ctx, b.ID, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same.ID != rule.ID {
+		t.Fatalf("expected rule %s, got %s", rule.ID, same.ID)
+	}
+	reachable, err := c.ListPeerReachableBy(ctx, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reachable) != 1 || reachable[0].PeerID != b.ID {
+		t.Fatalf("unexpected reachable peers %+v", reachable)
+	}
+	list, err := c.ListAccessRules(ctx, client.ListAccessRulesOptions{PeerID: a.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 {
+		t.Fatalf("expected 1 rule, got %d", list.Total)
+	}
+	if err := c.DeleteAccessRule(ctx, a.ID, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetAccessRule(ctx, a.ID, b.ID); !client.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	_, c := newClient(t)
+	ctx := context.Background()
+	network, err := c.CreateNetwork(ctx, client.CreateNetworkRequest{Name: "staging", Subnet: "10.1.0.1/16", ListenPort: 51821})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := c.CreatePeer(ctx, client.CreatePeerRequest{NetworkID: network.ID, Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same name is free in another network
+	b, err := c.CreatePeer(ctx, client.CreatePeerRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiError *client.APIError
+	if _, err := c.CreateAccessRule(ctx, a.ID, b.ID, client.CreateAccessRuleRequest{}); !errors.As(err, &apiError) || apiError.Code != "network_mismatch" {
+		t.Fatalf("expected a network_mismatch error, got %v", err)
+	}
+	if err := c.DeleteNetwork(ctx, network.ID); !errors.As(err, &apiError) || apiError.Code != "network_not_empty" {
+		t.Fatalf("expected a network_not_empty error, got %v", err)
+	}
+	if err := c.DeletePeer(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteNetwork(ctx, network.ID); err != nil {
+		t.Fatal(err)
+	}
+	networks, err := c.ListNetworks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 1 || networks[0].ID != fake.DefaultNetworkID {
+		t.Fatalf("expected only the default network, got %+v", networks)
+	}
+}
+
+func TestPeerSettings(t *testing.T) {
+	_, c := newClient(t)
+	ctx := context.Background()
+	peer, err := c.CreatePeer(ctx, client.CreatePeerRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer, err = c.SetPeerDirect(ctx, peer.ID, true); err != nil || !peer.Direct {
+		t.Fatalf("expected a direct peer, got %+v %v", peer, err)
+	}
+	if peer, err = c.SetPeerEgress(ctx, peer.ID, true); err != nil || !peer.Egress {
+		t.Fatalf("expected an egress peer, got %+v %v", peer, err)
+	}
+	if peer, err = c.SetPeerRoutes(ctx, peer.ID, []string{"192.168.1.7/24"}); err != nil || len(peer.Routes) != 1 || peer.Routes[0] != "192.168.1.0/24" {
+		t.Fatalf("expected a normalized route, got %+v %v", peer, err)
+	}
+	if peer, err = c.SetPeerRateLimits(ctx, peer.ID, 1000, 2000); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := c.GetPeerUsage(ctx, peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.PeerID != peer.ID || usage.IngressLimitKbit != 1000 || usage.EgressLimitKbit != 2000 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+func TestPortForwards(t *testing.T) {
+	server, c := newClient(t)
+	server.AutoCreate = true
+	ctx := context.Background()
+	peer, err := c.CreatePeer(ctx, client.CreatePeerRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward, err := c.CreatePortForward(ctx, client.CreatePortForwardRequest{PeerID: peer.ID, PublicPort: 8443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward.Protocol != "tcp" || forward.PeerPort != 8443 || forward.Status != client.PortForwardStatusCreated {
+		t.Fatalf("unexpected port forward %+v", forward)
+	}
+	var apiError *client.APIError
+	if _, err := c.CreatePortForward(ctx, client.CreatePortForwardRequest{PeerID: peer.ID, PublicPort: 8443}); !errors.As(err, &apiError) || apiError.Code != "port_conflict" {
+		t.Fatalf("expected a port_conflict error, got %v", err)
+	}
+	forwards, err := c.ListPortForwards(ctx, peer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwards) != 1 || forwards[0].ID != forward.ID {
+		t.Fatalf("unexpected port forwards %+v", forwards)
+	}
+	if err := c.DeletePortForward(ctx, forward.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetPortForward(ctx, forward.ID); !client.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	server, c := newClient(t)
+	ctx := context.Background()
+	gateway, err := c.CreatePeer(ctx, client.CreatePeerRequest{Name: "gateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := c.CreateEnrollmentToken(ctx, client.CreateEnrollmentTokenRequest{Name: "laptop", AccessRulePeerIDs: []string{gateway.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "" {
+		t.Fatal("expected the plain token on create")
+	}
+	// enrolling does not need the api token
+	anonymous := client.New(server.URL, "")
+	response, err := anonymous.Enroll(ctx, client.EnrollRequest{Token: token.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Peer.Name != "laptop" || response.Config.PrivateKey == "" || response.PeerToken == "" {
+		t.Fatalf("unexpected enrollment %+v", response)
+	}
+	if _, err := c.GetAccessRule(ctx, gateway.ID, response.Peer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anonymous.Enroll(ctx, client.EnrollRequest{Token: token.Token}); !client.IsUnauthorized(err) {
+		t.Fatalf("expected a used token to be rejected, got %v", err)
+	}
+	tokens, err := c.ListEnrollmentTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Token != "" || tokens[0].PeerID != response.Peer.ID || tokens[0].UsedAt == nil {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+}
+
+func TestNotImplemented(t *testing.T) {
+	_, c := newClient(t)
+	var apiError *client.APIError
+	_, err := c.ApplyState(context.Background(), client.DesiredState{}, true)
+	if !errors.As(err, &apiError) || apiError.StatusCode != 501 {
+		t.Fatalf("expected a not implemented error, got %v", err)
+	}
+}
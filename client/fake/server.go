@@ -0,0 +1,979 @@
+// Package fake is an in-memory pikotunnel api for unit testing code which uses the client package.
+//
+//	server := fake.NewServer()
+//	defer server.Close()
+//	c := server.Client()
+//
+// Peers, networks and port forwards are created as pending, use SetPeerStatus,
+// SetNetworkStatus and SetPortForwardStatus to simulate the worker, or set AutoCreate to
+// have them created immediately. Lists honor the limit and cursor but not the sort, order
+// and created_* options. Batch, state, events, the cluster endpoints and the openapi spec
+// are not implemented and answer 501.
+package fake
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"pikotunnel/client"
+)
+
+const (
+	Token = "fake-token"
+	// DefaultNetworkID is the id of the network peers are created in when none is given
+	DefaultNetworkID = "default"
+
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type Server struct {
+	*httptest.Server
+
+	// AutoCreate makes new peers created instead of pending
+	AutoCreate bool
+
+	mutex            sync.Mutex
+	networks         map[string]*client.Network
+	peers            map[string]*client.Peer
+	accessRules      map[string]*client.AccessRule
+	portForwards     map[string]*client.PortForward
+	webhooks         map[string]*client.Webhook
+	enrollmentTokens map[string]*client.EnrollmentToken
+	nextIP           int
+}
+
+func NewServer() *Server {
+	server := &Server{
+		networks: map[string]*client.Network{
+			DefaultNetworkID: {
+				ID:         DefaultNetworkID,
+				Name:       "default",
+				Subnet:     "10.0.0.1/16",
+				ListenPort: 51820,
+				Interface:  "wg0",
+				Chain:      "PIKOTUNNEL",
+				PublicKey:  "fake-relay-public-key",
+				Status:     client.NetworkStatusCreated,
+				CreatedAt:  time.Now().UTC().Truncate(time.Second),
+			},
+		},
+		peers:            map[string]*client.Peer{},
+		accessRules:      map[string]*client.AccessRule{},
+		portForwards:     map[string]*client.PortForward{},
+		webhooks:         map[string]*client.Webhook{},
+		enrollmentTokens: map[string]*client.EnrollmentToken{},
+		nextIP:           2,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /networks", server.createNetwork)
+	mux.HandleFunc("GET /networks", server.listNetworks)
+	mux.HandleFunc("GET /networks/{id}", server.getNetwork)
+	mux.HandleFunc("DELETE /networks/{id}", server.deleteNetwork)
+	mux.HandleFunc("POST /peers", server.createPeer)
+	mux.HandleFunc("GET /peers", server.listPeers)
+	mux.HandleFunc("GET /peers/{id}", server.getPeer)
+	mux.HandleFunc("GET /peers/{id}/status", server.getPeerStatus)
+	mux.HandleFunc("GET /peers/{id}/config", server.getPeerConfig)
+	mux.HandleFunc("GET /peers/{id}/script", server.getPeerScript)
+	mux.HandleFunc("GET /peers/{id}/access-rules", server.getPeerAccessRules)
+	mux.HandleFunc("GET /peers/{id}/reachable-by", server.getPeerReachableBy)
+	mux.HandleFunc("PUT /peers/{id}/direct", server.setPeerDirect)
+	mux.HandleFunc("PUT /peers/{id}/routes", server.setPeerRoutes)
+	mux.HandleFunc("PUT /peers/{id}/egress", server.setPeerEgress)
+	mux.HandleFunc("PUT /peers/{id}/limits", server.setPeerRateLimits)
+	mux.HandleFunc("GET /peers/{id}/usage", server.getPeerUsage)
+	mux.HandleFunc("DELETE /peers/{id}", server.deletePeer)
+	mux.HandleFunc("POST /access-rule/{peer_a_id}/{peer_b_id}", server.createAccessRule)
+	mux.HandleFunc("GET /access-rule/{peer_a_id}/{peer_b_id}", server.getAccessRule)
+	mux.HandleFunc("DELETE /access-rule/{peer_a_id}/{peer_b_id}", server.deleteAccessRule)
+	mux.HandleFunc("GET /access-rules", server.listAccessRules)
+	mux.HandleFunc("POST /port-forwards", server.createPortForward)
+	mux.HandleFunc("GET /port-forwards", server.listPortForwards)
+	mux.HandleFunc("GET /port-forwards/{id}", server.getPortForward)
+	mux.HandleFunc("DELETE /port-forwards/{id}", server.deletePortForward)
+	mux.HandleFunc("POST /webhooks", server.createWebhook)
+	mux.HandleFunc("GET /webhooks", server.listWebhooks)
+	mux.HandleFunc("DELETE /webhooks/{id}", server.deleteWebhook)
+	mux.HandleFunc("POST /enrollment-tokens", server.createEnrollmentToken)
+	mux.HandleFunc("GET /enrollment-tokens", server.listEnrollmentTokens)
+	mux.HandleFunc("DELETE /enrollment-tokens/{id}", server.deleteEnrollmentToken)
+	mux.HandleFunc("POST /enroll", server.enroll)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotImplemented, "not_implemented", "%s %s is not implemented by the fake server", r.Method, r.URL.Path)
+	})
+	server.Server = httptest.NewServer(server.authenticate(mux))
+	return server
+}
+
+// Client returns a client pointed at the fake server
+func (s *Server) Client() *client.Client {
+	return client.New(s.URL, Token)
+}
+
+// SetPeerStatus simulates the worker processing a peer
+func (s *Server) SetPeerStatus(id string, status client.PeerStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if peer, ok := s.peers[id]; ok {
+		peer.Status = status
+	}
+}
+
+// SetNetworkStatus simulates the worker setting up a network
+func (s *Server) SetNetworkStatus(id string, status client.NetworkStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if network, ok := s.networks[id]; ok {
+		network.Status = status
+	}
+}
+
+// SetPortForwardStatus simulates the worker installing the rules of a port forward
+func (s *Server) SetPortForwardStatus(id string, status client.PortForwardStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if forward, ok := s.portForwards[id]; ok {
+		forward.Status = status
+	}
+}
+
+// Peers returns a copy of every peer in the fake
+func (s *Server) Peers() []client.Peer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peers := []client.Peer{}
+	for _, peer := range s.peers {
+		peers = append(peers, *peer)
+	}
+	slices.SortFunc(peers, func(a, b client.Peer) int { return strings.Compare(a.IP, b.IP) })
+	return peers
+}
+
+// AccessRules returns a copy of every access rule in the fake
+func (s *Server) AccessRules() []client.AccessRule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rules := []client.AccessRule{}
+	for _, rule := range s.accessRules {
+		rules = append(rules, s.accessRuleResponse(rule))
+	}
+	slices.SortFunc(rules, func(a, b client.AccessRule) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return rules
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the enrollment token in the body is the credential of /enroll
+		if r.Header.Get("Authorization") != Token && r.URL.Path != "/enroll" {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid api token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, format string, args ...any) {
+	writeJSON(w, status, client.APIError{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// paginate returns the page of items after the offset in the cursor, the cursors of the fake
+// are offsets and are not compatible with the real api
+func paginate[T any](w http.ResponseWriter, r *http.Request, items []T) (client.List[T], bool) {
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and %d", maxListLimit)
+			return client.List[T]{}, false
+		}
+		limit = parsed
+	}
+	offset := 0
+	if value := query.Get("cursor"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_cursor", "invalid cursor")
+			return client.List[T]{}, false
+		}
+		offset = min(parsed, len(items))
+	}
+	list := client.List[T]{Items: items[offset:min(offset+limit, len(items))], Total: int64(len(items))}
+	if offset+limit < len(items) {
+		list.NextCursor = strconv.Itoa(offset + limit)
+	}
+	return list, true
+}
+
+// readJSON decodes the body into request, an empty body is left as is when optional
+func readJSON(w http.ResponseWriter, r *http.Request, request any, optional bool) bool {
+	if optional && r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid body: %s", err)
+		return false
+	}
+	return true
+}
+
+func newKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func accessRuleKey(peerAID string, peerBID string) string {
+	if peerAID > peerBID {
+		peerAID, peerBID = peerBID, peerAID
+	}
+	return peerAID + "/" + peerBID
+}
+
+func (s *Server) accessRuleResponse(rule *client.AccessRule) client.AccessRule {
+	response := *rule
+	if peer, ok := s.peers[rule.PeerAID]; ok {
+		response.PeerAIP = peer.IP
+		response.PeerAName = peer.Name
+	}
+	if peer, ok := s.peers[rule.PeerBID]; ok {
+		response.PeerBIP = peer.IP
+		response.PeerBName = peer.Name
+	}
+	return response
+}
+
+func (s *Server) createPeer(w http.ResponseWriter, r *http.Request) {
+	var request client.CreatePeerRequest
+	if !readJSON(w, r, &request, true) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peer, ok := s.newPeer(w, request.NetworkID, request.Name, request.Label, request.PublicKey)
+	if ok {
+		writeJSON(w, http.StatusCreated, peer)
+	}
+}
+
+// newPeer stores a peer, names are unique per network. The caller holds the mutex.
+func (s *Server) newPeer(w http.ResponseWriter, networkID string, name string, label string, publicKey string) (*client.Peer, bool) {
+	if networkID == "" {
+		networkID = DefaultNetworkID
+	}
+	network, ok := s.networks[networkID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "network_not_found", "network %s not found", networkID)
+		return nil, false
+	}
+	if network.Status == client.NetworkStatusDeleting || network.Status == client.NetworkStatusFailed {
+		writeError(w, http.StatusUnprocessableEntity, "network_unavailable", "network %s is %s", network.Name, network.Status)
+		return nil, false
+	}
+	if name != "" {
+		for _, peer := range s.peers {
+			if peer.NetworkID == network.ID && peer.Name == name {
+				writeError(w, http.StatusConflict, "peer_name_taken", "peer with name %s already exists in network %s", name, network.Name)
+				return nil, false
+			}
+		}
+	}
+	peer := &client.Peer{
+		ID:        uuid.New().String(),
+		NetworkID: network.ID,
+		IP:        fmt.Sprintf("10.0.%d.%d", s.nextIP/256, s.nextIP%256),
+		PublicKey: publicKey,
+		Status:    client.PeerStatusPending,
+		Name:      name,
+		Label:     strings.TrimSpace(label),
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Routes:    []string{},
+	}
+	if peer.PublicKey == "" {
+		peer.PublicKey = newKey()
+		peer.PrivateKey = newKey()
+	}
+	s.nextIP++
+	if s.AutoCreate {
+		peer.Status = client.PeerStatusCreated
+	}
+	s.peers[peer.ID] = peer
+	return peer, true
+}
+
+func (s *Server) listPeers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	items := []client.Peer{}
+	for _, peer := range s.peers {
+		if networkID := query.Get("network_id"); networkID != "" && peer.NetworkID != networkID {
+			continue
+		}
+		if status := query.Get("status"); status != "" && string(peer.Status) != status {
+			continue
+		}
+		if ip := query.Get("ip"); ip != "" && peer.IP != ip {
+			continue
+		}
+		if label := query.Get("label"); label != "" && peer.Label != label {
+			continue
+		}
+		if name := query.Get("name"); name != "" && peer.Name != name {
+			continue
+		}
+		items = append(items, *peer)
+	}
+	slices.SortFunc(items, func(a, b client.Peer) int { return strings.Compare(a.IP, b.IP) })
+	if list, ok := paginate(w, r, items); ok {
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// withPeer runs fn with the peer from the path locked, or writes a 404
+func (s *Server) withPeer(w http.ResponseWriter, r *http.Request, fn func(peer *client.Peer)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peer, ok := s.peers[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "peer_not_found", "peer %s not found", r.PathValue("id"))
+		return
+	}
+	fn(peer)
+}
+
+func (s *Server) getPeer(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		writeJSON(w, http.StatusOK, peer)
+	})
+}
+
+func (s *Server) getPeerStatus(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": string(peer.Status)})
+	})
+}
+
+func (s *Server) peerConfig(peer *client.Peer) client.WireguardConfig {
+	return client.WireguardConfig{
+		PrivateKey:     peer.PrivateKey,
+		PublicKey:      peer.PublicKey,
+		IP:             peer.IP,
+		IPWithMask:     peer.IP + "/32",
+		AllowedIPs:     "10.0.0.0/16",
+		RelayPublicKey: "fake-relay-public-key",
+		Endpoint:       "127.0.0.1:51820",
+	}
+}
+
+func (s *Server) getPeerConfig(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		writeJSON(w, http.StatusOK, s.peerConfig(peer))
+	})
+}
+
+func (s *Server) getPeerScript(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		config := s.peerConfig(peer)
+		writeJSON(w, http.StatusOK, fmt.Sprintf("#!/bin/bash\n# fake wireguard script for %s\nip address add %s dev wg0\n", peer.ID, config.IPWithMask))
+	})
+}
+
+func (s *Server) peerAccessRules(id string) []*client.AccessRule {
+	rules := []*client.AccessRule{}
+	for _, rule := range s.accessRules {
+		if rule.PeerAID == id || rule.PeerBID == id {
+			rules = append(rules, rule)
+		}
+	}
+	slices.SortFunc(rules, func(a, b *client.AccessRule) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return rules
+}
+
+func (s *Server) getPeerAccessRules(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		response := []client.AccessRule{}
+		for _, rule := range s.peerAccessRules(peer.ID) {
+			response = append(response, s.accessRuleResponse(rule))
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+func (s *Server) getPeerReachableBy(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		response := []client.ReachablePeer{}
+		for _, rule := range s.peerAccessRules(peer.ID) {
+			otherID := rule.PeerAID
+			if otherID == peer.ID {
+				otherID = rule.PeerBID
+			}
+			other, ok := s.peers[otherID]
+			if !ok {
+				continue
+			}
+			response = append(response, client.ReachablePeer{
+				PeerID:           other.ID,
+				IP:               other.IP,
+				Name:             other.Name,
+				Label:            other.Label,
+				AccessRuleID:     rule.ID,
+				AccessRuleStatus: rule.Status,
+			})
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+// deletePeer removes the peer, its access rules and its port forwards right away, there is
+// no worker in the fake
+func (s *Server) deletePeer(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := r.PathValue("id")
+	for key, rule := range s.accessRules {
+		if rule.PeerAID == id || rule.PeerBID == id {
+			delete(s.accessRules, key)
+		}
+	}
+	for key, forward := range s.portForwards {
+		if forward.PeerID == id {
+			delete(s.portForwards, key)
+		}
+	}
+	delete(s.peers, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createAccessRule(w http.ResponseWriter, r *http.Request) {
+	var request client.CreateAccessRuleRequest
+	if !readJSON(w, r, &request, true) {
+		return
+	}
+	peerAID := r.PathValue("peer_a_id")
+	peerBID := r.PathValue("peer_b_id")
+	if peerAID == peerBID {
+		writeError(w, http.StatusUnprocessableEntity, "same_peer", "peer a and peer b cannot be the same")
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if rule, ok := s.newAccessRule(w, peerAID, peerBID, request.ExpiresAt, request.Routes); ok {
+		writeJSON(w, http.StatusCreated, s.accessRuleResponse(rule))
+	}
+}
+
+// newAccessRule stores a rule between two peers of the same network, an existing rule is
+// returned as is. The caller holds the mutex.
+func (s *Server) newAccessRule(w http.ResponseWriter, peerAID string, peerBID string, expiresAt *time.Time, routes []string) (*client.AccessRule, bool) {
+	key := accessRuleKey(peerAID, peerBID)
+	if rule, ok := s.accessRules[key]; ok {
+		return rule, true
+	}
+	for _, id := range []string{peerAID, peerBID} {
+		if _, ok := s.peers[id]; !ok {
+			writeError(w, http.StatusNotFound, "peer_not_found", "peer %s not found", id)
+			return nil, false
+		}
+	}
+	if s.peers[peerAID].NetworkID != s.peers[peerBID].NetworkID {
+		writeError(w, http.StatusUnprocessableEntity, "network_mismatch", "peers %s and %s are in different networks", peerAID, peerBID)
+		return nil, false
+	}
+	if routes == nil {
+		routes = []string{}
+	}
+	rule := &client.AccessRule{
+		ID:        uuid.New().String(),
+		PeerAID:   peerAID,
+		PeerBID:   peerBID,
+		NetworkID: s.peers[peerAID].NetworkID,
+		Status:    client.AccessRuleStatusCreated,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		ExpiresAt: expiresAt,
+		Routes:    routes,
+	}
+	s.accessRules[key] = rule
+	return rule, true
+}
+
+func (s *Server) getAccessRule(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rule, ok := s.accessRules[accessRuleKey(r.PathValue("peer_a_id"), r.PathValue("peer_b_id"))]
+	if !ok {
+		writeError(w, http.StatusNotFound, "access_rule_not_found", "access rule not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.accessRuleResponse(rule))
+}
+
+func (s *Server) deleteAccessRule(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := accessRuleKey(r.PathValue("peer_a_id"), r.PathValue("peer_b_id"))
+	if _, ok := s.accessRules[key]; !ok {
+		writeError(w, http.StatusNotFound, "access_rule_not_found", "access rule not found")
+		return
+	}
+	delete(s.accessRules, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listAccessRules(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	items := []client.AccessRule{}
+	for _, rule := range s.accessRules {
+		if networkID := query.Get("network_id"); networkID != "" && rule.NetworkID != networkID {
+			continue
+		}
+		if status := query.Get("status"); status != "" && string(rule.Status) != status {
+			continue
+		}
+		if peerID := query.Get("peer_id"); peerID != "" && rule.PeerAID != peerID && rule.PeerBID != peerID {
+			continue
+		}
+		items = append(items, s.accessRuleResponse(rule))
+	}
+	slices.SortFunc(items, func(a, b client.AccessRule) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	if list, ok := paginate(w, r, items); ok {
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var request client.CreateWebhookRequest
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	secret := request.Secret
+	if secret == "" {
+		secret = strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+	webhook := &client.Webhook{ID: uuid.New().String(), URL: request.URL, Secret: secret, Events: strings.Join(request.Events, ",")}
+	s.mutex.Lock()
+	s.webhooks[webhook.ID] = webhook
+	s.mutex.Unlock()
+	writeJSON(w, http.StatusCreated, webhook)
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := []client.Webhook{}
+	for _, webhook := range s.webhooks {
+		// the secret is only returned on create
+		response = append(response, client.Webhook{ID: webhook.ID, URL: webhook.URL, Events: webhook.Events})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.webhooks, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createNetwork(w http.ResponseWriter, r *http.Request) {
+	var request client.CreateNetworkRequest
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	if request.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid_network_name", "name must be a lowercase dns label")
+		return
+	}
+	if request.ListenPort < 1 || request.ListenPort > 65535 {
+		writeError(w, http.StatusBadRequest, "invalid_listen_port", "listen_port must be between 1 and 65535")
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, other := range s.networks {
+		switch {
+		case other.Name == request.Name:
+			writeError(w, http.StatusConflict, "network_name_taken", "network with name %s already exists", request.Name)
+			return
+		case other.ListenPort == request.ListenPort:
+			writeError(w, http.StatusConflict, "listen_port_taken", "listen port %d is used by network %s", request.ListenPort, other.Name)
+			return
+		}
+	}
+	iface := request.Interface
+	if iface == "" {
+		iface = "pt-" + request.Name
+	}
+	network := &client.Network{
+		ID:         uuid.New().String(),
+		Name:       request.Name,
+		Subnet:     request.Subnet,
+		ListenPort: request.ListenPort,
+		Interface:  iface,
+		Chain:      "PIKOTUNNEL-" + strings.ToUpper(request.Name),
+		PublicKey:  newKey(),
+		Status:     client.NetworkStatusPending,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	if s.AutoCreate {
+		network.Status = client.NetworkStatusCreated
+	}
+	s.networks[network.ID] = network
+	writeJSON(w, http.StatusCreated, network)
+}
+
+func (s *Server) listNetworks(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := []client.Network{}
+	for _, network := range s.networks {
+		response = append(response, *network)
+	}
+	slices.SortFunc(response, func(a, b client.Network) int { return strings.Compare(a.Name, b.Name) })
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getNetwork(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	network, ok := s.networks[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "network_not_found", "network %s not found", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, network)
+}
+
+// deleteNetwork removes an empty network right away, the default network cannot be deleted
+func (s *Server) deleteNetwork(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := r.PathValue("id")
+	if id == DefaultNetworkID {
+		writeError(w, http.StatusConflict, "default_network", "the default network cannot be deleted")
+		return
+	}
+	count := 0
+	for _, peer := range s.peers {
+		if peer.NetworkID == id {
+			count++
+		}
+	}
+	if count > 0 {
+		writeError(w, http.StatusConflict, "network_not_empty", "network %s still has %d peer(s)", id, count)
+		return
+	}
+	delete(s.networks, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setPeerDirect(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Direct bool `json:"direct"`
+	}
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	s.withPeer(w, r, func(peer *client.Peer) {
+		peer.Direct = request.Direct
+		writeJSON(w, http.StatusOK, peer)
+	})
+}
+
+// setPeerRoutes only checks the routes are subnets, overlaps are not detected
+func (s *Server) setPeerRoutes(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Routes []string `json:"routes"`
+	}
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	routes := []string{}
+	for _, route := range request.Routes {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(route))
+		if err != nil || subnet.IP.To4() == nil {
+			writeError(w, http.StatusBadRequest, "invalid_route", "route %s must be an ipv4 subnet", route)
+			return
+		}
+		routes = append(routes, subnet.String())
+	}
+	s.withPeer(w, r, func(peer *client.Peer) {
+		peer.Routes = routes
+		writeJSON(w, http.StatusOK, peer)
+	})
+}
+
+func (s *Server) setPeerEgress(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Egress bool `json:"egress"`
+	}
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	s.withPeer(w, r, func(peer *client.Peer) {
+		peer.Egress = request.Egress
+		writeJSON(w, http.StatusOK, peer)
+	})
+}
+
+func (s *Server) setPeerRateLimits(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		IngressLimitKbit int `json:"ingress_limit_kbit"`
+		EgressLimitKbit  int `json:"egress_limit_kbit"`
+	}
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	if request.IngressLimitKbit < 0 || request.EgressLimitKbit < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_rate_limit", "limits cannot be negative")
+		return
+	}
+	s.withPeer(w, r, func(peer *client.Peer) {
+		peer.IngressLimitKbit = request.IngressLimitKbit
+		peer.EgressLimitKbit = request.EgressLimitKbit
+		writeJSON(w, http.StatusOK, peer)
+	})
+}
+
+// getPeerUsage reports no traffic, there is no data plane in the fake
+func (s *Server) getPeerUsage(w http.ResponseWriter, r *http.Request) {
+	s.withPeer(w, r, func(peer *client.Peer) {
+		writeJSON(w, http.StatusOK, client.PeerUsage{
+			PeerID:           peer.ID,
+			IngressLimitKbit: peer.IngressLimitKbit,
+			EgressLimitKbit:  peer.EgressLimitKbit,
+		})
+	})
+}
+
+func (s *Server) createPortForward(w http.ResponseWriter, r *http.Request) {
+	var request client.CreatePortForwardRequest
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	protocol := strings.ToLower(strings.TrimSpace(request.Protocol))
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		writeError(w, http.StatusBadRequest, "invalid_protocol", "protocol must be tcp or udp")
+		return
+	}
+	peerPort := request.PeerPort
+	if peerPort == 0 {
+		peerPort = request.PublicPort
+	}
+	if request.PublicPort < 1 || request.PublicPort > 65535 || peerPort < 1 || peerPort > 65535 {
+		writeError(w, http.StatusBadRequest, "invalid_port", "public_port and peer_port must be between 1 and 65535")
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peer, ok := s.peers[request.PeerID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "peer_not_found", "peer %s not found", request.PeerID)
+		return
+	}
+	if peer.Status == client.PeerStatusDeleting || peer.Status == client.PeerStatusFailed {
+		writeError(w, http.StatusUnprocessableEntity, "peer_unavailable", "peer %s is %s", peer.ID, peer.Status)
+		return
+	}
+	for _, other := range s.portForwards {
+		if other.Protocol == protocol && other.PublicPort == request.PublicPort {
+			writeError(w, http.StatusConflict, "port_conflict", "%s port %d of the relay is used by another port forward", protocol, request.PublicPort)
+			return
+		}
+	}
+	forward := &client.PortForward{
+		ID:         uuid.New().String(),
+		NetworkID:  peer.NetworkID,
+		PeerID:     peer.ID,
+		Protocol:   protocol,
+		PublicPort: request.PublicPort,
+		PeerPort:   peerPort,
+		Status:     client.PortForwardStatusPending,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	if s.AutoCreate {
+		forward.Status = client.PortForwardStatusCreated
+	}
+	s.portForwards[forward.ID] = forward
+	writeJSON(w, http.StatusCreated, forward)
+}
+
+func (s *Server) listPortForwards(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := []client.PortForward{}
+	for _, forward := range s.portForwards {
+		if peerID := r.URL.Query().Get("peer_id"); peerID != "" && forward.PeerID != peerID {
+			continue
+		}
+		response = append(response, *forward)
+	}
+	slices.SortFunc(response, func(a, b client.PortForward) int {
+		return cmp.Or(strings.Compare(a.Protocol, b.Protocol), cmp.Compare(a.PublicPort, b.PublicPort))
+	})
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getPortForward(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	forward, ok := s.portForwards[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "port_forward_not_found", "port forward %s not found", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, forward)
+}
+
+// deletePortForward removes the port forward right away, there is no worker in the fake
+func (s *Server) deletePortForward(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.portForwards[r.PathValue("id")]; !ok {
+		writeError(w, http.StatusNotFound, "port_forward_not_found", "port forward %s not found", r.PathValue("id"))
+		return
+	}
+	delete(s.portForwards, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createEnrollmentToken mints a token, the fake keeps it in plain text to match it on enroll
+func (s *Server) createEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	var request client.CreateEnrollmentTokenRequest
+	if !readJSON(w, r, &request, true) {
+		return
+	}
+	networkID := request.NetworkID
+	if networkID == "" {
+		networkID = DefaultNetworkID
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.networks[networkID]; !ok {
+		writeError(w, http.StatusNotFound, "network_not_found", "network %s not found", networkID)
+		return
+	}
+	peerIDs := []string{}
+	for _, peerID := range request.AccessRulePeerIDs {
+		peer, ok := s.peers[peerID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "peer_not_found", "peer %s not found", peerID)
+			return
+		}
+		if peer.NetworkID != networkID {
+			writeError(w, http.StatusUnprocessableEntity, "network_mismatch", "peer %s is not in network %s", peerID, networkID)
+			return
+		}
+		peerIDs = append(peerIDs, peerID)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	expiresAt := now.Add(24 * time.Hour)
+	if request.ExpiresAt != nil {
+		if !request.ExpiresAt.After(now) {
+			writeError(w, http.StatusBadRequest, "invalid_expires_at", "expires_at must be in the future")
+			return
+		}
+		expiresAt = request.ExpiresAt.UTC()
+	}
+	token := &client.EnrollmentToken{
+		ID:                uuid.New().String(),
+		Token:             "pte_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Name:              request.Name,
+		Label:             strings.TrimSpace(request.Label),
+		AccessRulePeerIDs: peerIDs,
+		NetworkID:         networkID,
+		ExpiresAt:         expiresAt,
+		CreatedAt:         now,
+	}
+	s.enrollmentTokens[token.ID] = token
+	writeJSON(w, http.StatusCreated, token)
+}
+
+func (s *Server) listEnrollmentTokens(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := []client.EnrollmentToken{}
+	for _, token := range s.enrollmentTokens {
+		// the plain token is only returned on create
+		listed := *token
+		listed.Token = ""
+		response = append(response, listed)
+	}
+	slices.SortFunc(response, func(a, b client.EnrollmentToken) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) deleteEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.enrollmentTokens, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// enroll burns the token and creates its peer and access rules
+func (s *Server) enroll(w http.ResponseWriter, r *http.Request) {
+	var request client.EnrollRequest
+	if !readJSON(w, r, &request, false) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var token *client.EnrollmentToken
+	for _, candidate := range s.enrollmentTokens {
+		if request.Token != "" && candidate.Token == request.Token {
+			token = candidate
+		}
+	}
+	now := time.Now().UTC()
+	if token == nil || token.UsedAt != nil || !token.ExpiresAt.After(now) {
+		writeError(w, http.StatusUnauthorized, "invalid_enrollment_token", "enrollment token is invalid, expired or already used")
+		return
+	}
+	for _, peerID := range token.AccessRulePeerIDs {
+		if _, ok := s.peers[peerID]; !ok {
+			writeError(w, http.StatusNotFound, "peer_not_found", "peer %s not found", peerID)
+			return
+		}
+	}
+	peer, ok := s.newPeer(w, token.NetworkID, token.Name, token.Label, request.PublicKey)
+	if !ok {
+		return
+	}
+	for _, peerID := range token.AccessRulePeerIDs {
+		s.newAccessRule(w, peer.ID, peerID, nil, nil)
+	}
+	token.UsedAt = &now
+	token.PeerID = peer.ID
+	writeJSON(w, http.StatusCreated, client.EnrollResponse{
+		Peer:      *peer,
+		Config:    s.peerConfig(peer),
+		PeerToken: "ptp_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+	})
+}
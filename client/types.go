@@ -0,0 +1,364 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type PeerStatus string
+
+const (
+	PeerStatusPending  PeerStatus = "pending"
+	PeerStatusCreated  PeerStatus = "created"
+	PeerStatusDeleting PeerStatus = "deleting"
+	PeerStatusFailed   PeerStatus = "failed"
+)
+
+type AccessRuleStatus string
+
+const (
+	AccessRuleStatusPending  AccessRuleStatus = "pending"
+	AccessRuleStatusCreated  AccessRuleStatus = "created"
+	AccessRuleStatusDeleting AccessRuleStatus = "deleting"
+)
+
+type PortForwardStatus string
+
+const (
+	PortForwardStatusPending  PortForwardStatus = "pending"
+	PortForwardStatusCreated  PortForwardStatus = "created"
+	PortForwardStatusDeleting PortForwardStatus = "deleting"
+	PortForwardStatusFailed   PortForwardStatus = "failed"
+)
+
+type NetworkStatus string
+
+const (
+	NetworkStatusPending  NetworkStatus = "pending"
+	NetworkStatusCreated  NetworkStatus = "created"
+	NetworkStatusDeleting NetworkStatus = "deleting"
+	NetworkStatusFailed   NetworkStatus = "failed"
+)
+
+// Network is an isolated overlay, peers only reach peers of the same network
+type Network struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Subnet     string        `json:"subnet"`
+	ListenPort int           `json:"listen_port"`
+	Interface  string        `json:"interface"`
+	Chain      string        `json:"chain"`
+	PublicKey  string        `json:"public_key"`
+	Status     NetworkStatus `json:"status"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+type CreateNetworkRequest struct {
+	Name string `json:"name"`
+	// Subnet holds the relay address and the prefix, e.g. 10.1.0.1/16
+	Subnet     string `json:"subnet"`
+	ListenPort int    `json:"listen_port"`
+	// Interface defaults to pt-<name>
+	Interface      string `json:"interface,omitempty"`
+	IdempotencyKey string `json:"-"`
+}
+
+type Peer struct {
+	ID         string     `json:"id"`
+	NetworkID  string     `json:"network_id"`
+	IP         string     `json:"ip"`
+	PublicKey  string     `json:"public_key"`
+	PrivateKey string     `json:"private_key"`
+	Status     PeerStatus `json:"status"`
+	Name       string     `json:"name"`
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Direct peers connect to each other without the relay, see SetPeerDirect
+	Direct bool `json:"direct"`
+	// Endpoint is the public address the relay last saw the peer at
+	Endpoint string `json:"endpoint"`
+	// Routes are the subnets the peer is a gateway for, see SetPeerRoutes
+	Routes []string `json:"routes"`
+	// Egress peers reach the internet through the relay, see SetPeerEgress
+	Egress bool `json:"egress"`
+	// IngressLimitKbit limits what the peer sends, EgressLimitKbit what it receives, 0 is unlimited
+	IngressLimitKbit int `json:"ingress_limit_kbit"`
+	EgressLimitKbit  int `json:"egress_limit_kbit"`
+}
+
+// PeerUsage is the traffic of a peer through the relay which answered, see GetPeerUsage
+type PeerUsage struct {
+	PeerID       string `json:"peer_id"`
+	IngressBytes uint64 `json:"ingress_bytes"`
+	EgressBytes  uint64 `json:"egress_bytes"`
+	// IngressKbit and EgressKbit are the average rates over the last telemetry poll
+	IngressKbit      uint64    `json:"ingress_kbit"`
+	EgressKbit       uint64    `json:"egress_kbit"`
+	IngressLimitKbit int       `json:"ingress_limit_kbit"`
+	EgressLimitKbit  int       `json:"egress_limit_kbit"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+type AccessRule struct {
+	ID        string           `json:"id"`
+	PeerAID   string           `json:"peer_a_id"`
+	PeerBID   string           `json:"peer_b_id"`
+	NetworkID string           `json:"network_id"`
+	PeerAIP   string           `json:"peer_a_ip"`
+	PeerAName string           `json:"peer_a_name"`
+	PeerBIP   string           `json:"peer_b_ip"`
+	PeerBName string           `json:"peer_b_name"`
+	Status    AccessRuleStatus `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+	ExpiresAt *time.Time       `json:"expires_at,omitempty"`
+	Routes    []string         `json:"routes"`
+}
+
+type ReachablePeer struct {
+	PeerID           string           `json:"peer_id"`
+	IP               string           `json:"ip"`
+	Name             string           `json:"name"`
+	Label            string           `json:"label"`
+	AccessRuleID     string           `json:"access_rule_id"`
+	AccessRuleStatus AccessRuleStatus `json:"access_rule_status"`
+}
+
+// WireguardConfig is what a peer needs to set up its interface
+type WireguardConfig struct {
+	PrivateKey     string `json:"private_key"`
+	PublicKey      string `json:"public_key"`
+	IP             string `json:"ip"`
+	IPWithMask     string `json:"ip_with_mask"`
+	AllowedIPs     string `json:"allowed_ips"`
+	RelayPublicKey string `json:"relay_public_key"`
+	Endpoint       string `json:"endpoint"`
+	// Endpoints lists every live relay, comma separated, Endpoint first
+	Endpoints string `json:"endpoints"`
+	// DirectPeers are reached without the relay, the relay stays the fallback
+	DirectPeers []DirectPeer `json:"direct_peers"`
+	// DNS resolves <peer-name>.<DNSDomain> for the reachable peers, empty when the relay has no dns
+	DNS       string `json:"dns"`
+	DNSDomain string `json:"dns_domain"`
+}
+
+type DirectPeer struct {
+	PeerID     string `json:"peer_id"`
+	PublicKey  string `json:"public_key"`
+	Endpoint   string `json:"endpoint"`
+	AllowedIPs string `json:"allowed_ips"`
+}
+
+// Relay is a server of the cluster, see ListRelays
+type Relay struct {
+	Name       string    `json:"name"`
+	PublicIP   string    `json:"public_ip"`
+	Region     string    `json:"region"`
+	Role       string    `json:"role"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type RelayHeartbeatRequest struct {
+	Name     string `json:"name"`
+	PublicIP string `json:"public_ip"`
+	Region   string `json:"region"`
+}
+
+type List[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor"`
+}
+
+type ListOptions struct {
+	Limit         int
+	Cursor        string
+	Sort          string
+	Order         string // asc or desc
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+type ListPeersOptions struct {
+	ListOptions
+	NetworkID string
+	Status    PeerStatus
+	IP        string
+	Label     string
+	Name      string
+}
+
+type ListAccessRulesOptions struct {
+	ListOptions
+	NetworkID string
+	Status    AccessRuleStatus
+	PeerID    string
+}
+
+type CreatePeerRequest struct {
+	// NetworkID defaults to the default network
+	NetworkID string `json:"network_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Label     string `json:"label,omitempty"`
+	// PublicKey registers a key generated by the caller, the server then never sees the private key
+	PublicKey string `json:"public_key,omitempty"`
+	// IdempotencyKey makes the request safe to retry, it is sent as the Idempotency-Key header
+	IdempotencyKey string `json:"-"`
+}
+
+type CreateAccessRuleRequest struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Routes are routed subnets of either peer the rule opens to the other one
+	Routes         []string `json:"routes,omitempty"`
+	IdempotencyKey string   `json:"-"`
+}
+
+const (
+	BatchOpCreatePeer       = "create_peer"
+	BatchOpUpdatePeer       = "update_peer"
+	BatchOpDeletePeer       = "delete_peer"
+	BatchOpCreateAccessRule = "create_access_rule"
+	BatchOpDeleteAccessRule = "delete_access_rule"
+)
+
+type BatchOperation struct {
+	Op        string     `json:"op"`
+	Ref       string     `json:"ref,omitempty"`
+	NetworkID string     `json:"network_id,omitempty"`
+	Name      string     `json:"name,omitempty"`
+	Label     string     `json:"label,omitempty"`
+	PeerID    string     `json:"peer_id,omitempty"`
+	PeerAID   string     `json:"peer_a_id,omitempty"`
+	PeerBID   string     `json:"peer_b_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Routes    []string   `json:"routes,omitempty"`
+}
+
+type BatchRequest struct {
+	Atomic         bool             `json:"atomic"`
+	Operations     []BatchOperation `json:"operations"`
+	IdempotencyKey string           `json:"-"`
+}
+
+type BatchResult struct {
+	Index      int         `json:"index"`
+	Op         string      `json:"op"`
+	Status     string      `json:"status"`
+	Code       string      `json:"code,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Peer       *Peer       `json:"peer,omitempty"`
+	AccessRule *AccessRule `json:"access_rule,omitempty"`
+}
+
+type BatchResponse struct {
+	Success bool          `json:"success"`
+	Results []BatchResult `json:"results"`
+}
+
+type DesiredState struct {
+	// Network is the name of the network the state describes, the default network when empty
+	Network     string              `json:"network,omitempty"`
+	Peers       []DesiredPeer       `json:"peers"`
+	AccessRules []DesiredAccessRule `json:"access_rules"`
+}
+
+type DesiredPeer struct {
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"`
+}
+
+type DesiredAccessRule struct {
+	PeerA string `json:"peer_a"`
+	PeerB string `json:"peer_b"`
+}
+
+type StatePlanItem struct {
+	Action  string `json:"action"`
+	Kind    string `json:"kind"`
+	Summary string `json:"summary"`
+}
+
+type StateResponse struct {
+	DryRun  bool            `json:"dry_run"`
+	Plan    []StatePlanItem `json:"plan"`
+	Results *BatchResponse  `json:"results,omitempty"`
+}
+
+type Event struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// PortForward exposes a port of a peer on the public ip of the relay
+type PortForward struct {
+	ID         string            `json:"id"`
+	NetworkID  string            `json:"network_id"`
+	PeerID     string            `json:"peer_id"`
+	Protocol   string            `json:"protocol"`
+	PublicPort int               `json:"public_port"`
+	PeerPort   int               `json:"peer_port"`
+	Status     PortForwardStatus `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+type CreatePortForwardRequest struct {
+	PeerID string `json:"peer_id"`
+	// Protocol is tcp or udp, tcp when empty
+	Protocol   string `json:"protocol,omitempty"`
+	PublicPort int    `json:"public_port"`
+	// PeerPort defaults to PublicPort
+	PeerPort       int    `json:"peer_port,omitempty"`
+	IdempotencyKey string `json:"-"`
+}
+
+type Webhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	Events string `json:"events"`
+}
+
+type CreateWebhookRequest struct {
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret,omitempty"`
+	Events         []string `json:"events,omitempty"`
+	IdempotencyKey string   `json:"-"`
+}
+
+type EnrollmentToken struct {
+	ID string `json:"id"`
+	// Token is only returned when the token is created
+	Token             string     `json:"token,omitempty"`
+	Name              string     `json:"name"`
+	Label             string     `json:"label"`
+	AccessRulePeerIDs []string   `json:"access_rule_peer_ids"`
+	NetworkID         string     `json:"network_id"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	UsedAt            *time.Time `json:"used_at"`
+	PeerID            string     `json:"peer_id"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+type CreateEnrollmentTokenRequest struct {
+	// NetworkID is the network of the enrolled peer, the default network when empty
+	NetworkID string `json:"network_id,omitempty"`
+	// Name and Label are given to the enrolled peer
+	Name  string `json:"name,omitempty"`
+	Label string `json:"label,omitempty"`
+	// AccessRulePeerIDs are linked with the enrolled peer by access rules
+	AccessRulePeerIDs []string   `json:"access_rule_peer_ids,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+}
+
+type EnrollRequest struct {
+	Token     string `json:"token"`
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+type EnrollResponse struct {
+	Peer   Peer            `json:"peer"`
+	Config WireguardConfig `json:"config"`
+	// PeerToken only grants access to the enrolled peer itself, use it as the client token
+	PeerToken string `json:"peer_token"`
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"pikotunnel/client"
+)
+
+const (
+	clusterRoleLeader   = "leader"
+	clusterRoleFollower = "follower"
+
+	clusterSyncInterval      = 10 * time.Second
+	relayHeartbeatInterval   = 30 * time.Second
+	relayLivenessGracePeriod = 2 * time.Minute
+)
+
+// ClusterSnapshot is the whole desired state of the leader, followers install it as is
+type ClusterSnapshot struct {
+	Networks    []clusterNetwork `json:"networks"`
+	Peers       []Peer           `json:"peers"`
+	AccessRules []AccessRule     `json:"access_rules"`
+	Relays      []Relay          `json:"relays"`
+	// PortForwards are installed on every relay, peers are reachable on the port of any of them
+	PortForwards []PortForward `json:"port_forwards"`
+	// PeerTokenHashes lets enrolled peers read their config from any relay, keyed by peer id
+	PeerTokenHashes map[string]string `json:"peer_token_hashes"`
+}
+
+// clusterNetwork carries the private key the public api hides, every relay of a network
+// answers with the same key so peers can fail over without a new config
+type clusterNetwork struct {
+	Network
+	PrivateKey string `json:"private_key"`
+}
+
+type RelayHeartbeatRequest struct {
+	Name     string `json:"name"`
+	PublicIP string `json:"public_ip"`
+	Region   string `json:"region"`
+}
+
+func isClusterFollower() bool {
+	return config != nil && config.ClusterRole == clusterRoleFollower
+}
+
+// readOnlyFollowerMiddleware rejects writes on a follower, its state is replaced by the leader's
+func readOnlyFollowerMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		method := c.Request().Method
+		if isClusterFollower() && method != http.MethodGet && method != http.MethodHead {
+			return respondError(c, conflictError("read_only_follower", "this relay follows %s, send changes to the leader", config.ClusterLeaderURL))
+		}
+		return next(c)
+	}
+}
+
+func getClusterSnapshot(c echo.Context) error {
+	snapshot, err := buildClusterSnapshot()
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, snapshot)
+}
+
+func postRelayHeartbeat(c echo.Context) error {
+	var request RelayHeartbeatRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, invalidError("invalid_body", "invalid request body"))
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || request.Name == config.RelayName {
+		return respondError(c, invalidError("invalid_relay_name", "name must be set and differ from the leader's"))
+	}
+	relay := &Relay{
+		Name:       request.Name,
+		PublicIP:   strings.TrimSpace(request.PublicIP),
+		Region:     strings.TrimSpace(request.Region),
+		Role:       clusterRoleFollower,
+		LastSeenAt: time.Now().UTC(),
+	}
+	if err := SaveRelay(relay); err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, relay)
+}
+
+func getRelays(c echo.Context) error {
+	relays, err := GetRelays()
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, relays)
+}
+
+func buildClusterSnapshot() (*ClusterSnapshot, error) {
+	snapshot := &ClusterSnapshot{}
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		snapshot.Networks = append(snapshot.Networks, clusterNetwork{Network: network, PrivateKey: network.PrivateKey})
+	}
+	if snapshot.Peers, err = GetPeers(); err != nil {
+		return nil, err
+	}
+	snapshot.PeerTokenHashes = map[string]string{}
+	for _, peer := range snapshot.Peers {
+		if peer.TokenHash != "" {
+			snapshot.PeerTokenHashes[peer.ID] = peer.TokenHash
+		}
+	}
+	if err = GetDB().Order("created_at").Find(&snapshot.AccessRules).Error; err != nil {
+		return nil, err
+	}
+	if snapshot.Relays, err = GetRelays(); err != nil {
+		return nil, err
+	}
+	if snapshot.PortForwards, err = GetPortForwards(""); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// replaceClusterState swaps the local networks, peers, access rules and relays for the snapshot
+func replaceClusterState(snapshot *ClusterSnapshot) error {
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&PortForward{}, &AccessRule{}, &Peer{}, &Network{}, &Relay{}} {
+			if err := tx.Where("1 = 1").Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		for _, network := range snapshot.Networks {
+			network.Network.PrivateKey = network.PrivateKey
+			if err := tx.Create(&network.Network).Error; err != nil {
+				return err
+			}
+		}
+		for i := range snapshot.Peers {
+			snapshot.Peers[i].TokenHash = snapshot.PeerTokenHashes[snapshot.Peers[i].ID]
+		}
+		if len(snapshot.Peers) > 0 {
+			if err := tx.CreateInBatches(snapshot.Peers, 100).Error; err != nil {
+				return err
+			}
+		}
+		if len(snapshot.AccessRules) > 0 {
+			if err := tx.CreateInBatches(snapshot.AccessRules, 100).Error; err != nil {
+				return err
+			}
+		}
+		if len(snapshot.Relays) > 0 {
+			if err := tx.CreateInBatches(snapshot.Relays, 100).Error; err != nil {
+				return err
+			}
+		}
+		if len(snapshot.PortForwards) > 0 {
+			if err := tx.CreateInBatches(snapshot.PortForwards, 100).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// relayEndpoints lists the endpoints of a network on the live relays, this relay first, then the leader
+func relayEndpoints(network *Network) []string {
+	endpoints := []string{fmt.Sprintf("%s:%d", config.WireguardRelayServerPublicIP, network.ListenPort)}
+	var relays []Relay
+	err := GetDB().Order("role DESC, name").Find(&relays, "last_seen_at > ?", time.Now().UTC().Add(-relayLivenessGracePeriod)).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to get relays: %s", err)
+		return endpoints
+	}
+	for _, relay := range relays {
+		if relay.PublicIP == "" || relay.PublicIP == config.WireguardRelayServerPublicIP {
+			continue
+		}
+		endpoints = append(endpoints, fmt.Sprintf("%s:%d", relay.PublicIP, network.ListenPort))
+	}
+	return endpoints
+}
+
+// runRelayHeartbeat keeps the leader in the relay list followers and peer configs are built from
+func runRelayHeartbeat(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	ticker := time.NewTicker(relayHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		err := SaveRelay(&Relay{
+			Name:       config.RelayName,
+			PublicIP:   config.WireguardRelayServerPublicIP,
+			Region:     config.RelayRegion,
+			Role:       clusterRoleLeader,
+			LastSeenAt: time.Now().UTC(),
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to record the relay heartbeat: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runClusterFollower pulls the leader's state and installs it on the local interfaces and chains
+func runClusterFollower(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	leader := client.New(config.ClusterLeaderURL, config.ClusterLeaderToken)
+	// networks set up by this process, keyed by id
+	applied := map[string]Network{}
+	ticker := time.NewTicker(clusterSyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := syncWithLeader(ctx, leader, applied); err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] Failed to sync with the leader %s: %s", config.ClusterLeaderURL, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func syncWithLeader(ctx context.Context, leader *client.Client, applied map[string]Network) error {
+	err := leader.SendRelayHeartbeat(ctx, client.RelayHeartbeatRequest{
+		Name:     config.RelayName,
+		PublicIP: config.WireguardRelayServerPublicIP,
+		Region:   config.RelayRegion,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := leader.GetClusterSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	var snapshot ClusterSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if err := replaceClusterState(&snapshot); err != nil {
+		return err
+	}
+
+	desired := map[string]Network{}
+	var networks []Network
+	for _, network := range snapshot.Networks {
+		network.Network.PrivateKey = network.PrivateKey
+		if network.Status == NetworkStatusCreated {
+			desired[network.ID] = network.Network
+			networks = append(networks, network.Network)
+		}
+	}
+	for id, network := range applied {
+		if current, ok := desired[id]; ok && sameDataPlane(&current, &network) {
+			continue
+		}
+		log.Printf("[INFO] Network %s changed on the leader, removing %s", network.Name, network.Interface)
+		teardownNetwork(&network, networks)
+		delete(applied, id)
+	}
+	for i := range networks {
+		network := &networks[i]
+		if _, ok := applied[network.ID]; !ok {
+			if err := setupNetwork(network, networks); err != nil {
+				log.Printf("[ERROR] Failed to set up network %s: %s", network.Name, err)
+				continue
+			}
+			applied[network.ID] = *network
+		}
+		if err := reconcileNetwork(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameDataPlane reports whether two versions of a network share interface, chain and keys
+func sameDataPlane(a *Network, b *Network) bool {
+	return a.Interface == b.Interface && a.Chain == b.Chain && a.Subnet == b.Subnet &&
+		a.ListenPort == b.ListenPort && a.PrivateKey == b.PrivateKey
+}
@@ -3,9 +3,7 @@ package main
 import (
 	"encoding/json"
 	"log"
-	"net"
 	"os"
-	"strings"
 )
 
 type Config struct {
@@ -15,6 +13,29 @@ type Config struct {
 	WireguardListenPort          int    `json:"wireguard_listen_port"`
 	WireguardPrivateKey          string `json:"wireguard_private_key"`
 	WireguardPublicKey           string `json:"wireguard_public_key"`
+	// WireguardInterface and IptablesChain name the interface and chain of the default network
+	WireguardInterface string `json:"wireguard_interface"`
+	IptablesChain      string `json:"iptables_chain"`
+	// InterfacePrefix and IptablesChainPrefix name the interfaces and chains of networks created with the api
+	InterfacePrefix     string `json:"interface_prefix"`
+	IptablesChainPrefix string `json:"iptables_chain_prefix"`
+	// Netns runs the data plane (interfaces, iptables, sysctl) inside the named network namespace
+	Netns string `json:"netns"`
+	// ClusterRole is leader or follower, empty runs a standalone relay
+	ClusterRole string `json:"cluster_role"`
+	// ClusterLeaderURL and ClusterLeaderToken let a follower pull the state from the leader
+	ClusterLeaderURL   string `json:"cluster_leader_url"`
+	ClusterLeaderToken string `json:"cluster_leader_token"`
+	// RelayName defaults to the hostname, RelayRegion is informative
+	RelayName   string `json:"relay_name"`
+	RelayRegion string `json:"relay_region"`
+	// NarrowAllowedIPs gives peers the /32s of the relay and of the peers they have access rules with
+	// instead of the whole subnet
+	NarrowAllowedIPs bool `json:"narrow_allowed_ips"`
+	// EgressSourceIP is the address the traffic of peers with egress leaves with, masqueraded if empty
+	EgressSourceIP string `json:"egress_source_ip"`
+	// DNS serves <peer-name>.<network-name>.pt on the relay address of every network
+	DNS bool `json:"dns"`
 }
 
 var config *Config
@@ -34,6 +55,21 @@ func loadConfig() {
 			WireguardListenPort: 51820,
 		}
 	}
+	if config.WireguardInterface == "" {
+		config.WireguardInterface = defaultNetworkInterface
+	}
+	if config.IptablesChain == "" {
+		config.IptablesChain = defaultNetworkChain
+	}
+	if config.InterfacePrefix == "" {
+		config.InterfacePrefix = "pt-"
+	}
+	if config.IptablesChainPrefix == "" {
+		config.IptablesChainPrefix = "PT_"
+	}
+	if config.RelayName == "" {
+		config.RelayName, _ = os.Hostname()
+	}
 
 	// write to config.json
 	jsonFile, err = os.Create("config.json")
@@ -45,21 +81,37 @@ func loadConfig() {
 	encoder.SetIndent("", "    ")
 	encoder.Encode(config)
 
+	// the dns server binds the relay addresses, they only exist inside the namespace
+	if config.DNS && config.Netns != "" {
+		log.Println("dns cannot be used together with netns")
+		os.Exit(1)
+	}
+
+	switch config.ClusterRole {
+	case "", clusterRoleLeader:
+	case clusterRoleFollower:
+		// networks and their keys come from the leader
+		if config.APIToken == "" || config.WireguardRelayServerPublicIP == "" || config.ClusterLeaderURL == "" || config.ClusterLeaderToken == "" {
+			log.Println("A follower needs api_token, wireguard_relay_server_public_ip, cluster_leader_url and cluster_leader_token")
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Println("cluster_role must be leader, follower or empty")
+		os.Exit(1)
+	}
+
 	// check if config.json is empty
 	if config.APIToken == "" || config.WireguardSubnet == "" || config.WireguardRelayServerPublicIP == "" || config.WireguardListenPort == 0 || config.WireguardPrivateKey == "" || config.WireguardPublicKey == "" {
 		log.Println("Config.json is empty, please fill in the required fields")
 		os.Exit(1)
 	}
-}
-
-func (c *Config) GetRelayWireguardAddress() string {
-	return strings.Split(config.WireguardSubnet, "/")[0]
-}
-
-func (c *Config) GetWireguardClientSubnet() string {
-	_, ipnet, err := net.ParseCIDR(c.WireguardSubnet)
-	if err != nil {
-		return ""
+	if !networkInterfaceRegex.MatchString(config.WireguardInterface) || len(config.InterfacePrefix) > 10 {
+		log.Println("wireguard_interface must be lowercase and at most 15 characters, interface_prefix at most 10")
+		os.Exit(1)
+	}
+	if !iptablesChainRegex.MatchString(config.IptablesChain) || len(config.IptablesChainPrefix) > 12 || !iptablesChainRegex.MatchString(config.IptablesChainPrefix) {
+		log.Println("iptables_chain must be at most 28 letters, digits, - or _, iptables_chain_prefix at most 12")
+		os.Exit(1)
 	}
-	return ipnet.String()
 }
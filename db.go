@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"sync"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -16,28 +19,184 @@ const (
 	PeerStatusPending  PeerStatus = "pending"
 	PeerStatusCreated  PeerStatus = "created"
 	PeerStatusDeleting PeerStatus = "deleting"
+	PeerStatusFailed   PeerStatus = "failed"
 )
 
 type AccessRuleStatus string
 
 const (
-	AccessRuleStatusPending AccessRuleStatus = "pending"
-	AccessRuleStatusCreated AccessRuleStatus = "created"
+	AccessRuleStatusPending  AccessRuleStatus = "pending"
+	AccessRuleStatusCreated  AccessRuleStatus = "created"
+	AccessRuleStatusDeleting AccessRuleStatus = "deleting"
 )
 
+type PortForwardStatus string
+
+const (
+	PortForwardStatusPending  PortForwardStatus = "pending"
+	PortForwardStatusCreated  PortForwardStatus = "created"
+	PortForwardStatusDeleting PortForwardStatus = "deleting"
+	PortForwardStatusFailed   PortForwardStatus = "failed"
+)
+
+type NetworkStatus string
+
+const (
+	NetworkStatusPending  NetworkStatus = "pending"
+	NetworkStatusCreated  NetworkStatus = "created"
+	NetworkStatusDeleting NetworkStatus = "deleting"
+	NetworkStatusFailed   NetworkStatus = "failed"
+)
+
+// Network is an isolated overlay with its own wireguard interface, key, port, subnet and iptables chain
+type Network struct {
+	ID   string `gorm:"type:uuid;primary_key" json:"id"`
+	Name string `gorm:"type:varchar(63);uniqueIndex" json:"name"`
+	// Subnet holds the relay address and the prefix, e.g. 10.0.0.1/16
+	Subnet     string        `gorm:"type:varchar(64)" json:"subnet"`
+	ListenPort int           `gorm:"uniqueIndex" json:"listen_port"`
+	Interface  string        `gorm:"type:varchar(15);uniqueIndex" json:"interface"`
+	Chain      string        `gorm:"type:varchar(28);uniqueIndex" json:"chain"`
+	PrivateKey string        `gorm:"type:text" json:"-"`
+	PublicKey  string        `gorm:"type:text" json:"public_key"`
+	Status     NetworkStatus `gorm:"type:varchar(20);index" json:"status"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// Relay is a pikotunnel server of the cluster, peers can use any of them as endpoint
+type Relay struct {
+	Name       string    `gorm:"type:varchar(255);primary_key" json:"name"`
+	PublicIP   string    `gorm:"type:varchar(255)" json:"public_ip"`
+	Region     string    `gorm:"type:varchar(255)" json:"region"`
+	Role       string    `gorm:"type:varchar(20)" json:"role"`
+	LastSeenAt time.Time `gorm:"index" json:"last_seen_at"`
+}
+
 type Peer struct {
 	ID         string     `gorm:"type:uuid;primary_key" json:"id"`
+	NetworkID  string     `gorm:"type:uuid;index" json:"network_id"`
 	IP         string     `gorm:"type:varchar(255);index" json:"ip"`
 	PublicKey  string     `gorm:"type:text" json:"public_key"`
 	PrivateKey string     `gorm:"type:text" json:"private_key"`
 	Status     PeerStatus `gorm:"type:varchar(20);index" json:"status"`
+	Name       string     `gorm:"type:varchar(63);index" json:"name"`
+	Label      string     `gorm:"type:varchar(255);index" json:"label"`
+	CreatedAt  time.Time  `gorm:"index" json:"created_at"`
+	// FirstHandshakeAt is set the first time the relay sees a handshake from the peer
+	FirstHandshakeAt *time.Time `json:"first_handshake_at"`
+	// TokenHash is the sha256 of the token given to an enrolled peer, it only grants access to the peer itself
+	TokenHash string `gorm:"type:varchar(64);index" json:"-"`
+	// Direct peers talk to each other without the relay when both opted in, see directPeers
+	Direct bool `json:"direct"`
+	// Endpoint is the public address the relay last saw the peer at
+	Endpoint string `gorm:"type:varchar(64)" json:"endpoint"`
+	// Routes are the comma separated subnets the peer is a gateway for, e.g. an office lan
+	Routes string `gorm:"type:text" json:"routes"`
+	// Egress lets the peer reach the internet through the relay, its traffic leaves with the relay's address
+	Egress bool `json:"egress"`
+	// IngressLimitKbit limits what the peer sends, EgressLimitKbit what it receives, 0 is unlimited
+	IngressLimitKbit int `json:"ingress_limit_kbit"`
+	EgressLimitKbit  int `json:"egress_limit_kbit"`
+	// TrafficClass identifies the tc class and filters of a limited peer, see applyPeerRateLimits
+	TrafficClass int `gorm:"index" json:"traffic_class"`
 }
 
 type AccessRule struct {
-	ID      string           `gorm:"type:uuid;primary_key" json:"id"`
-	PeerAID string           `gorm:"type:uuid;index:idx_peer_id" json:"peer_a_id"`
-	PeerBID string           `gorm:"type:uuid;index:idx_peer_id" json:"peer_b_id"`
-	Status  AccessRuleStatus `gorm:"type:varchar(20);index" json:"status"`
+	ID        string           `gorm:"type:uuid;primary_key" json:"id"`
+	PeerAID   string           `gorm:"type:uuid;index:idx_peer_id" json:"peer_a_id"`
+	PeerBID   string           `gorm:"type:uuid;index:idx_peer_id" json:"peer_b_id"`
+	NetworkID string           `gorm:"type:uuid;index" json:"network_id"`
+	Status    AccessRuleStatus `gorm:"type:varchar(20);index" json:"status"`
+	ExpiresAt *time.Time       `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time        `gorm:"index" json:"created_at"`
+	// Routes are the comma separated routes of one peer the rule opens to the other peer
+	Routes string `gorm:"type:text" json:"routes"`
+}
+
+// PortForward exposes a port of a peer on the relay, e.g. relay:2222 -> peer:22
+type PortForward struct {
+	ID         string            `gorm:"type:uuid;primary_key" json:"id"`
+	NetworkID  string            `gorm:"type:uuid;index" json:"network_id"`
+	PeerID     string            `gorm:"type:uuid;index" json:"peer_id"`
+	Protocol   string            `gorm:"type:varchar(3);uniqueIndex:idx_port_forward_public" json:"protocol"`
+	PublicPort int               `gorm:"uniqueIndex:idx_port_forward_public" json:"public_port"`
+	PeerPort   int               `json:"peer_port"`
+	Status     PortForwardStatus `gorm:"type:varchar(20);index" json:"status"`
+	CreatedAt  time.Time         `gorm:"index" json:"created_at"`
+}
+
+// OtherPeerID returns the peer on the other side of the rule
+func (rule *AccessRule) OtherPeerID(peerID string) string {
+	if rule.PeerAID == peerID {
+		return rule.PeerBID
+	}
+	return rule.PeerAID
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "failed"
+)
+
+type Webhook struct {
+	ID     string `gorm:"type:uuid;primary_key" json:"id"`
+	URL    string `gorm:"type:text" json:"url"`
+	Secret string `gorm:"type:text" json:"secret"`
+	// Events is a comma separated list of subscribed event types, empty means all
+	Events string `gorm:"type:text" json:"events"`
+}
+
+type WebhookDelivery struct {
+	ID            string                `gorm:"type:uuid;primary_key" json:"id"`
+	WebhookID     string                `gorm:"type:uuid;index" json:"webhook_id"`
+	Event         string                `gorm:"type:varchar(64)" json:"event"`
+	Payload       string                `gorm:"type:text" json:"payload"`
+	Status        WebhookDeliveryStatus `gorm:"type:varchar(20);index:idx_delivery_due" json:"status"`
+	Attempts      int                   `json:"attempts"`
+	NextAttemptAt time.Time             `gorm:"index:idx_delivery_due" json:"next_attempt_at"`
+	LastError     string                `gorm:"type:text" json:"last_error"`
+}
+
+type Event struct {
+	ID        uint64          `gorm:"primaryKey;autoIncrement" json:"id"`
+	Type      string          `gorm:"type:varchar(64)" json:"type"`
+	Timestamp time.Time       `gorm:"index" json:"timestamp"`
+	Data      json.RawMessage `gorm:"type:text" json:"data"`
+}
+
+// IdempotencyRecord stores the response of a create request made with an Idempotency-Key header
+type IdempotencyRecord struct {
+	Key         string `gorm:"type:varchar(255);primary_key" json:"key"`
+	Method      string `gorm:"type:varchar(10)" json:"method"`
+	Path        string `gorm:"type:text" json:"path"`
+	RequestHash string `gorm:"type:varchar(64)" json:"request_hash"`
+	// StatusCode is 0 while the original request is still being processed
+	StatusCode  int    `json:"status_code"`
+	ContentType string `gorm:"type:varchar(255)" json:"content_type"`
+	Body        []byte `json:"body"`
+	// ReservedAt is when the original request took the key, see idempotencyReservationTimeout
+	ReservedAt time.Time `json:"reserved_at"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+// EnrollmentToken lets a client create its own peer once without the api token.
+// Only the sha256 of the token is stored.
+type EnrollmentToken struct {
+	ID        string `gorm:"type:uuid;primary_key" json:"id"`
+	TokenHash string `gorm:"type:varchar(64);uniqueIndex" json:"-"`
+	Name      string `gorm:"type:varchar(63)" json:"name"`
+	Label     string `gorm:"type:varchar(255)" json:"label"`
+	// AccessRulePeerIDs is a comma separated list of peers the enrolled peer gets an access rule with
+	AccessRulePeerIDs string     `gorm:"type:text" json:"access_rule_peer_ids"`
+	NetworkID         string     `gorm:"type:uuid" json:"network_id"`
+	ExpiresAt         time.Time  `gorm:"index" json:"expires_at"`
+	UsedAt            *time.Time `json:"used_at"`
+	// PeerID is the peer created with the token
+	PeerID    string    `gorm:"type:uuid" json:"peer_id"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 var (
@@ -62,6 +221,10 @@ func GetDB() *gorm.DB {
 		var err error
 		db, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{
 			Logger: logger.Default.LogMode(logger.Silent),
+			// keep stored timestamps comparable with each other and with cursors
+			NowFunc: func() time.Time {
+				return time.Now().UTC()
+			},
 		})
 		if err != nil {
 			panic("failed to connect database > " + err.Error())
@@ -79,14 +242,36 @@ func GetDB() *gorm.DB {
 		}
 
 		// Auto migrate the schemas
-		err = db.AutoMigrate(&Peer{}, &AccessRule{})
+		err = db.AutoMigrate(&Network{}, &Peer{}, &AccessRule{}, &Webhook{}, &WebhookDelivery{}, &Event{}, &IdempotencyRecord{}, &EnrollmentToken{}, &Relay{}, &PortForward{})
 		if err != nil {
 			panic("failed to migrate database")
 		}
+
+		// rows created before created_at existed
+		now := time.Now().UTC()
+		db.Model(&Peer{}).Where("created_at IS NULL").Update("created_at", now)
+		db.Model(&AccessRule{}).Where("created_at IS NULL").Update("created_at", now)
+		// expiries stored with the offset the client sent, before they were normalized to utc
+		var expiring []AccessRule
+		db.Find(&expiring, "expires_at IS NOT NULL")
+		for _, rule := range expiring {
+			db.Model(&AccessRule{}).Where("id = ?", rule.ID).Update("expires_at", rule.ExpiresAt.UTC())
+		}
 	})
 	return db
 }
 
+// CheckpointAndCloseDB folds the WAL back into the database file and closes the connection
+func CheckpointAndCloseDB() error {
+	if db == nil {
+		return nil
+	}
+	if err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE);").Error; err != nil {
+		log.Printf("[ERROR] Failed to checkpoint the WAL: %s", err)
+	}
+	return CloseDB()
+}
+
 // CloseDB closes the database connection
 func CloseDB() error {
 	if db != nil {
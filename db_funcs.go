@@ -1,29 +1,77 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+func GetNetwork(networkID string) (*Network, error) {
+	var network Network
+	err := GetDB().First(&network, "id = ?", networkID).Error
+	return &network, wrapNotFound(err, networkNotFoundError(networkID))
+}
+
+func GetDefaultNetwork() (*Network, error) {
+	var network Network
+	err := GetDB().First(&network, "name = ?", defaultNetworkName).Error
+	return &network, wrapNotFound(err, networkNotFoundError(defaultNetworkName))
+}
+
+func GetNetworks() ([]Network, error) {
+	var networks []Network
+	err := GetDB().Order("created_at").Find(&networks).Error
+	return networks, err
+}
+
+func UpdateNetworkStatus(networkID string, status NetworkStatus) error {
+	err := GetDB().Model(&Network{}).Where("id = ?", networkID).Update("status", status).Error
+	if err == nil && status == NetworkStatusDeleting {
+		workerQueueChannel <- QueueJob{Type: "network", ID: networkID}
+	}
+	return err
+}
+
+func DeleteNetwork(networkID string) error {
+	return GetDB().Delete(&Network{}, "id = ?", networkID).Error
+}
+
 func GetPeer(peerID string) (*Peer, error) {
 	var peer Peer
 	err := GetDB().First(&peer, "id = ?", peerID).Error
+	return &peer, wrapNotFound(err, peerNotFoundError(peerID))
+}
+
+// GetPeerByName returns the peer of the network with that name, or nil
+func GetPeerByName(networkID string, name string) (*Peer, error) {
+	var peer Peer
+	err := GetDB().First(&peer, "network_id = ? AND name = ? AND status <> ?", networkID, name, PeerStatusDeleting).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
 	return &peer, err
 }
 
-func GetPeerIP(peerID string) (string, error) {
+// GetPeerByIP returns the peer of the network with that ip, or nil
+func GetPeerByIP(networkID string, ip string) (*Peer, error) {
 	var peer Peer
-	err := GetDB().First(&peer, "id = ?", peerID).Select("ip").Error
-	return peer.IP, err
+	err := GetDB().First(&peer, "network_id = ? AND ip = ?", networkID, ip).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &peer, err
 }
 
 func GetPeerStatus(peerID string) (PeerStatus, error) {
 	var peer Peer
 	err := GetDB().First(&peer, "id = ?", peerID).Select("status").Error
-	return peer.Status, err
+	return peer.Status, wrapNotFound(err, peerNotFoundError(peerID))
 }
 
 func GetPeers() ([]Peer, error) {
@@ -32,27 +80,137 @@ func GetPeers() ([]Peer, error) {
 	return peers, err
 }
 
-func CreatePeer() (*Peer, error) {
-	ip := getUniqueIPInSubnet()
-	privateKey, err := generateWireguardPrivateKey()
-	if err != nil {
-		return nil, err
+func GetPeersByIDs(peerIDs []string) (map[string]*Peer, error) {
+	var peers []Peer
+	err := GetDB().Find(&peers, "id IN ?", peerIDs).Error
+	result := map[string]*Peer{}
+	for i := range peers {
+		result[peers[i].ID] = &peers[i]
+	}
+	return result, err
+}
+
+// peer names are used as dns labels
+var peerNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type PeerFilter struct {
+	NetworkID string
+	Status    string
+	IP        string
+	Label     string
+	Name      string
+}
+
+var peerSortColumns = []string{"created_at", "ip", "status", "label", "name"}
+
+func ListPeers(filter PeerFilter, options ListOptions) (*ListResult[Peer], error) {
+	query := GetDB().Model(&Peer{})
+	if filter.NetworkID != "" {
+		query = query.Where("network_id = ?", filter.NetworkID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if filter.Label != "" {
+		query = query.Where("label = ?", filter.Label)
+	}
+	if filter.Name != "" {
+		query = query.Where("name = ?", filter.Name)
+	}
+	return paginate(query, options, func(peer *Peer) string {
+		switch options.Sort {
+		case "ip":
+			return peer.IP
+		case "status":
+			return string(peer.Status)
+		case "label":
+			return peer.Label
+		case "name":
+			return peer.Name
+		}
+		return peer.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}, func(peer *Peer) string {
+		return peer.ID
+	})
+}
+
+// CreatePeer creates a pending peer in the network, the default one when networkID is empty.
+// With an empty publicKey the relay generates the key pair, otherwise the peer keeps its
+// private key to itself.
+func CreatePeer(networkID string, name string, label string, publicKey string) (*Peer, error) {
+	var keys *wireguardKeyPair
+	if strings.TrimSpace(publicKey) == "" {
+		var err error
+		keys, err = generateWireguardKeyPair()
+		if err != nil {
+			return nil, err
+		}
 	}
-	publicKey, err := generateWireguardPublicKey(privateKey)
+	peer, err := createPeerTx(GetDB(), networkID, name, label, publicKey, keys)
+	if err == nil {
+		workerQueueChannel <- QueueJob{Type: "peer", ID: peer.ID}
+	}
+	return peer, err
+}
+
+// createPeerTx inserts a pending peer using tx, queueing it to the worker is up to the caller.
+// The peer gets publicKey when the caller brought its own key, keys otherwise.
+func createPeerTx(tx *gorm.DB, networkID string, name string, label string, publicKey string, keys *wireguardKeyPair) (*Peer, error) {
+	network, err := resolveNetworkTx(tx, networkID)
 	if err != nil {
 		return nil, err
 	}
+	name = strings.TrimSpace(name)
+	if name != "" {
+		if !peerNameRegex.MatchString(name) {
+			return nil, invalidError("invalid_peer_name", "name must be a lowercase dns label")
+		}
+		var count int64
+		// names are unique per network, like <peer>.<network>.pt. A deleting peer frees its name,
+		// apply can recreate a peer before the worker has removed the old one.
+		err := tx.Model(&Peer{}).Where("network_id = ? AND name = ? AND status <> ?", network.ID, name, PeerStatusDeleting).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, conflictError("peer_name_taken", "peer with name %s already exists in network %s", name, network.Name)
+		}
+	}
+	privateKey := ""
+	publicKey = strings.TrimSpace(publicKey)
+	if publicKey != "" {
+		if !isValidWireguardKey(publicKey) {
+			return nil, invalidError("invalid_public_key", "public key must be a base64 encoded 32 byte wireguard key")
+		}
+		var count int64
+		err := tx.Model(&Peer{}).Where("public_key = ?", publicKey).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, conflictError("public_key_taken", "a peer with this public key already exists")
+		}
+	} else {
+		if keys == nil {
+			return nil, errors.New("a peer without a public key needs a generated key pair")
+		}
+		privateKey, publicKey = keys.privateKey, keys.publicKey
+	}
+	ip := getUniqueIPInSubnet(tx, network)
 	peer := &Peer{
 		ID:         uuid.New().String(),
+		NetworkID:  network.ID,
 		IP:         ip,
 		PrivateKey: privateKey,
 		PublicKey:  publicKey,
 		Status:     PeerStatusPending,
+		Name:       name,
+		Label:      strings.TrimSpace(label),
 	}
-	err = GetDB().Create(peer).Error
-	if err == nil {
-		workerQueueChannel <- QueueJob{Type: "peer", ID: peer.ID}
-	}
+	err = tx.Create(peer).Error
 	return peer, err
 }
 
@@ -71,12 +229,17 @@ func DeletePeer(peerID string) error {
 func GetAccessRuleByID(id string) (*AccessRule, error) {
 	var accessRule AccessRule
 	err := GetDB().First(&accessRule, "id = ?", id).Error
-	return &accessRule, err
+	return &accessRule, wrapNotFound(err, notFoundError("access_rule_not_found", "access rule %s not found", id))
 }
 
 func GetAccessRule(peerAID, peerBID string) (*AccessRule, error) {
+	accessRule, err := getAccessRuleTx(GetDB(), peerAID, peerBID)
+	return accessRule, wrapNotFound(err, notFoundError("access_rule_not_found", "access rule between %s and %s not found", peerAID, peerBID))
+}
+
+func getAccessRuleTx(tx *gorm.DB, peerAID, peerBID string) (*AccessRule, error) {
 	var accessRule AccessRule
-	err := GetDB().First(&accessRule, "peer_a_id = ? AND peer_b_id = ?", peerAID, peerBID).Error
+	err := tx.First(&accessRule, "peer_a_id = ? AND peer_b_id = ?", peerAID, peerBID).Error
 	if err == nil {
 		return &accessRule, nil
 	}
@@ -84,7 +247,7 @@ func GetAccessRule(peerAID, peerBID string) (*AccessRule, error) {
 		return nil, err
 	}
 	// try out peerBID -> peerAID
-	err = GetDB().First(&accessRule, "peer_b_id = ? AND peer_a_id = ?", peerAID, peerBID).Error
+	err = tx.First(&accessRule, "peer_b_id = ? AND peer_a_id = ?", peerAID, peerBID).Error
 	if err != nil {
 		return nil, err
 	}
@@ -97,6 +260,35 @@ func GetAccessRulesByPeerID(peerID string) ([]AccessRule, error) {
 	return accessRules, err
 }
 
+type AccessRuleFilter struct {
+	NetworkID string
+	Status    string
+	PeerID    string
+}
+
+var accessRuleSortColumns = []string{"created_at", "status"}
+
+func ListAccessRules(filter AccessRuleFilter, options ListOptions) (*ListResult[AccessRule], error) {
+	query := GetDB().Model(&AccessRule{})
+	if filter.NetworkID != "" {
+		query = query.Where("network_id = ?", filter.NetworkID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.PeerID != "" {
+		query = query.Where("(peer_a_id = ? OR peer_b_id = ?)", filter.PeerID, filter.PeerID)
+	}
+	return paginate(query, options, func(rule *AccessRule) string {
+		if options.Sort == "status" {
+			return string(rule.Status)
+		}
+		return rule.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}, func(rule *AccessRule) string {
+		return rule.ID
+	})
+}
+
 func IsAccessRuleExist(peerAID, peerBID string) (bool, error) {
 	accessRule, err := GetAccessRule(peerAID, peerBID)
 	if err != nil {
@@ -108,44 +300,71 @@ func IsAccessRuleExist(peerAID, peerBID string) (bool, error) {
 	return accessRule != nil, nil
 }
 
-func CreateAccessRule(peerAID, peerBID string) (*AccessRule, error) {
+func CreateAccessRule(peerAID, peerBID string, expiresAt *time.Time, routes []string) (*AccessRule, error) {
+	accessRule, isNew, err := createAccessRuleTx(GetDB(), peerAID, peerBID, expiresAt, routes)
+	if err == nil && isNew {
+		workerQueueChannel <- QueueJob{Type: "access_rule", ID: accessRule.ID}
+	}
+	return accessRule, err
+}
+
+// createAccessRuleTx inserts a pending access rule using tx, or returns the existing one with isNew false.
+// routes lists the routed subnets of either peer the rule also opens to the other one.
+func createAccessRuleTx(tx *gorm.DB, peerAID, peerBID string, expiresAt *time.Time, routes []string) (accessRule *AccessRule, isNew bool, err error) {
 	peerAID = strings.TrimSpace(peerAID)
 	peerBID = strings.TrimSpace(peerBID)
-	isExist, err := IsAccessRuleExist(peerAID, peerBID)
-	if err != nil {
-		return nil, err
+	// sqlite compares timestamps as text, they must all be in the same zone
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		expiresAt = &utc
+	}
+	// check if peerAID and peerBID are the same
+	if peerAID == peerBID {
+		return nil, false, unprocessableError("same_peer", "peer_a_id and peer_b_id cannot be the same")
 	}
-	if isExist {
-		record, err := GetAccessRule(peerAID, peerBID)
+	record, err := getAccessRuleTx(tx, peerAID, peerBID)
+	if err == nil {
+		normalized, err := normalizeRoutes(routes)
 		if err != nil {
-			return nil, errors.New("failed to get access rule " + peerAID + " -> " + peerBID + " : " + err.Error())
+			return nil, false, err
 		}
-		return record, nil
+		if len(normalized) > 0 && strings.Join(normalized, ",") != record.Routes {
+			return nil, false, conflictError("access_rule_exists", "an access rule between %s and %s already exists with other routes", peerAID, peerBID)
+		}
+		return record, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
 	}
 	// Validate peerAID and peerBID
-	_, err = GetPeer(peerAID)
+	var peerA, peerB Peer
+	err = tx.First(&peerA, "id = ?", peerAID).Error
 	if err != nil {
-		return nil, errors.New("failed to get peer " + peerAID + " : " + err.Error())
+		return nil, false, wrapNotFound(err, peerNotFoundError(peerAID))
 	}
-	_, err = GetPeer(peerBID)
+	err = tx.First(&peerB, "id = ?", peerBID).Error
 	if err != nil {
-		return nil, errors.New("failed to get peer " + peerBID + " : " + err.Error())
+		return nil, false, wrapNotFound(err, peerNotFoundError(peerBID))
 	}
-	// check if peerAID and peerBID are the same
-	if peerAID == peerBID {
-		return nil, errors.New("peerAID and peerBID cannot be the same")
+	// networks are isolated, their peers never reach each other
+	if peerA.NetworkID != peerB.NetworkID {
+		return nil, false, unprocessableError("network_mismatch", "peers %s and %s are in different networks", peerAID, peerBID)
 	}
-	accessRule := &AccessRule{
-		ID:      uuid.New().String(),
-		PeerAID: peerAID,
-		PeerBID: peerBID,
-		Status:  AccessRuleStatusPending,
+	routes, err = validateAccessRuleRoutes(routes, &peerA, &peerB)
+	if err != nil {
+		return nil, false, err
 	}
-	err = GetDB().Create(accessRule).Error
-	if err == nil {
-		workerQueueChannel <- QueueJob{Type: "access_rule", ID: accessRule.ID}
+	accessRule = &AccessRule{
+		ID:        uuid.New().String(),
+		PeerAID:   peerAID,
+		PeerBID:   peerBID,
+		NetworkID: peerA.NetworkID,
+		Status:    AccessRuleStatusPending,
+		ExpiresAt: expiresAt,
+		Routes:    strings.Join(routes, ","),
 	}
-	return accessRule, err
+	err = tx.Create(accessRule).Error
+	return accessRule, true, err
 }
 
 func UpdateAccessRuleStatus(ruleID string, status AccessRuleStatus) error {
@@ -155,3 +374,208 @@ func UpdateAccessRuleStatus(ruleID string, status AccessRuleStatus) error {
 func DeleteAccessRule(ruleID string) error {
 	return GetDB().Delete(&AccessRule{}, "id = ?", ruleID).Error
 }
+
+func GetExpiredAccessRules() ([]AccessRule, error) {
+	var accessRules []AccessRule
+	err := GetDB().Find(&accessRules, "expires_at IS NOT NULL AND expires_at <= ?", time.Now().UTC()).Error
+	return accessRules, err
+}
+
+func SetPeerFirstHandshake(publicKey string, at time.Time) (*Peer, error) {
+	var peer Peer
+	err := GetDB().First(&peer, "public_key = ? AND first_handshake_at IS NULL", publicKey).Error
+	if err != nil {
+		return nil, err
+	}
+	peer.FirstHandshakeAt = &at
+	err = GetDB().Model(&Peer{}).Where("id = ?", peer.ID).Update("first_handshake_at", at).Error
+	return &peer, err
+}
+
+// SetPeerEndpoint records the endpoint the relay sees the peer at, it returns
+// gorm.ErrRecordNotFound when the peer is unknown or the endpoint did not change
+func SetPeerEndpoint(publicKey string, endpoint string) (*Peer, error) {
+	var peer Peer
+	err := GetDB().First(&peer, "public_key = ? AND (endpoint IS NULL OR endpoint <> ?)", publicKey, endpoint).Error
+	if err != nil {
+		return nil, err
+	}
+	peer.Endpoint = endpoint
+	err = GetDB().Model(&Peer{}).Where("id = ?", peer.ID).Update("endpoint", endpoint).Error
+	return &peer, err
+}
+
+func SetPeerDirect(peerID string, direct bool) (*Peer, error) {
+	peer, err := GetPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	peer.Direct = direct
+	err = GetDB().Model(&Peer{}).Where("id = ?", peerID).Update("direct", direct).Error
+	return peer, err
+}
+
+func SetPeerEgress(peerID string, egress bool) (*Peer, error) {
+	peer, err := GetPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	peer.Egress = egress
+	err = GetDB().Model(&Peer{}).Where("id = ?", peerID).Update("egress", egress).Error
+	return peer, err
+}
+
+func GetPortForward(id string) (*PortForward, error) {
+	var forward PortForward
+	err := GetDB().First(&forward, "id = ?", id).Error
+	return &forward, wrapNotFound(err, notFoundError("port_forward_not_found", "port forward %s not found", id))
+}
+
+// GetPortForwards lists the port forwards, of one peer if peerID is set
+func GetPortForwards(peerID string) ([]PortForward, error) {
+	forwards := []PortForward{}
+	query := GetDB().Order("created_at")
+	if peerID != "" {
+		query = query.Where("peer_id = ?", peerID)
+	}
+	err := query.Find(&forwards).Error
+	return forwards, err
+}
+
+func UpdatePortForwardStatus(id string, status PortForwardStatus) error {
+	return GetDB().Model(&PortForward{}).Where("id = ?", id).Update("status", status).Error
+}
+
+func DeletePortForward(id string) error {
+	return GetDB().Delete(&PortForward{}, "id = ?", id).Error
+}
+
+func GetWebhook(id string) (*Webhook, error) {
+	var webhook Webhook
+	err := GetDB().First(&webhook, "id = ?", id).Error
+	return &webhook, wrapNotFound(err, notFoundError("webhook_not_found", "webhook %s not found", id))
+}
+
+func GetWebhooks() ([]Webhook, error) {
+	var webhooks []Webhook
+	err := GetDB().Find(&webhooks).Error
+	return webhooks, err
+}
+
+func CreateWebhook(url, secret string, events []string) (*Webhook, error) {
+	url = strings.TrimSpace(url)
+	if url == "" {
+		return nil, invalidError("invalid_webhook", "url is required")
+	}
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(buf)
+	}
+	webhook := &Webhook{
+		ID:     uuid.New().String(),
+		URL:    url,
+		Secret: secret,
+		Events: strings.Join(events, ","),
+	}
+	err := GetDB().Create(webhook).Error
+	return webhook, err
+}
+
+func DeleteWebhook(id string) error {
+	return GetDB().Delete(&Webhook{}, "id = ?", id).Error
+}
+
+func GetDueWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := GetDB().Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryStatusPending, time.Now().UTC()).
+		Order("next_attempt_at").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+func CreateEvent(event *Event) error {
+	return GetDB().Create(event).Error
+}
+
+func GetEventsAfter(cursor uint64, limit int) ([]Event, error) {
+	var events []Event
+	err := GetDB().Where("id > ?", cursor).Order("id").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+func DeleteEventsBefore(before time.Time) error {
+	return GetDB().Delete(&Event{}, "timestamp < ?", before).Error
+}
+
+func GetIdempotencyRecord(key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	err := GetDB().First(&record, "key = ?", key).Error
+	return &record, err
+}
+
+// CreateIdempotencyRecord reserves the key, it fails if the key is already taken
+func CreateIdempotencyRecord(record *IdempotencyRecord) error {
+	return GetDB().Create(record).Error
+}
+
+func CompleteIdempotencyRecord(key string, statusCode int, contentType string, body []byte) error {
+	return GetDB().Model(&IdempotencyRecord{}).Where("key = ?", key).Updates(map[string]interface{}{
+		"status_code":  statusCode,
+		"content_type": contentType,
+		"body":         body,
+	}).Error
+}
+
+func DeleteIdempotencyRecord(key string) error {
+	return GetDB().Delete(&IdempotencyRecord{}, "key = ?", key).Error
+}
+
+// DeleteAbandonedIdempotencyRecord releases the key if it is still reserved since before
+// reservedBefore, it reports whether the key was released
+func DeleteAbandonedIdempotencyRecord(key string, reservedBefore time.Time) (bool, error) {
+	result := GetDB().Delete(&IdempotencyRecord{}, "key = ? AND status_code = 0 AND reserved_at < ?", key, reservedBefore)
+	return result.RowsAffected > 0, result.Error
+}
+
+func DeleteIdempotencyRecordsBefore(before time.Time) error {
+	return GetDB().Delete(&IdempotencyRecord{}, "created_at < ?", before).Error
+}
+
+// GetPeerByTokenHash returns the enrolled peer owning the token
+func GetPeerByTokenHash(tokenHash string) (*Peer, error) {
+	var peer Peer
+	err := GetDB().First(&peer, "token_hash = ? AND token_hash <> ''", tokenHash).Error
+	return &peer, err
+}
+
+func GetEnrollmentTokens() ([]EnrollmentToken, error) {
+	var tokens []EnrollmentToken
+	err := GetDB().Order("created_at").Find(&tokens).Error
+	return tokens, err
+}
+
+// CreateEnrollmentToken stores a token which is already validated, see MintEnrollmentToken
+func CreateEnrollmentToken(token *EnrollmentToken) error {
+	return GetDB().Create(token).Error
+}
+
+func DeleteEnrollmentToken(id string) error {
+	return GetDB().Delete(&EnrollmentToken{}, "id = ?", id).Error
+}
+
+func DeleteEnrollmentTokensExpiredBefore(before time.Time) error {
+	return GetDB().Delete(&EnrollmentToken{}, "expires_at < ?", before).Error
+}
+
+func GetRelays() ([]Relay, error) {
+	var relays []Relay
+	err := GetDB().Order("name").Find(&relays).Error
+	return relays, err
+}
+
+// SaveRelay creates or refreshes a relay, relays are keyed by name
+func SaveRelay(relay *Relay) error {
+	return GetDB().Save(relay).Error
+}
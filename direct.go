@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+)
+
+// directPeers lists the peers a peer can reach without going through the relay: both opted in,
+// the access rule between them is created and the relay has seen both endpoints. Peers keep the
+// relay for everything else, so a direct peer which stops answering falls back to the relay.
+func directPeers(peer *Peer) ([]map[string]string, error) {
+	result := []map[string]string{}
+	if !peer.Direct || peer.Endpoint == "" {
+		return result, nil
+	}
+	rules, err := GetAccessRulesByPeerID(peer.ID)
+	if err != nil {
+		return nil, err
+	}
+	otherPeerIDs := []string{}
+	for _, rule := range rules {
+		if rule.Status == AccessRuleStatusCreated {
+			otherPeerIDs = append(otherPeerIDs, rule.OtherPeerID(peer.ID))
+		}
+	}
+	peers, err := GetPeersByIDs(otherPeerIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, otherPeerID := range otherPeerIDs {
+		other, ok := peers[otherPeerID]
+		if !ok || !other.Direct || other.Endpoint == "" || other.Status != PeerStatusCreated {
+			continue
+		}
+		result = append(result, map[string]string{
+			"peer_id":     other.ID,
+			"public_key":  other.PublicKey,
+			"endpoint":    other.Endpoint,
+			"allowed_ips": other.IP + "/32",
+		})
+	}
+	// a stable order, so agents only see a change when there is one
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["peer_id"] < result[j]["peer_id"]
+	})
+	return result, nil
+}
+
+// notifyDirectPartners tells the peers having access rules with the peer that their direct peers changed
+func notifyDirectPartners(peer *Peer, reason string) {
+	rules, err := GetAccessRulesByPeerID(peer.ID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to get access rules of peer %s: %s", peer.ID, err)
+		return
+	}
+	for _, rule := range rules {
+		notifyPeerConfigChanged(reason, rule.OtherPeerID(peer.ID))
+	}
+}
+
+// eventConcernsPeer keeps the config changes of the peer and the peer's own lifecycle events
+func eventConcernsPeer(event Event, peerID string) bool {
+	var data map[string]string
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		return false
+	}
+	if event.Type == EventPeerConfigChanged {
+		return data["peer_id"] == peerID
+	}
+	return strings.HasPrefix(event.Type, "peer.") && data["id"] == peerID
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gorm.io/gorm"
+)
+
+const (
+	// dnsZone is the zone the relay answers for, peers are <peer-name>.<network-name>.pt
+	dnsZone            = "pt"
+	dnsPort            = 53
+	dnsTTL             = 30
+	dnsRefreshInterval = 10 * time.Second
+)
+
+// dnsListener serves the names of one network on its relay address
+type dnsListener struct {
+	conn    *net.UDPConn
+	address string
+}
+
+// dnsDomain is the domain of the peers of a network, it is the search domain of its peers
+func dnsDomain(network *Network) string {
+	return network.Name + "." + dnsZone
+}
+
+// peerDNS is the dns server and search domain of the peers of the network, empty when the dns
+// server does not run
+func peerDNS(network *Network) (string, string) {
+	if !config.DNS || config.Netns != "" {
+		return "", ""
+	}
+	return network.RelayAddress(), dnsDomain(network)
+}
+
+// runDNSServer listens on the relay address of every created network, networks created or
+// removed later are picked up every dnsRefreshInterval
+func runDNSServer(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	if config.Netns != "" {
+		log.Printf("[ERROR] The dns server does not run inside the %s network namespace, peer names are not served", config.Netns)
+		return
+	}
+	// keyed by network id
+	listeners := map[string]*dnsListener{}
+	ticker := time.NewTicker(dnsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		refreshDNSListeners(listeners)
+		select {
+		case <-ctx.Done():
+			for _, listener := range listeners {
+				listener.conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func refreshDNSListeners(listeners map[string]*dnsListener) {
+	networks, err := GetNetworks()
+	if err != nil {
+		log.Printf("[ERROR] Failed to get networks: %s", err)
+		return
+	}
+	wanted := map[string]string{}
+	for _, network := range networks {
+		if network.Status == NetworkStatusCreated {
+			wanted[network.ID] = network.RelayAddress()
+		}
+	}
+	for networkID, listener := range listeners {
+		if wanted[networkID] != listener.address {
+			listener.conn.Close()
+			delete(listeners, networkID)
+		}
+	}
+	for networkID, address := range wanted {
+		if _, ok := listeners[networkID]; ok {
+			continue
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(address), Port: dnsPort})
+		if err != nil {
+			// the interface may not be up yet, retried on the next refresh
+			log.Printf("[ERROR] Failed to listen for dns queries on %s: %s", address, err)
+			continue
+		}
+		listeners[networkID] = &dnsListener{conn: conn, address: address}
+		go serveDNS(conn, networkID)
+		log.Printf("[DONE] Serving dns on %s:%d", address, dnsPort)
+	}
+}
+
+func serveDNS(conn *net.UDPConn, networkID string) {
+	buffer := make([]byte, 512)
+	for {
+		n, remote, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[ERROR] Failed to read dns query: %s", err)
+			}
+			return
+		}
+		response, err := answerDNSQuery(buffer[:n], networkID, remote.IP.String())
+		if err != nil {
+			// not a dns message, nothing to answer
+			continue
+		}
+		conn.WriteToUDP(response, remote)
+	}
+}
+
+// answerDNSQuery answers for the peers of the network the asking peer can reach: itself and the
+// peers it has a created access rule with. Other names of the zone do not exist for it, names
+// outside the zone are refused, the relay is not a recursive resolver.
+func answerDNSQuery(query []byte, networkID string, sourceIP string) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	responseHeader := dnsmessage.Header{ID: header.ID, Response: true, RecursionDesired: header.RecursionDesired}
+	var answer *Peer
+	switch name := strings.ToLower(question.Name.String()); {
+	case question.Class != dnsmessage.ClassINET || !strings.HasSuffix(name, "."+dnsZone+"."):
+		responseHeader.RCode = dnsmessage.RCodeRefused
+	default:
+		responseHeader.Authoritative = true
+		answer, err = resolvePeerName(strings.TrimSuffix(name, "."+dnsZone+"."), networkID, sourceIP)
+		if err != nil {
+			responseHeader.RCode = dnsmessage.RCodeServerFailure
+			log.Printf("[ERROR] Failed to resolve %s: %s", name, err)
+		} else if answer == nil {
+			responseHeader.RCode = dnsmessage.RCodeNameError
+		}
+	}
+
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), responseHeader)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	// other types of a known name get an empty answer
+	if answer != nil && question.Type == dnsmessage.TypeA {
+		if err := builder.StartAnswers(); err != nil {
+			return nil, err
+		}
+		resource := dnsmessage.AResource{}
+		copy(resource.A[:], net.ParseIP(answer.IP).To4())
+		err = builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}, resource)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+// resolvePeerName finds the peer named <peer-name>.<network-name> if the peer at sourceIP can reach it
+func resolvePeerName(name string, networkID string, sourceIP string) (*Peer, error) {
+	labels := strings.Split(name, ".")
+	if len(labels) != 2 {
+		return nil, nil
+	}
+	network, err := GetNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	// networks are isolated, their names are only served on their own address
+	if labels[1] != network.Name {
+		return nil, nil
+	}
+	source, err := GetPeerByIP(networkID, sourceIP)
+	if err != nil || source == nil {
+		return nil, err
+	}
+	target, err := GetPeerByName(networkID, labels[0])
+	if err != nil || target == nil || target.Status != PeerStatusCreated {
+		return nil, err
+	}
+	if target.ID == source.ID {
+		return target, nil
+	}
+	rule, err := getAccessRuleTx(GetDB(), source.ID, target.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rule.Status != AccessRuleStatusCreated {
+		return nil, nil
+	}
+	return target, nil
+}
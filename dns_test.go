@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestPeerDNSRequiresTheDNSServer(t *testing.T) {
+	previous := *config
+	defer func() { *config = previous }()
+	network := &Network{Name: "default", Subnet: "10.0.0.1/16"}
+
+	config.DNS = false
+	if server, domain := peerDNS(network); server != "" || domain != "" {
+		t.Fatalf("expected no dns without the dns option, got %s %s", server, domain)
+	}
+	config.DNS = true
+	if server, domain := peerDNS(network); server != "10.0.0.1" || domain != "default.pt" {
+		t.Fatalf("expected 10.0.0.1 default.pt, got %s %s", server, domain)
+	}
+	// the dns server does not run inside a namespace
+	config.Netns = "pikotunnel"
+	if server, domain := peerDNS(network); server != "" || domain != "" {
+		t.Fatalf("expected no dns with netns, got %s %s", server, domain)
+	}
+}
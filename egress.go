@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"slices"
+)
+
+// egressAllowedIPs is the allowed ips of a peer with egress, everything goes through the relay
+const egressAllowedIPs = "0.0.0.0/0"
+
+// egressNATRule masquerades the traffic of the network leaving through another interface, or
+// with egress_source_ip set, rewrites it to that address. Only peers with an egress rule in the
+// chain get that far, see addEgressRule.
+func egressNATRule(network *Network) []string {
+	rule := []string{"-t", "nat", "-s", network.ClientSubnet(), "!", "-o", network.Interface}
+	if config.EgressSourceIP != "" {
+		return append(rule, "-j", "SNAT", "--to-source", config.EgressSourceIP)
+	}
+	return append(rule, "-j", "MASQUERADE")
+}
+
+// setupEgress sends the traffic of the network leaving the interface through the chain, where it
+// is dropped unless the peer has egress, and accepts the answers
+func setupEgress(network *Network) {
+	iface := network.Interface
+	ensureIptablesRule("-I", "FORWARD", "-i", iface, "!", "-o", iface, "-j", network.Chain)
+	ensureIptablesRule("-I", "FORWARD", "!", "-i", iface, "-o", iface, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	ensureIptablesRule("-A", network.Chain, "-i", iface, "!", "-o", iface, "-j", "DROP")
+	ensureIptablesRule("-A", "POSTROUTING", egressNATRule(network)...)
+}
+
+func teardownEgress(network *Network) {
+	iface := network.Interface
+	dataPlaneCommand("iptables", "-D", "FORWARD", "-i", iface, "!", "-o", iface, "-j", network.Chain).Run()
+	dataPlaneCommand("iptables", "-D", "FORWARD", "!", "-i", iface, "-o", iface, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT").Run()
+	dataPlaneCommand("iptables", append([]string{"-D", "POSTROUTING"}, egressNATRule(network)...)...).Run()
+}
+
+func addEgressRule(network *Network, peerIP string) {
+	err := dataPlaneCommand("iptables", "-I", network.Chain, "1", "-s", peerIP, "-i", network.Interface, "!", "-o", network.Interface, "-j", "ACCEPT").Run()
+	if err != nil {
+		log.Printf("[ERROR] Failed to add egress rule of %s: %s", peerIP, err)
+	}
+}
+
+func removeEgressRule(network *Network, peerIP string) {
+	err := dataPlaneCommand("iptables", "-D", network.Chain, "-s", peerIP, "-i", network.Interface, "!", "-o", network.Interface, "-j", "ACCEPT").Run()
+	if err != nil {
+		log.Printf("[ERROR] Failed to remove egress rule of %s: %s", peerIP, err)
+	}
+}
+
+// reconcileEgress adds the egress rules of the created peers with egress and removes the rules of
+// the peers which lost it, the rules of pending and deleting peers are left to the worker
+func reconcileEgress(network *Network, peers []Peer, existing map[string]bool) {
+	added, removed := 0, 0
+	known := []string{}
+	for _, peer := range peers {
+		if !peer.Egress {
+			continue
+		}
+		known = append(known, peer.IP)
+		if peer.Status == PeerStatusCreated && !existing[peer.IP] {
+			addEgressRule(network, peer.IP)
+			added++
+		}
+	}
+	for ip := range existing {
+		if !slices.Contains(known, ip) {
+			removeEgressRule(network, ip)
+			removed++
+		}
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("[DONE] Reconciled egress rules of network %s: %d added, %d removed", network.Name, added, removed)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	enrollmentTokenPrefix         = "pte_"
+	peerTokenPrefix               = "ptp_"
+	defaultEnrollmentTokenTTL     = 24 * time.Hour
+	maxEnrollmentTokenTTL         = 30 * 24 * time.Hour
+	enrollmentTokenRetention      = 7 * 24 * time.Hour
+	maxEnrollmentTokenAccessRules = 100
+)
+
+// generateToken returns a random token with the given prefix and its hash
+func generateToken(prefix string) (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := prefix + hex.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// MintEnrollmentToken creates a single use enrollment token. The plain token is only
+// returned here, the database keeps its hash.
+func MintEnrollmentToken(networkID string, name string, label string, accessRulePeerIDs []string, expiresAt *time.Time) (*EnrollmentToken, string, error) {
+	network, err := resolveNetworkTx(GetDB(), networkID)
+	if err != nil {
+		return nil, "", err
+	}
+	name = strings.TrimSpace(name)
+	if name != "" && !peerNameRegex.MatchString(name) {
+		return nil, "", invalidError("invalid_peer_name", "name must be a lowercase dns label")
+	}
+	if len(accessRulePeerIDs) > maxEnrollmentTokenAccessRules {
+		return nil, "", invalidError("invalid_enrollment_token", "at most %d access rule peers are allowed", maxEnrollmentTokenAccessRules)
+	}
+	now := time.Now().UTC()
+	expiry := now.Add(defaultEnrollmentTokenTTL)
+	if expiresAt != nil {
+		if !expiresAt.After(now) || expiresAt.Sub(now) > maxEnrollmentTokenTTL {
+			return nil, "", invalidError("invalid_expires_at", "expires_at must be in the future and within %s", maxEnrollmentTokenTTL)
+		}
+		expiry = expiresAt.UTC()
+	}
+	if name != "" {
+		var count int64
+		err := GetDB().Model(&Peer{}).Where("network_id = ? AND name = ? AND status <> ?", network.ID, name, PeerStatusDeleting).Count(&count).Error
+		if err != nil {
+			return nil, "", err
+		}
+		if count > 0 {
+			return nil, "", conflictError("peer_name_taken", "peer with name %s already exists in network %s", name, network.Name)
+		}
+	}
+	peerIDs := []string{}
+	for _, peerID := range accessRulePeerIDs {
+		peerID = strings.TrimSpace(peerID)
+		peer, err := GetPeer(peerID)
+		if err != nil {
+			return nil, "", err
+		}
+		if peer.NetworkID != network.ID {
+			return nil, "", unprocessableError("network_mismatch", "peer %s is not in network %s", peerID, network.Name)
+		}
+		peerIDs = append(peerIDs, peerID)
+	}
+
+	plain, hash, err := generateToken(enrollmentTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &EnrollmentToken{
+		ID:                uuid.New().String(),
+		TokenHash:         hash,
+		Name:              name,
+		Label:             strings.TrimSpace(label),
+		AccessRulePeerIDs: strings.Join(peerIDs, ","),
+		NetworkID:         network.ID,
+		ExpiresAt:         expiry,
+	}
+	err = CreateEnrollmentToken(token)
+	return token, plain, err
+}
+
+func invalidEnrollmentTokenError() *DomainError {
+	return &DomainError{Kind: ErrorKindUnauthorized, Code: "invalid_enrollment_token", Message: "enrollment token is invalid, expired or already used"}
+}
+
+// EnrollPeer exchanges an enrollment token for a new peer. With an empty publicKey the relay
+// generates the key pair. The returned peer token lets the peer read and delete itself.
+func EnrollPeer(plainToken string, publicKey string) (*Peer, string, error) {
+	var peer *Peer
+	var jobs []QueueJob
+	peerToken, peerTokenHash, err := generateToken(peerTokenPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	var keys *wireguardKeyPair
+	if strings.TrimSpace(publicKey) == "" {
+		// reject unusable tokens before running wg, the transaction checks the token again
+		var count int64
+		err = GetDB().Model(&EnrollmentToken{}).Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(plainToken), time.Now().UTC()).Count(&count).Error
+		if err != nil {
+			return nil, "", err
+		}
+		if count == 0 {
+			return nil, "", invalidEnrollmentTokenError()
+		}
+		keys, err = generateWireguardKeyPair()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = GetDB().Transaction(func(tx *gorm.DB) error {
+		var token EnrollmentToken
+		err := tx.First(&token, "token_hash = ?", hashToken(plainToken)).Error
+		if err != nil {
+			return wrapNotFound(err, invalidEnrollmentTokenError())
+		}
+		now := time.Now().UTC()
+		if token.UsedAt != nil || !token.ExpiresAt.After(now) {
+			return invalidEnrollmentTokenError()
+		}
+		// the token is burned first, a concurrent enrollment with the same token updates nothing
+		result := tx.Model(&EnrollmentToken{}).Where("id = ? AND used_at IS NULL", token.ID).Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return invalidEnrollmentTokenError()
+		}
+
+		peer, err = createPeerTx(tx, token.NetworkID, token.Name, token.Label, publicKey, keys)
+		if err != nil {
+			return err
+		}
+		peer.TokenHash = peerTokenHash
+		err = tx.Model(&Peer{}).Where("id = ?", peer.ID).Update("token_hash", peerTokenHash).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&EnrollmentToken{}).Where("id = ?", token.ID).Update("peer_id", peer.ID).Error
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, QueueJob{Type: "peer", ID: peer.ID})
+
+		for _, otherPeerID := range strings.Split(token.AccessRulePeerIDs, ",") {
+			if otherPeerID == "" {
+				continue
+			}
+			rule, isNew, err := createAccessRuleTx(tx, peer.ID, otherPeerID, nil, nil)
+			if err != nil {
+				// the other peer may have been deleted since the token was minted
+				log.Printf("[ERROR] Skipping access rule between enrolled peer %s and %s: %s", peer.ID, otherPeerID, err)
+				continue
+			}
+			if isNew {
+				jobs = append(jobs, QueueJob{Type: "access_rule", ID: rule.ID})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	for _, job := range jobs {
+		workerQueueChannel <- job
+	}
+	return peer, peerToken, nil
+}
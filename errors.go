@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type ErrorKind int
+
+const (
+	ErrorKindInternal ErrorKind = iota
+	ErrorKindInvalid
+	ErrorKindNotFound
+	ErrorKindConflict
+	ErrorKindUnprocessable
+	ErrorKindUnavailable
+	ErrorKindUnauthorized
+)
+
+var errorKindStatus = map[ErrorKind]int{
+	ErrorKindInternal:      http.StatusInternalServerError,
+	ErrorKindInvalid:       http.StatusBadRequest,
+	ErrorKindNotFound:      http.StatusNotFound,
+	ErrorKindConflict:      http.StatusConflict,
+	ErrorKindUnprocessable: http.StatusUnprocessableEntity,
+	ErrorKindUnavailable:   http.StatusServiceUnavailable,
+	ErrorKindUnauthorized:  http.StatusUnauthorized,
+}
+
+// DomainError is returned by the db and domain functions, the api maps its kind to a status code
+type DomainError struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+	Details []string
+	// Status overrides the status derived from Kind, used for errors raised by echo
+	Status int
+	// Err is the underlying error, if any, so errors.Is keeps working
+	Err error
+}
+
+func (e *DomainError) StatusCode() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	if status, ok := errorKindStatus[e.Kind]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func (e *DomainError) Error() string {
+	return e.Message
+}
+
+func (e *DomainError) Unwrap() error {
+	return e.Err
+}
+
+func invalidError(code string, format string, args ...interface{}) *DomainError {
+	return &DomainError{Kind: ErrorKindInvalid, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFoundError(code string, format string, args ...interface{}) *DomainError {
+	return &DomainError{Kind: ErrorKindNotFound, Code: code, Message: fmt.Sprintf(format, args...), Err: gorm.ErrRecordNotFound}
+}
+
+func conflictError(code string, format string, args ...interface{}) *DomainError {
+	return &DomainError{Kind: ErrorKindConflict, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func unprocessableError(code string, format string, args ...interface{}) *DomainError {
+	return &DomainError{Kind: ErrorKindUnprocessable, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func peerNotFoundError(peerID string) *DomainError {
+	return notFoundError("peer_not_found", "peer %s not found", peerID)
+}
+
+func networkNotFoundError(networkID string) *DomainError {
+	return notFoundError("network_not_found", "network %s not found", networkID)
+}
+
+// wrapNotFound turns gorm.ErrRecordNotFound into the given domain error and leaves other errors alone
+func wrapNotFound(err error, notFound *DomainError) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return notFound
+	}
+	return err
+}
+
+type ErrorResponse struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+// toDomainError classifies any error, unknown errors are internal
+func toDomainError(err error) *DomainError {
+	var domainError *DomainError
+	if errors.As(err, &domainError) {
+		return domainError
+	}
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		message := http.StatusText(httpError.Code)
+		if text, ok := httpError.Message.(string); ok {
+			message = text
+		}
+		code := strings.ToLower(strings.ReplaceAll(http.StatusText(httpError.Code), " ", "_"))
+		return &DomainError{Code: code, Message: message, Status: httpError.Code, Err: err}
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &DomainError{Kind: ErrorKindNotFound, Code: "not_found", Message: "record not found", Err: err}
+	}
+	// sqlite reports lock contention as busy or locked, the client can retry
+	if strings.Contains(err.Error(), "database is locked") || strings.Contains(err.Error(), "database is busy") {
+		return &DomainError{Kind: ErrorKindUnavailable, Code: "database_busy", Message: "database is busy, retry later", Err: err}
+	}
+	return &DomainError{Kind: ErrorKindInternal, Code: "internal_error", Message: err.Error(), Err: err}
+}
+
+func respondError(c echo.Context, err error) error {
+	domainError := toDomainError(err)
+	status := domainError.StatusCode()
+	if status == http.StatusInternalServerError {
+		log.Printf("[ERROR] %s %s: %s", c.Request().Method, c.Request().URL.Path, err)
+	}
+	return c.JSON(status, ErrorResponse{
+		Code:    domainError.Code,
+		Message: domainError.Message,
+		Details: domainError.Details,
+	})
+}
+
+// httpErrorHandler renders errors raised by echo itself (unknown route, bad bind, ...) in the same shape
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	if c.Request().Method == http.MethodHead {
+		c.NoContent(toDomainError(err).StatusCode())
+		return
+	}
+	respondError(c, err)
+}
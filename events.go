@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	EventPeerCreated        = "peer.created"
+	EventPeerDeleting       = "peer.deleting"
+	EventPeerDeleted        = "peer.deleted"
+	EventPeerFailed         = "peer.failed"
+	EventPeerFirstHandshake = "peer.first_handshake"
+	EventPeerConfigChanged  = "peer.config_changed"
+	EventAccessRuleCreated  = "access_rule.created"
+	EventAccessRuleRevoked  = "access_rule.revoked"
+	EventAccessRuleExpired  = "access_rule.expired"
+	EventPortForwardCreated = "port_forward.created"
+	EventPortForwardDeleted = "port_forward.deleted"
+	EventPortForwardFailed  = "port_forward.failed"
+)
+
+var eventTypes = []string{
+	EventPeerCreated,
+	EventPeerDeleting,
+	EventPeerDeleted,
+	EventPeerFailed,
+	EventPeerFirstHandshake,
+	EventPeerConfigChanged,
+	EventAccessRuleCreated,
+	EventAccessRuleRevoked,
+	EventAccessRuleExpired,
+	EventPortForwardCreated,
+	EventPortForwardDeleted,
+	EventPortForwardFailed,
+}
+
+const (
+	eventRetention         = 7 * 24 * time.Hour
+	eventSubscriberBuffer  = 256
+	retentionCheckInterval = time.Hour
+)
+
+var (
+	eventSubscribers     = map[chan Event]struct{}{}
+	eventSubscribersLock sync.Mutex
+	// serializes storing and publishing, so live subscribers see ids in order
+	eventEmitLock sync.Mutex
+)
+
+// emitEvent persists the event so stream clients can resume from it,
+// queues webhook deliveries and fans it out to live subscribers
+func emitEvent(eventType string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode %s event: %s", eventType, err)
+		return
+	}
+	event := Event{
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Data:      payload,
+	}
+	eventEmitLock.Lock()
+	defer eventEmitLock.Unlock()
+	err = CreateEvent(&event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to store %s event: %s", eventType, err)
+		return
+	}
+	err = queueWebhookDeliveries(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to queue webhook deliveries for %s: %s", eventType, err)
+	}
+	publishEvent(event)
+}
+
+func subscribeEvents() chan Event {
+	ch := make(chan Event, eventSubscriberBuffer)
+	eventSubscribersLock.Lock()
+	eventSubscribers[ch] = struct{}{}
+	eventSubscribersLock.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan Event) {
+	eventSubscribersLock.Lock()
+	defer eventSubscribersLock.Unlock()
+	if _, ok := eventSubscribers[ch]; ok {
+		delete(eventSubscribers, ch)
+		close(ch)
+	}
+}
+
+func publishEvent(event Event) {
+	eventSubscribersLock.Lock()
+	defer eventSubscribersLock.Unlock()
+	for ch := range eventSubscribers {
+		select {
+		case ch <- event:
+		default:
+			// slow consumer, drop it so it reconnects and resumes from its cursor
+			delete(eventSubscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// runRetention prunes old events and idempotency records
+func runRetention(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := DeleteEventsBefore(time.Now().UTC().Add(-eventRetention))
+		if err != nil {
+			log.Printf("[ERROR] Failed to prune old events: %s", err)
+		}
+		err = DeleteIdempotencyRecordsBefore(time.Now().UTC().Add(-idempotencyRetention))
+		if err != nil {
+			log.Printf("[ERROR] Failed to prune old idempotency records: %s", err)
+		}
+		err = DeleteEnrollmentTokensExpiredBefore(time.Now().UTC().Add(-enrollmentTokenRetention))
+		if err != nil {
+			log.Printf("[ERROR] Failed to prune expired enrollment tokens: %s", err)
+		}
+	}
+}
+
+func peerEventData(peer *Peer) map[string]string {
+	return map[string]string{
+		"id":         peer.ID,
+		"ip":         peer.IP,
+		"public_key": peer.PublicKey,
+		"status":     string(peer.Status),
+	}
+}
+
+// notifyPeerConfigChanged tells the peers their wireguard config has to be fetched again
+func notifyPeerConfigChanged(reason string, peerIDs ...string) {
+	for _, peerID := range peerIDs {
+		emitEvent(EventPeerConfigChanged, map[string]string{"peer_id": peerID, "reason": reason})
+	}
+}
+
+// emitAccessRuleEvent emits the event and notifies both peers, their direct peers follow the rules
+func emitAccessRuleEvent(eventType string, rule *AccessRule) {
+	emitEvent(eventType, accessRuleEventData(rule))
+	notifyPeerConfigChanged(eventType, rule.PeerAID, rule.PeerBID)
+}
+
+func accessRuleEventData(rule *AccessRule) map[string]string {
+	return map[string]string{
+		"id":        rule.ID,
+		"peer_a_id": rule.PeerAID,
+		"peer_b_id": rule.PeerBID,
+		"status":    string(rule.Status),
+	}
+}
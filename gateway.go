@@ -6,12 +6,39 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// dataPlaneCommand runs ip, wg, iptables and sysctl inside the configured network namespace, if any
+func dataPlaneCommand(name string, args ...string) *exec.Cmd {
+	if config == nil || config.Netns == "" {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("ip", append([]string{"netns", "exec", config.Netns, name}, args...)...)
+}
+
+// ensureNetns creates the configured network namespace when it does not exist yet
+func ensureNetns() {
+	if config.Netns == "" {
+		return
+	}
+	if exec.Command("ip", "netns", "exec", config.Netns, "true").Run() == nil {
+		return
+	}
+	out, err := exec.Command("ip", "netns", "add", config.Netns).CombinedOutput()
+	if err != nil {
+		log.Fatalf("Failed to create network namespace %s: %s", config.Netns, strings.TrimSpace(string(out)))
+	}
+	// loopback is down in a fresh namespace
+	dataPlaneCommand("ip", "link", "set", "up", "lo").Run()
+	log.Printf("[DONE] Created network namespace %s", config.Netns)
+}
+
 func runWireguardCommand(input *string, args ...string) (string, error) {
-	wg := exec.Command("wg", args...)
+	wg := dataPlaneCommand("wg", args...)
 	stdoutBuf := bytes.NewBuffer(nil)
 	stderrBuf := bytes.NewBuffer(nil)
 	if input != nil {
@@ -19,10 +46,14 @@ func runWireguardCommand(input *string, args ...string) (string, error) {
 	}
 	wg.Stdout = stdoutBuf
 	wg.Stderr = stderrBuf
-	wg.Run()
+	err := wg.Run()
+	if wg.ProcessState == nil {
+		// wg could not be started, e.g. it is not installed
+		return "", fmt.Errorf("wireguard command failed: %w", err)
+	}
 	exitCode := wg.ProcessState.ExitCode()
 	if exitCode != 0 {
-		return "", fmt.Errorf("wireguard command failed with exit code %d: %s", exitCode, stderrBuf.String())
+		return "", fmt.Errorf("wireguard command failed with exit code %d: %s", exitCode, strings.TrimSpace(stderrBuf.String()))
 	}
 	return strings.TrimSpace(stdoutBuf.String()), nil
 }
@@ -43,124 +74,493 @@ func generateWireguardPublicKey(privateKey string) (string, error) {
 	return result, nil
 }
 
+// wireguardKeyPair is a key pair generated by the relay for a peer
+type wireguardKeyPair struct {
+	privateKey string
+	publicKey  string
+}
+
+// generateWireguardKeyPair runs wg twice, generate the keys before opening a transaction so the
+// database is not locked while wg runs
+func generateWireguardKeyPair() (*wireguardKeyPair, error) {
+	privateKey, err := generateWireguardPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := generateWireguardPublicKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &wireguardKeyPair{privateKey: privateKey, publicKey: publicKey}, nil
+}
+
+// initialSetup rebuilds the interface and the chain of every network from scratch
 func initialSetup() {
 	log.Println("[STARTING] Initial setup")
+	networks, err := getActiveNetworks()
+	if err != nil {
+		panic(err)
+	}
 	// cleanup
-	// flush iptables
-	exec.Command("iptables", "-F", "WG_RULES").Run()
-	log.Println("[DONE] Flushed iptables")
-
-	// down and delete wg0 interface
-	exec.Command("ip", "link", "set", "down", "wg0").Run()
-	exec.Command("ip", "link", "delete", "wg0").Run()
-	log.Println("[DONE] Deleted wg0 interface")
-
-	// setup ip forwarding
-	exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1").Run()
-	exec.Command("sysctl", "-w", "net.ipv4.conf.all.proxy_arp=1").Run()
+	for i := range networks {
+		teardownNetwork(&networks[i], networks)
+	}
+	ensureNetns()
+	setupIPForwarding()
+	for i := range networks {
+		if err := setupNetwork(&networks[i], networks); err != nil {
+			log.Printf("[ERROR] Failed to set up network %s: %s", networks[i].Name, err)
+		}
+	}
+	log.Println("[DONE] Initial setup")
+}
+
+// adoptOrSetup makes sure the interface and the chain of every network exist without touching
+// what is already there, so the tunnels stay up across restarts. Use the flush command to
+// rebuild from scratch.
+func adoptOrSetup() {
+	networks, err := getActiveNetworks()
+	if err != nil {
+		panic(err)
+	}
+	ensureNetns()
+	setupIPForwarding()
+	for i := range networks {
+		if networks[i].Status != NetworkStatusCreated {
+			// pending networks are set up by the worker
+			continue
+		}
+		if err := setupNetwork(&networks[i], networks); err != nil {
+			log.Printf("[ERROR] Failed to set up network %s: %s", networks[i].Name, err)
+		}
+	}
+}
+
+// getActiveNetworks returns the networks which have, or are about to have, an interface
+func getActiveNetworks() ([]Network, error) {
+	var networks []Network
+	err := GetDB().Order("created_at").Find(&networks, "status IN ?", []NetworkStatus{NetworkStatusCreated, NetworkStatusPending}).Error
+	return networks, err
+}
+
+func setupIPForwarding() {
+	dataPlaneCommand("sysctl", "-w", "net.ipv4.ip_forward=1").Run()
+	dataPlaneCommand("sysctl", "-w", "net.ipv4.conf.all.proxy_arp=1").Run()
 	log.Println("[DONE] Setup ip forwarding")
+}
 
-	// setup
-	exec.Command("ip", "link", "add", "wg0", "type", "wireguard").Run()
-	exec.Command("ip", "addr", "add", config.WireguardSubnet, "dev", "wg0").Run()
-	exec.Command("ip", "link", "set", "up", "wg0").Run()
-	log.Println("[DONE] Setup wg0 interface")
+// ensureIptablesRule adds the rule with action (-I or -A) unless it is already there
+func ensureIptablesRule(action string, chain string, rule ...string) {
+	if dataPlaneCommand("iptables", append([]string{"-C", chain}, rule...)...).Run() != nil {
+		dataPlaneCommand("iptables", append([]string{action, chain}, rule...)...).Run()
+	}
+}
 
-	// set mtu
+// setupNetwork creates the interface and the chain of the network, or adopts the existing ones
+// and fixes what differs. networks are the other networks it is isolated from.
+func setupNetwork(network *Network, networks []Network) error {
+	iface := network.Interface
+	log.Printf("[STARTING] Setting up %s interface of network %s", iface, network.Name)
+
+	if dataPlaneCommand("ip", "link", "show", iface).Run() != nil {
+		out, err := dataPlaneCommand("ip", "link", "add", iface, "type", "wireguard").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ip link add %s: %s", iface, strings.TrimSpace(string(out)))
+		}
+		log.Printf("[DONE] Created %s interface", iface)
+	}
+	out, _ := dataPlaneCommand("ip", "-o", "addr", "show", "dev", iface).Output()
+	if !strings.Contains(string(out), " "+network.Subnet+" ") {
+		dataPlaneCommand("ip", "addr", "add", network.Subnet, "dev", iface).Run()
+		log.Printf("[DONE] Added address %s to %s interface", network.Subnet, iface)
+	}
 	MTU := os.Getenv("WG_MTU")
 	if MTU == "" {
 		MTU = "1420"
 	}
-	exec.Command("ip", "link", "set", "mtu", MTU, "dev", "wg0").Run()
-	log.Println("[DONE] Set mtu of wg0 interface to", MTU)
+	dataPlaneCommand("ip", "link", "set", "mtu", MTU, "dev", iface).Run()
+	dataPlaneCommand("ip", "link", "set", "up", iface).Run()
 
-	// write the private key in a tmp file
-	tmpFile, err := os.CreateTemp("", "wg_private_key")
-	if err != nil {
-		panic(err)
+	// only touch the key and port when they differ, peers keep their sessions otherwise
+	privateKey, _ := runWireguardCommand(nil, "show", iface, "private-key")
+	listenPort, _ := runWireguardCommand(nil, "show", iface, "listen-port")
+	if privateKey != network.PrivateKey || listenPort != strconv.Itoa(network.ListenPort) {
+		tmpFile, err := os.CreateTemp("", "wg_private_key")
+		if err != nil {
+			return err
+		}
+		tmpFile.WriteString(network.PrivateKey)
+		tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+		_, err = runWireguardCommand(nil, "set", iface, "private-key", tmpFile.Name(), "listen-port", strconv.Itoa(network.ListenPort))
+		if err != nil {
+			return err
+		}
+		log.Printf("[DONE] Set private key and listen port of %s interface", iface)
 	}
-	tmpFile.WriteString(config.WireguardPrivateKey)
-	tmpFile.Close()
-	log.Println("[DONE] Wrote private key to tmp file")
-	// add the private key to the wg0 interface
-	exec.Command("wg", "set", "wg0", "private-key", tmpFile.Name(), "listen-port", strconv.Itoa(config.WireguardListenPort)).Run()
-	log.Println("[DONE] Added private key to wg0 interface")
 
-	// setup chain
-	exec.Command("iptables", "-N", "WG_RULES").Run()
-	exec.Command("iptables", "-I", "FORWARD", "-i", "wg0", "-o", "wg0", "-j", "WG_RULES").Run()
-	exec.Command("iptables", "-A", "WG_RULES", "-i", "wg0", "-o", "wg0", "-j", "DROP").Run()
-	log.Println("[DONE] Setup iptables chain")
+	dataPlaneCommand("iptables", "-N", network.Chain).Run()
+	ensureIptablesRule("-I", "FORWARD", "-i", iface, "-o", iface, "-j", network.Chain)
+	ensureIptablesRule("-A", network.Chain, "-i", iface, "-o", iface, "-j", "DROP")
+	setupEgress(network)
+	setupShaping(network)
+	// traffic between networks never reaches a chain, drop it explicitly
+	for _, other := range networks {
+		if other.ID == network.ID {
+			continue
+		}
+		ensureIptablesRule("-I", "FORWARD", "-i", iface, "-o", other.Interface, "-j", "DROP")
+		ensureIptablesRule("-I", "FORWARD", "-i", other.Interface, "-o", iface, "-j", "DROP")
+	}
+	log.Printf("[DONE] Set up %s interface and %s chain", iface, network.Chain)
+	return nil
+}
 
-	log.Println("[DONE] Initial setup")
+// teardownNetwork removes the interface and the chain of the network, peers lose their tunnel
+func teardownNetwork(network *Network, networks []Network) {
+	iface := network.Interface
+	dataPlaneCommand("ip", "link", "set", "down", iface).Run()
+	dataPlaneCommand("ip", "link", "delete", iface).Run()
+	log.Printf("[DONE] Deleted %s interface", iface)
+
+	dataPlaneCommand("iptables", "-D", "FORWARD", "-i", iface, "-o", iface, "-j", network.Chain).Run()
+	teardownEgress(network)
+	for _, other := range networks {
+		if other.ID == network.ID {
+			continue
+		}
+		dataPlaneCommand("iptables", "-D", "FORWARD", "-i", iface, "-o", other.Interface, "-j", "DROP").Run()
+		dataPlaneCommand("iptables", "-D", "FORWARD", "-i", other.Interface, "-o", iface, "-j", "DROP").Run()
+	}
+	dataPlaneCommand("iptables", "-F", network.Chain).Run()
+	dataPlaneCommand("iptables", "-X", network.Chain).Run()
+	log.Printf("[DONE] Flushed %s chain", network.Chain)
 }
 
+// prepareServer reconciles the interface and the chain of every network with the database in
+// place: missing peers and rules are added, stale ones removed, and everything else is left
+// untouched. Pending and deleting records are left to the worker.
 func prepareServer() {
-	// add peers
-	var createdPeers []Peer
-	err := GetDB().Find(&createdPeers, "status = ?", PeerStatusCreated).Error
+	networks, err := getActiveNetworks()
 	if err != nil {
 		panic(err)
 	}
-	for _, peer := range createdPeers {
-		addWireguardPeer(peer.PublicKey, peer.IP)
+	for i := range networks {
+		if networks[i].Status == NetworkStatusCreated {
+			if err := reconcileNetwork(&networks[i]); err != nil {
+				panic(err)
+			}
+		}
 	}
-	log.Println("[DONE] Added wireguard peers")
+}
 
-	// add access rules
-	var createdAccessRules []AccessRule
-	err = GetDB().Find(&createdAccessRules, "status = ?", AccessRuleStatusCreated).Error
+// reconcileNetwork installs the missing peers and rules of the network and removes the stale ones
+func reconcileNetwork(network *Network) error {
+	var peers []Peer
+	err := GetDB().Find(&peers, "network_id = ? AND status IN ?", network.ID, []PeerStatus{PeerStatusCreated, PeerStatusPending, PeerStatusDeleting}).Error
 	if err != nil {
-		panic(err)
+		return err
+	}
+	knownPublicKeys := map[string]bool{}
+	peersByID := map[string]*Peer{}
+	desiredRoutes := map[string]bool{}
+	for i, peer := range peers {
+		knownPublicKeys[peer.PublicKey] = true
+		peersByID[peer.ID] = &peers[i]
+		for _, route := range splitList(peer.Routes) {
+			desiredRoutes[route] = peer.Status == PeerStatusCreated
+		}
+	}
+	allowedIPs, err := getWireguardAllowedIPs(network)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read the peers of %s: %s", network.Interface, err)
+		return nil
+	}
+	added, removed := 0, 0
+	for i, peer := range peers {
+		if peer.Status == PeerStatusCreated && !sameAllowedIPs(allowedIPs[peer.PublicKey], peer.relayAllowedIPs()) {
+			addWireguardPeer(network, &peers[i])
+			added++
+		}
+	}
+	for publicKey := range allowedIPs {
+		if !knownPublicKeys[publicKey] {
+			removeWireguardPeer(network, publicKey)
+			removed++
+		}
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("[DONE] Reconciled wireguard peers of network %s: %d added, %d removed", network.Name, added, removed)
+	}
+	reconcileRoutes(network, desiredRoutes)
+	reconcileRateLimits(network, peers)
+
+	var accessRules []AccessRule
+	err = GetDB().Find(&accessRules, "network_id = ? AND status IN ?", network.ID, []AccessRuleStatus{AccessRuleStatusCreated, AccessRuleStatusPending, AccessRuleStatusDeleting}).Error
+	if err != nil {
+		return err
 	}
-	for _, accessRule := range createdAccessRules {
-		peerAIP, err := GetPeerIP(accessRule.PeerAID)
+	knownRules := map[[2]string]bool{}
+	desiredRules := map[[2]string]bool{}
+	for _, accessRule := range accessRules {
+		peerA, okA := peersByID[accessRule.PeerAID]
+		peerB, okB := peersByID[accessRule.PeerBID]
+		if !okA || !okB {
+			log.Printf("[ERROR] Access rule %s references a missing peer", accessRule.ID)
+			continue
+		}
+		for _, pair := range accessRulePairs(&accessRule, peerA, peerB) {
+			knownRules[pair] = true
+			if accessRule.Status == AccessRuleStatusCreated {
+				desiredRules[pair] = true
+			}
+		}
+	}
+	existingRules, existingEgress, err := getIptablesAcceptRules(network)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read the %s chain: %s", network.Chain, err)
+		return nil
+	}
+	added, removed = 0, 0
+	for rule := range desiredRules {
+		if !existingRules[rule] {
+			addIptablesRule(network, rule[0], rule[1])
+			added++
+		}
+	}
+	for rule := range existingRules {
+		if !knownRules[rule] {
+			removeIptablesRule(network, rule[0], rule[1])
+			removed++
+		}
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("[DONE] Reconciled access rules of network %s: %d added, %d removed", network.Name, added, removed)
+	}
+	reconcileEgress(network, peers, existingEgress)
+	return reconcilePortForwards(network, peersByID)
+}
+
+// addWireguardPeer adds or updates the peer with its address and routed subnets
+func addWireguardPeer(network *Network, peer *Peer) error {
+	_, err := runWireguardCommand(nil, "set", network.Interface, "peer", peer.PublicKey, "allowed-ips", strings.Join(peer.relayAllowedIPs(), ","))
+	if err != nil {
+		log.Printf("[ERROR] Failed to add wireguard peer (%s): %s", peer.PublicKey, err)
+		return err
+	}
+	for _, route := range splitList(peer.Routes) {
+		if err := dataPlaneCommand("ip", "route", "replace", route, "dev", network.Interface).Run(); err != nil {
+			log.Printf("[ERROR] Failed to add route %s to %s: %s", route, network.Interface, err)
+		}
+	}
+	return nil
+}
+
+// sameAllowedIPs compares the comma separated allowed ips read from wireguard with the expected ones
+func sameAllowedIPs(current string, expected []string) bool {
+	currentIPs := splitList(current)
+	slices.Sort(currentIPs)
+	expected = slices.Clone(expected)
+	slices.Sort(expected)
+	return slices.Equal(currentIPs, expected)
+}
+
+// reconcileRoutes removes the routes of the interface no peer is a gateway for anymore and adds
+// the missing ones, desired maps each route to whether its gateway is created
+func reconcileRoutes(network *Network, desired map[string]bool) {
+	out, err := dataPlaneCommand("ip", "route", "show", "dev", network.Interface).Output()
+	if err != nil {
+		log.Printf("[ERROR] Failed to read the routes of %s: %s", network.Interface, err)
+		return
+	}
+	existing := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		// the route of the network itself belongs to the interface address
+		if len(fields) == 0 || slices.Contains(fields, "kernel") {
+			continue
+		}
+		existing[fields[0]] = true
+		if _, ok := desired[fields[0]]; !ok {
+			dataPlaneCommand("ip", "route", "delete", fields[0], "dev", network.Interface).Run()
+		}
+	}
+	for route, install := range desired {
+		if install && !existing[route] {
+			dataPlaneCommand("ip", "route", "replace", route, "dev", network.Interface).Run()
+		}
+	}
+}
+
+func removeWireguardPeer(network *Network, peerPublicKey string) {
+	_, err := runWireguardCommand(nil, "set", network.Interface, "peer", peerPublicKey, "remove")
+	if err != nil {
+		log.Printf("[ERROR] Failed to remove wireguard peer (%s): %s", peerPublicKey, err)
+	}
+}
+
+// getWireguardLatestHandshakes returns public key -> latest handshake time, peers without a handshake are skipped
+func getWireguardLatestHandshakes(network *Network) (map[string]time.Time, error) {
+	result, err := runWireguardCommand(nil, "show", network.Interface, "latest-handshakes")
+	if err != nil {
+		return nil, err
+	}
+	handshakes := map[string]time.Time{}
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || timestamp == 0 {
+			continue
+		}
+		handshakes[fields[0]] = time.Unix(timestamp, 0)
+	}
+	return handshakes, nil
+}
+
+// getWireguardEndpoints returns the public address of every peer which reached the relay
+func getWireguardEndpoints(network *Network) (map[string]string, error) {
+	result, err := runWireguardCommand(nil, "show", network.Interface, "endpoints")
+	if err != nil {
+		return nil, err
+	}
+	endpoints := map[string]string{}
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] == "(none)" {
+			continue
+		}
+		endpoints[fields[0]] = fields[1]
+	}
+	return endpoints, nil
+}
+
+// getWireguardTransfer returns the bytes received from and sent to every peer, keyed by public key
+func getWireguardTransfer(network *Network) (map[string][2]uint64, error) {
+	result, err := runWireguardCommand(nil, "show", network.Interface, "transfer")
+	if err != nil {
+		return nil, err
+	}
+	transfer := map[string][2]uint64{}
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		received, err := strconv.ParseUint(fields[1], 10, 64)
 		if err != nil {
-			log.Printf("[ERROR] Error getting peer %s IP: %s", accessRule.PeerAID, err)
 			continue
 		}
-		peerBIP, err := GetPeerIP(accessRule.PeerBID)
+		sent, err := strconv.ParseUint(fields[2], 10, 64)
 		if err != nil {
-			log.Printf("[ERROR] Error getting peer %s IP: %s", accessRule.PeerBID, err)
 			continue
 		}
-		addIptablesRuleBetweenPeers(peerAIP, peerBIP)
+		transfer[fields[0]] = [2]uint64{received, sent}
+	}
+	return transfer, nil
+}
+
+// accessRulePeers loads both peers of an access rule
+func accessRulePeers(rule *AccessRule) (*Peer, *Peer, error) {
+	peers, err := GetPeersByIDs([]string{rule.PeerAID, rule.PeerBID})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, peerID := range []string{rule.PeerAID, rule.PeerBID} {
+		if _, ok := peers[peerID]; !ok {
+			return nil, nil, peerNotFoundError(peerID)
+		}
 	}
-	log.Println("[DONE] Added access rules")
+	return peers[rule.PeerAID], peers[rule.PeerBID], nil
 }
 
-func addWireguardPeer(peerPublicKey string, peerWireguardIP string) {
-	_, err := runWireguardCommand(nil, "set", "wg0", "peer", peerPublicKey, "allowed-ips", peerWireguardIP+"/32")
+// addAccessRuleIptables accepts the traffic of the rule in both directions, see accessRulePairs
+func addAccessRuleIptables(network *Network, rule *AccessRule) error {
+	peerA, peerB, err := accessRulePeers(rule)
 	if err != nil {
-		log.Printf("[ERROR] Failed to add wireguard peer (%s): %s", peerPublicKey, err)
+		return err
 	}
+	for _, pair := range accessRulePairs(rule, peerA, peerB) {
+		addIptablesRule(network, pair[0], pair[1])
+	}
+	return nil
 }
 
-func removeWireguardPeer(peerPublicKey string) {
-	_, err := runWireguardCommand(nil, "set", "wg0", "peer", peerPublicKey, "remove")
+func removeAccessRuleIptables(network *Network, rule *AccessRule) error {
+	peerA, peerB, err := accessRulePeers(rule)
 	if err != nil {
-		log.Printf("[ERROR] Failed to remove wireguard peer (%s): %s", peerPublicKey, err)
+		return err
+	}
+	for _, pair := range accessRulePairs(rule, peerA, peerB) {
+		removeIptablesRule(network, pair[0], pair[1])
 	}
+	return nil
 }
 
-func addIptablesRuleBetweenPeers(peerAIP string, peerBIP string) {
-	err := exec.Command("iptables", "-I", "WG_RULES", "1", "-s", peerAIP, "-d", peerBIP, "-i", "wg0", "-o", "wg0", "-j", "ACCEPT").Run()
+func addIptablesRule(network *Network, sourceIP string, destinationIP string) {
+	err := dataPlaneCommand("iptables", "-I", network.Chain, "1", "-s", sourceIP, "-d", destinationIP, "-i", network.Interface, "-o", network.Interface, "-j", "ACCEPT").Run()
 	if err != nil {
-		log.Printf("[ERROR] Failed to add iptables rule between peers (%s -> %s): %s", peerAIP, peerBIP, err)
+		log.Printf("[ERROR] Failed to add iptables rule between peers (%s -> %s): %s", sourceIP, destinationIP, err)
 	}
-	err = exec.Command("iptables", "-I", "WG_RULES", "1", "-s", peerBIP, "-d", peerAIP, "-i", "wg0", "-o", "wg0", "-j", "ACCEPT").Run()
+}
+
+func removeIptablesRule(network *Network, sourceIP string, destinationIP string) {
+	err := dataPlaneCommand("iptables", "-D", network.Chain, "-s", sourceIP, "-d", destinationIP, "-i", network.Interface, "-o", network.Interface, "-j", "ACCEPT").Run()
 	if err != nil {
-		log.Printf("[ERROR] Failed to add iptables rule between peers (%s -> %s): %s", peerBIP, peerAIP, err)
+		log.Printf("[ERROR] Failed to remove iptables rule between peers (%s -> %s): %s", sourceIP, destinationIP, err)
 	}
 }
 
-func removeIptablesRuleBetweenPeers(peerAIP string, peerBIP string) {
-	err := exec.Command("iptables", "-D", "WG_RULES", "-s", peerAIP, "-d", peerBIP, "-i", "wg0", "-o", "wg0", "-j", "ACCEPT").Run()
+// getWireguardAllowedIPs returns public key -> allowed ips of the peers configured on the interface
+func getWireguardAllowedIPs(network *Network) (map[string]string, error) {
+	result, err := runWireguardCommand(nil, "show", network.Interface, "allowed-ips")
 	if err != nil {
-		log.Printf("[ERROR] Failed to remove iptables rule between peers (%s -> %s): %s", peerAIP, peerBIP, err)
+		return nil, err
 	}
-	err = exec.Command("iptables", "-D", "WG_RULES", "-s", peerBIP, "-d", peerAIP, "-i", "wg0", "-o", "wg0", "-j", "ACCEPT").Run()
+	allowedIPs := map[string]string{}
+	for _, line := range strings.Split(result, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		allowedIPs[fields[0]] = strings.Join(fields[1:], ",")
+	}
+	return allowedIPs, nil
+}
+
+// getIptablesAcceptRules returns the [source, destination] ip pairs accepted by the chain of the network,
+// and the sources accepted to leave the network, see addEgressRule
+func getIptablesAcceptRules(network *Network) (map[[2]string]bool, map[string]bool, error) {
+	out, err := dataPlaneCommand("iptables", "-S", network.Chain).Output()
 	if err != nil {
-		log.Printf("[ERROR] Failed to remove iptables rule between peers (%s -> %s): %s", peerBIP, peerAIP, err)
+		return nil, nil, err
+	}
+	rules := map[[2]string]bool{}
+	egress := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		var source, destination string
+		accept, leaving := false, false
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "!":
+				leaving = leaving || fields[i+1] == "-o"
+			case "-s":
+				source = strings.TrimSuffix(fields[i+1], "/32")
+			case "-d":
+				destination = strings.TrimSuffix(fields[i+1], "/32")
+			case "-j":
+				accept = fields[i+1] == "ACCEPT"
+			}
+		}
+		if accept && source != "" && destination != "" {
+			rules[[2]string{source, destination}] = true
+		}
+		if accept && source != "" && destination == "" && leaving {
+			egress[source] = true
+		}
 	}
+	return rules, egress, nil
 }
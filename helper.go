@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"os/exec"
 	"slices"
 	"strconv"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"golang.org/x/exp/rand"
+	"gorm.io/gorm"
 )
 
 func checkForToolInEnvironment(tool string) {
@@ -20,8 +23,21 @@ func checkForToolInEnvironment(tool string) {
 	}
 }
 
-func generateRandomIP() string {
-	_, ipNet, _ := net.ParseCIDR(config.WireguardSubnet) // Assume valid subnet input
+func envOrDefault(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// isValidWireguardKey checks the key is base64 of 32 bytes, like the output of wg genkey and wg pubkey
+func isValidWireguardKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+func generateRandomIP(subnet string) string {
+	_, ipNet, _ := net.ParseCIDR(subnet) // Assume valid subnet input
 
 	// Get the base IP as a byte slice
 	ip := ipNet.IP.To4()
@@ -45,21 +61,20 @@ func generateRandomIP() string {
 	return ip.String()
 }
 
-func getUsedIPAddresses() []string {
-	db := GetDB()
+func getUsedIPAddresses(tx *gorm.DB, networkID string) []string {
 	var ips []string
-	err := db.Model(&Peer{}).Select("ip").Find(&ips).Error
+	err := tx.Model(&Peer{}).Where("network_id = ?", networkID).Select("ip").Find(&ips).Error
 	if err != nil {
 		log.Println("Failed to get used IP addresses:", err)
 	}
 	return ips
 }
 
-func getUniqueIPInSubnet() string {
-	ips := getUsedIPAddresses()
-	ips = append(ips, config.GetRelayWireguardAddress())
+func getUniqueIPInSubnet(tx *gorm.DB, network *Network) string {
+	ips := getUsedIPAddresses(tx, network.ID)
+	ips = append(ips, network.RelayAddress())
 	for {
-		ip := generateRandomIP()
+		ip := generateRandomIP(network.Subnet)
 		if !slices.Contains(ips, ip) {
 			return ip
 		}
@@ -115,9 +130,28 @@ setup_wireguard() {
     # Bring interface up
     ip link set "$interface_name" up
     
-    # Add route
-    ip route add "$ALLOWED_IPS" dev "$interface_name"
+    # Add routes, with egress the default route is split in two halves which win over the current
+    # one without replacing it, and the relay stays reachable through the current one
+    for route in ${ALLOWED_IPS//,/ }; do
+        if [ "$route" = "0.0.0.0/0" ]; then
+            ip route add "${ENDPOINT%:*}/32" $(ip route show default | head -n 1 | cut -d ' ' -f 2-)
+            ip route add 0.0.0.0/1 dev "$interface_name"
+            ip route add 128.0.0.0/1 dev "$interface_name"
+        else
+            ip route add "$route" dev "$interface_name"
+        fi
+    done
     
+    # Resolve peer names through the relay, for the domain of the network only
+    if [ -n "$DNS" ]; then
+        if command -v resolvectl >/dev/null 2>&1; then
+            resolvectl dns "$interface_name" "$DNS"
+            resolvectl domain "$interface_name" "$DNS_DOMAIN"
+        else
+            echo "resolvectl not found, add nameserver $DNS for $DNS_DOMAIN to your resolver"
+        fi
+    fi
+
     echo "WireGuard interface $interface_name has been set up"
 }
 
@@ -127,8 +161,13 @@ remove_wireguard() {
     
     # Check if interface exists
     if ip link show "$interface_name" >/dev/null 2>&1; then
-        # Remove route
-        ip route del "$ALLOWED_IPS" dev "$interface_name" 2>/dev/null || true
+        # Remove routes
+        for route in ${ALLOWED_IPS//,/ }; do
+            if [ "$route" = "0.0.0.0/0" ]; then
+                ip route del "${ENDPOINT%:*}/32" 2>/dev/null || true
+            fi
+            ip route del "$route" dev "$interface_name" 2>/dev/null || true
+        done
         
         # Bring interface down
         ip link set "$interface_name" down 2>/dev/null || true
@@ -157,6 +196,8 @@ main() {
     local PEER_PUBLIC_KEY="{{.PublicKey}}"
     local ENDPOINT="{{.WireguardRelayServerPublicIP}}:{{.WireguardListenPort}}"
     local INTERFACE_IP="{{.IP}}/32"
+    local DNS="{{.DNS}}"
+    local DNS_DOMAIN="{{.DNSDomain}}"
 
     # Get command
     local COMMAND="$1"
@@ -191,24 +232,84 @@ main() {
 main "$@"
 `
 
-func (peer *Peer) GenerateWireguardScript() string {
+// AllowedIPs is what the peer routes through the relay: the whole subnet, or with narrow_allowed_ips
+// the relay address and the peers the peer has created access rules with. Either way the routed
+// subnets its access rules open are added. A peer with egress routes everything.
+func (peer *Peer) AllowedIPs(network *Network) (string, error) {
+	if peer.Egress {
+		return egressAllowedIPs, nil
+	}
+	routes, err := routesOpenedTo(peer)
+	if err != nil {
+		return "", err
+	}
+	if !config.NarrowAllowedIPs {
+		return strings.Join(append([]string{network.ClientSubnet()}, routes...), ","), nil
+	}
+	rules, err := GetAccessRulesByPeerID(peer.ID)
+	if err != nil {
+		return "", err
+	}
+	otherPeerIDs := []string{}
+	for _, rule := range rules {
+		if rule.Status == AccessRuleStatusCreated {
+			otherPeerIDs = append(otherPeerIDs, rule.OtherPeerID(peer.ID))
+		}
+	}
+	peers, err := GetPeersByIDs(otherPeerIDs)
+	if err != nil {
+		return "", err
+	}
+	ips := []string{}
+	for _, other := range peers {
+		ips = append(ips, other.IP+"/32")
+	}
+	slices.Sort(ips)
+	ips = append(append([]string{network.RelayAddress() + "/32"}, ips...), routes...)
+	return strings.Join(ips, ","), nil
+}
+
+func (peer *Peer) GenerateWireguardScript(network *Network) (string, error) {
+	allowedIPs, err := peer.AllowedIPs(network)
+	if err != nil {
+		return "", err
+	}
 	wireguardScript := strings.Replace(wireguardScriptTemplate, "{{.PrivateKey}}", peer.PrivateKey, 1)
-	wireguardScript = strings.Replace(wireguardScript, "{{.AllowedIPs}}", config.GetWireguardClientSubnet(), 1)
-	wireguardScript = strings.Replace(wireguardScript, "{{.PublicKey}}", config.WireguardPublicKey, 1)
+	wireguardScript = strings.Replace(wireguardScript, "{{.AllowedIPs}}", allowedIPs, 1)
+	wireguardScript = strings.Replace(wireguardScript, "{{.PublicKey}}", network.PublicKey, 1)
 	wireguardScript = strings.Replace(wireguardScript, "{{.WireguardRelayServerPublicIP}}", config.WireguardRelayServerPublicIP, 1)
-	wireguardScript = strings.Replace(wireguardScript, "{{.WireguardListenPort}}", strconv.Itoa(int(config.WireguardListenPort)), 1)
+	wireguardScript = strings.Replace(wireguardScript, "{{.WireguardListenPort}}", strconv.Itoa(network.ListenPort), 1)
 	wireguardScript = strings.Replace(wireguardScript, "{{.IP}}", peer.IP, 1)
-	return wireguardScript
+	dns, domain := peerDNS(network)
+	wireguardScript = strings.Replace(wireguardScript, "{{.DNS}}", dns, 1)
+	wireguardScript = strings.Replace(wireguardScript, "{{.DNSDomain}}", domain, 1)
+	return wireguardScript, nil
 }
 
-func (peer *Peer) GetWireguardConfig() map[string]string {
-	return map[string]string{
+func (peer *Peer) GetWireguardConfig(network *Network) (map[string]interface{}, error) {
+	allowedIPs, err := peer.AllowedIPs(network)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := directPeers(peer)
+	if err != nil {
+		return nil, err
+	}
+	dns, domain := peerDNS(network)
+	return map[string]interface{}{
 		"private_key":      peer.PrivateKey,
 		"public_key":       peer.PublicKey,
 		"ip":               peer.IP,
 		"ip_with_mask":     fmt.Sprintf("%s/32", peer.IP),
-		"allowed_ips":      config.GetWireguardClientSubnet(),
-		"relay_public_key": config.WireguardPublicKey,
-		"endpoint":         fmt.Sprintf("%s:%d", config.WireguardRelayServerPublicIP, config.WireguardListenPort),
-	}
+		"allowed_ips":      allowedIPs,
+		"relay_public_key": network.PublicKey,
+		"endpoint":         fmt.Sprintf("%s:%d", config.WireguardRelayServerPublicIP, network.ListenPort),
+		// every live relay of the cluster, the agent fails over to the next one
+		"endpoints": strings.Join(relayEndpoints(network), ","),
+		// peers reached without the relay, the relay stays the route to everything else
+		"direct_peers": direct,
+		// the relay resolves the names of reachable peers, empty without the dns option
+		"dns":        dns,
+		"dns_domain": domain,
+	}, nil
 }
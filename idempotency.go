@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotencyReplayHeader = "Idempotent-Replayed"
+	idempotencyRetention    = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+	// idempotencyReservationTimeout is how long a request may hold its key, a reservation older
+	// than this was abandoned (e.g. the server stopped) and the request runs again
+	idempotencyReservationTimeout = time.Minute
+)
+
+// idempotencyResponseRecorder copies everything written to the client
+type idempotencyResponseRecorder struct {
+	http.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (r *idempotencyResponseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// idempotencyMiddleware makes a create endpoint safe to retry. The first response for an
+// Idempotency-Key is stored and returned again for retries of the same request.
+func idempotencyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return respondError(c, invalidError("invalid_idempotency_key", "%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return respondError(c, err)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		record := &IdempotencyRecord{
+			Key:         key,
+			Method:      c.Request().Method,
+			Path:        c.Request().URL.Path,
+			RequestHash: hex.EncodeToString(hash[:]),
+			ReservedAt:  time.Now().UTC(),
+		}
+
+		existing, err := GetIdempotencyRecord(key)
+		if err == nil && existing.StatusCode == 0 && existing.sameRequest(record) {
+			released, releaseErr := DeleteAbandonedIdempotencyRecord(key, record.ReservedAt.Add(-idempotencyReservationTimeout))
+			if releaseErr != nil {
+				return respondError(c, releaseErr)
+			}
+			if released {
+				log.Printf("[ERROR] Idempotency key %s was abandoned by its request, running it again", key)
+				err = gorm.ErrRecordNotFound
+			}
+		}
+		if err == nil {
+			return replayIdempotentResponse(c, existing, record)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, err)
+		}
+		// reserve the key, a concurrent request with the same key loses the insert
+		if err := CreateIdempotencyRecord(record); err != nil {
+			existing, getErr := GetIdempotencyRecord(key)
+			if getErr != nil {
+				return respondError(c, err)
+			}
+			return replayIdempotentResponse(c, existing, record)
+		}
+
+		recorder := &idempotencyResponseRecorder{ResponseWriter: c.Response().Writer, body: &bytes.Buffer{}}
+		c.Response().Writer = recorder
+		err = next(c)
+		if err != nil {
+			// let echo render the error, the key can be retried
+			if deleteErr := DeleteIdempotencyRecord(key); deleteErr != nil {
+				log.Printf("[ERROR] Failed to release idempotency key %s: %s", key, deleteErr)
+			}
+			return err
+		}
+		status := c.Response().Status
+		if status >= 500 {
+			// nothing was created, allow the retry to run again
+			err = DeleteIdempotencyRecord(key)
+		} else {
+			err = CompleteIdempotencyRecord(key, status, c.Response().Header().Get(echo.HeaderContentType), recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to store idempotency key %s: %s", key, err)
+		}
+		return nil
+	}
+}
+
+func (record *IdempotencyRecord) sameRequest(other *IdempotencyRecord) bool {
+	return record.Method == other.Method && record.Path == other.Path && record.RequestHash == other.RequestHash
+}
+
+func replayIdempotentResponse(c echo.Context, existing *IdempotencyRecord, request *IdempotencyRecord) error {
+	if !existing.sameRequest(request) {
+		return respondError(c, unprocessableError("idempotency_key_reused", "%s was already used for a different request", idempotencyKeyHeader))
+	}
+	if existing.StatusCode == 0 {
+		return respondError(c, conflictError("idempotency_key_in_progress", "a request with this %s is still in progress", idempotencyKeyHeader))
+	}
+	c.Response().Header().Set(idempotencyReplayHeader, "true")
+	return c.Blob(existing.StatusCode, existing.ContentType, existing.Body)
+}
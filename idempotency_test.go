@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIdempotencyMiddlewareReleasesAbandonedKeys(t *testing.T) {
+	calls := 0
+	e := echo.New()
+	e.POST("/things", func(c echo.Context) error {
+		calls++
+		return c.JSON(http.StatusCreated, map[string]int{"call": calls})
+	}, idempotencyMiddleware)
+	send := func(key string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+		request.Header.Set(idempotencyKeyHeader, key)
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// a request which is still running holds its key
+	running := send("running-key", `{}`)
+	if running.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", running.Code)
+	}
+	GetDB().Model(&IdempotencyRecord{}).Where("key = ?", "running-key").Updates(map[string]interface{}{"status_code": 0, "reserved_at": time.Now().UTC()})
+	if response := send("running-key", `{}`); response.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a running request, got %d %s", response.Code, response.Body)
+	}
+
+	// the server stopped before the response was stored
+	GetDB().Model(&IdempotencyRecord{}).Where("key = ?", "running-key").Update("reserved_at", time.Now().UTC().Add(-2*idempotencyReservationTimeout))
+	if response := send("running-key", `{"other":true}`); response.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a different request, got %d %s", response.Code, response.Body)
+	}
+	retried := send("running-key", `{}`)
+	if retried.Code != http.StatusCreated || retried.Header().Get(idempotencyReplayHeader) != "" || calls != 2 {
+		t.Fatalf("expected the abandoned request to run again, got %d after %d calls", retried.Code, calls)
+	}
+	replayed := send("running-key", `{}`)
+	if replayed.Code != http.StatusCreated || replayed.Header().Get(idempotencyReplayHeader) != "true" || calls != 2 {
+		t.Fatalf("expected the stored response, got %d after %d calls", replayed.Code, calls)
+	}
+	if replayed.Body.String() != retried.Body.String() {
+		t.Fatalf("expected %s, got %s", retried.Body, replayed.Body)
+	}
+}
@@ -1,17 +1,48 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var globalWaitGroup = sync.WaitGroup{}
 
 func main() {
+	// client side commands, they only talk to the api
+	if len(os.Args) >= 2 {
+		switch os.Args[1] {
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "peer":
+			runPeerCommand(os.Args[2:])
+			return
+		case "rule":
+			runRuleCommand(os.Args[2:])
+			return
+		case "token":
+			runTokenCommand(os.Args[2:])
+			return
+		case "network":
+			runNetworkCommand(os.Args[2:])
+			return
+		case "forward":
+			runForwardCommand(os.Args[2:])
+			return
+		case "agent":
+			// runs on the peer, not on the relay
+			runAgent(os.Args[2:])
+			return
+		}
+	}
+
 	// check for root
 	if os.Geteuid() != 0 {
 		log.Fatal("Please run as root")
@@ -21,30 +52,95 @@ func main() {
 	checkForToolInEnvironment("wg")
 	checkForToolInEnvironment("iptables")
 	checkForToolInEnvironment("ip")
+	checkForToolInEnvironment("tc")
 	checkForToolInEnvironment("sqlite3")
 
 	loadConfig()
 
 	if len(os.Args) < 2 {
-		fmt.Println("Please provide a command : <backup|flush|server>")
+		fmt.Println("Please provide a command : <backup|flush|server|apply|network|peer|rule|token|forward|agent>")
 		os.Exit(1)
 	}
 	cmd := os.Args[1]
 	if cmd == "backup" {
 		backup()
 	} else if cmd == "flush" {
-		// initial setup will do the job
+		// rebuild the interfaces and chains from scratch, the server re-adds everything on its next start
+		if config.ClusterRole != clusterRoleFollower {
+			ensureDefaultNetwork()
+		}
 		initialSetup()
 	} else if cmd == "server" {
-		initialSetup()
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		if config.ClusterRole != clusterRoleFollower {
+			ensureDefaultNetwork()
+		}
+		// keep the existing interfaces so tunnels survive restarts
+		adoptOrSetup()
 		prepareServer()
-		queuePendingTasks()
 		globalWaitGroup.Add(1)
-		go startServer()
-		globalWaitGroup.Add(1)
-		go runWorkers()
+		go startServer(ctx)
+		if config.DNS {
+			globalWaitGroup.Add(1)
+			go runDNSServer(ctx)
+		}
+		if config.ClusterRole == clusterRoleFollower {
+			// the leader owns the state, a follower only installs it
+			globalWaitGroup.Add(1)
+			go runClusterFollower(ctx)
+		} else {
+			if config.ClusterRole == clusterRoleLeader {
+				globalWaitGroup.Add(1)
+				go runRelayHeartbeat(ctx)
+			}
+			queuePendingTasks()
+			globalWaitGroup.Add(1)
+			go runWorkers(ctx)
+			globalWaitGroup.Add(1)
+			go runWebhookDispatcher(ctx)
+			globalWaitGroup.Add(1)
+			go runTelemetryCollector(ctx)
+			globalWaitGroup.Add(1)
+			go runAccessRuleExpiry(ctx)
+			globalWaitGroup.Add(1)
+			go runRetention(ctx)
+		}
+
+		<-ctx.Done()
+		// a second signal kills the process right away
+		stop()
+		shutdown()
+	}
+}
+
+// getShutdownTimeout reads SHUTDOWN_TIMEOUT (e.g. 30s), the time given to in flight work on shutdown
+func getShutdownTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 30 * time.Second
+	}
+	return timeout
+}
+
+// shutdown waits for the goroutines to finish their current work, then closes the database
+func shutdown() {
+	log.Println("[STARTING] Graceful shutdown")
+	done := make(chan struct{})
+	go func() {
 		globalWaitGroup.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(getShutdownTimeout() + 5*time.Second):
+		log.Println("[ERROR] Timed out waiting for background work, closing anyway")
+	}
+	if err := CheckpointAndCloseDB(); err != nil {
+		log.Printf("[ERROR] Failed to close the database: %s", err)
 	}
+	log.Println("[DONE] Graceful shutdown")
 }
 
 func backup() {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests in a temporary directory, the database is created there
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "pikotunnel-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	config = &Config{
+		WireguardSubnet:     "10.0.0.1/16",
+		WireguardListenPort: 51820,
+		WireguardInterface:  "wg0",
+		IptablesChain:       "PIKOTUNNEL",
+	}
+	ensureDefaultNetwork()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
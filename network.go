@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// the default network is described by config.json, its interface and chain default to the
+// historical wg0 / WG_RULES names
+const (
+	defaultNetworkName      = "default"
+	defaultNetworkInterface = "wg0"
+	defaultNetworkChain     = "WG_RULES"
+)
+
+// interface names are limited to 15 characters by the kernel, chain names to 28 by iptables
+var (
+	networkInterfaceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,14}$`)
+	iptablesChainRegex    = regexp.MustCompile(`^[A-Za-z0-9_-]{1,28}$`)
+)
+
+// RelayAddress is the address of the relay inside the network
+func (network *Network) RelayAddress() string {
+	return strings.Split(network.Subnet, "/")[0]
+}
+
+// ClientSubnet is the subnet routed to the relay by the peers, e.g. 10.0.0.0/16
+func (network *Network) ClientSubnet() string {
+	_, ipnet, err := net.ParseCIDR(network.Subnet)
+	if err != nil {
+		return ""
+	}
+	return ipnet.String()
+}
+
+// ensureDefaultNetwork creates or updates the default network from config.json and moves
+// peers and access rules created before networks existed into it
+func ensureDefaultNetwork() {
+	network, err := GetDefaultNetwork()
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		panic(err)
+	}
+	if err != nil {
+		network = &Network{
+			ID:     uuid.New().String(),
+			Name:   defaultNetworkName,
+			Status: NetworkStatusCreated,
+		}
+	} else if network.Interface != config.WireguardInterface || network.Chain != config.IptablesChain {
+		// renamed in config.json, the old interface and chain would be left behind
+		log.Printf("[INFO] Default network moves from %s/%s to %s/%s", network.Interface, network.Chain, config.WireguardInterface, config.IptablesChain)
+		teardownNetwork(network, nil)
+	}
+	var count int64
+	err = GetDB().Model(&Network{}).Where("name <> ? AND (interface = ? OR chain = ?)", defaultNetworkName, config.WireguardInterface, config.IptablesChain).Count(&count).Error
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		log.Fatalf("wireguard_interface %s or iptables_chain %s is already used by another network", config.WireguardInterface, config.IptablesChain)
+	}
+	network.Interface = config.WireguardInterface
+	network.Chain = config.IptablesChain
+	network.Subnet = config.WireguardSubnet
+	network.ListenPort = config.WireguardListenPort
+	network.PrivateKey = config.WireguardPrivateKey
+	network.PublicKey = config.WireguardPublicKey
+	if err := GetDB().Save(network).Error; err != nil {
+		panic(err)
+	}
+
+	result := GetDB().Model(&Peer{}).Where("network_id = '' OR network_id IS NULL").Update("network_id", network.ID)
+	if result.Error != nil {
+		panic(result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("[DONE] Moved %d peer(s) to the default network", result.RowsAffected)
+	}
+	err = GetDB().Model(&AccessRule{}).Where("network_id = '' OR network_id IS NULL").Update("network_id", network.ID).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+// resolveNetworkTx returns the network peers are created in, the default one when networkID is empty
+func resolveNetworkTx(tx *gorm.DB, networkID string) (*Network, error) {
+	var network Network
+	var err error
+	networkID = strings.TrimSpace(networkID)
+	if networkID == "" {
+		err = tx.First(&network, "name = ?", defaultNetworkName).Error
+	} else {
+		err = tx.First(&network, "id = ?", networkID).Error
+	}
+	if err != nil {
+		return nil, wrapNotFound(err, networkNotFoundError(networkID))
+	}
+	if network.Status == NetworkStatusDeleting || network.Status == NetworkStatusFailed {
+		return nil, unprocessableError("network_unavailable", "network %s is %s", network.Name, network.Status)
+	}
+	return &network, nil
+}
+
+// CreateNetwork validates and stores a pending network, the worker sets up its interface and chain
+func CreateNetwork(name string, subnet string, listenPort int, iface string) (*Network, error) {
+	name = strings.TrimSpace(name)
+	if !peerNameRegex.MatchString(name) {
+		return nil, invalidError("invalid_network_name", "name must be a lowercase dns label")
+	}
+	ip, ipnet, err := net.ParseCIDR(strings.TrimSpace(subnet))
+	if err != nil || ip.To4() == nil {
+		return nil, invalidError("invalid_subnet", "subnet must be an ipv4 address with a prefix, e.g. 10.1.0.1/16")
+	}
+	if ones, _ := ipnet.Mask.Size(); ones < 8 || ones > 30 {
+		return nil, invalidError("invalid_subnet", "subnet prefix must be between /8 and /30")
+	}
+	if ip.Equal(ipnet.IP) {
+		return nil, invalidError("invalid_subnet", "subnet must hold the relay address, not the network address")
+	}
+	if listenPort < 1 || listenPort > 65535 {
+		return nil, invalidError("invalid_listen_port", "listen_port must be between 1 and 65535")
+	}
+	iface = strings.TrimSpace(iface)
+	if iface == "" {
+		iface = config.InterfacePrefix + name
+		if len(iface) > 15 {
+			iface = iface[:15]
+		}
+		iface = strings.TrimRight(iface, "-_")
+	}
+	if !networkInterfaceRegex.MatchString(iface) {
+		return nil, invalidError("invalid_interface", "interface must be lowercase and at most 15 characters")
+	}
+
+	chain := config.IptablesChainPrefix + strings.ToUpper(strings.TrimPrefix(iface, config.InterfacePrefix))
+	if len(chain) > 28 {
+		chain = chain[:28]
+	}
+
+	networks, err := GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range networks {
+		switch {
+		case other.Name == name:
+			return nil, conflictError("network_name_taken", "network with name %s already exists", name)
+		case other.ListenPort == listenPort:
+			return nil, conflictError("listen_port_taken", "listen port %d is used by network %s", listenPort, other.Name)
+		case other.Interface == iface:
+			return nil, conflictError("interface_taken", "interface %s is used by network %s", iface, other.Name)
+		case other.Chain == chain:
+			return nil, conflictError("interface_taken", "interface %s maps to the chain %s of network %s", iface, chain, other.Name)
+		}
+		otherIP, otherNet, err := net.ParseCIDR(other.Subnet)
+		if err == nil && (otherNet.Contains(ip) || ipnet.Contains(otherIP)) {
+			return nil, conflictError("subnet_overlap", "subnet %s overlaps network %s (%s)", ipnet, other.Name, other.ClientSubnet())
+		}
+	}
+	// the DNAT rule of a udp forward would take the handshakes of the network
+	var forwards int64
+	err = GetDB().Model(&PortForward{}).Where("protocol = ? AND public_port = ?", "udp", listenPort).Count(&forwards).Error
+	if err != nil {
+		return nil, err
+	}
+	if forwards > 0 {
+		return nil, portConflictError("udp", listenPort, "a port forward")
+	}
+
+	privateKey, err := generateWireguardPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := generateWireguardPublicKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	network := &Network{
+		ID:         uuid.New().String(),
+		Name:       name,
+		Subnet:     strings.TrimSpace(subnet),
+		ListenPort: listenPort,
+		Interface:  iface,
+		Chain:      chain,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		Status:     NetworkStatusPending,
+	}
+	err = GetDB().Create(network).Error
+	if err == nil {
+		workerQueueChannel <- QueueJob{Type: "network", ID: network.ID}
+	}
+	return network, err
+}
+
+// ScheduleNetworkDeletion marks an empty network for deletion, the default network cannot be deleted
+func ScheduleNetworkDeletion(id string) error {
+	network, err := GetNetwork(id)
+	if err != nil {
+		return err
+	}
+	if network.Name == defaultNetworkName {
+		return conflictError("default_network", "the default network cannot be deleted")
+	}
+	if network.Status == NetworkStatusDeleting {
+		return nil
+	}
+	var count int64
+	err = GetDB().Model(&Peer{}).Where("network_id = ?", id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return conflictError("network_not_empty", "network %s still has %d peer(s)", network.Name, count)
+	}
+	return UpdateNetworkStatus(id, NetworkStatusDeleting)
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Schema is the subset of the OpenAPI 3 schema object used by the api
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *int               `json:"minimum,omitempty"`
+	Maximum              *int               `json:"maximum,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+}
+
+type APIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type APIOperation struct {
+	Method  string
+	Path    string // echo style, e.g. /peers/:id
+	Summary string
+	Public  bool // no api token required
+	// PeerScoped operations also accept the token of an enrolled peer, for its own :id only
+	PeerScoped  bool
+	Parameters  []APIParameter
+	RequestBody *Schema
+	// BodyRequired is false for endpoints which accept an empty body
+	BodyRequired bool
+	Responses    map[int]*Schema
+	ContentType  string // response content type, defaults to application/json
+}
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func stringSchema() *Schema { return &Schema{Type: "string"} }
+func uuidSchema() *Schema   { return &Schema{Type: "string", Format: "uuid"} }
+func refSchema(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+func arraySchema(items *Schema) *Schema { return &Schema{Type: "array", Items: items} }
+func enumSchema(values ...string) *Schema {
+	return &Schema{Type: "string", Enum: values}
+}
+
+func pathParam(name string) APIParameter {
+	return APIParameter{Name: name, In: "path", Required: true, Schema: uuidSchema()}
+}
+
+func idempotencyKeyParam() APIParameter {
+	return APIParameter{Name: idempotencyKeyHeader, In: "header", Schema: stringSchema()}
+}
+
+func queryParam(name string, schema *Schema) APIParameter {
+	return APIParameter{Name: name, In: "query", Schema: schema}
+}
+
+func listQueryParams(sortColumns []string) []APIParameter {
+	return []APIParameter{
+		queryParam("limit", &Schema{Type: "integer", Minimum: intPtr(1), Maximum: intPtr(maxListLimit)}),
+		queryParam("cursor", stringSchema()),
+		queryParam("sort", enumSchema(sortColumns...)),
+		queryParam("order", enumSchema("asc", "desc")),
+		queryParam("created_after", &Schema{Type: "string", Format: "date-time"}),
+		queryParam("created_before", &Schema{Type: "string", Format: "date-time"}),
+	}
+}
+
+func listSchema(item string) *Schema {
+	return &Schema{Type: "object", Properties: map[string]*Schema{
+		"items":       arraySchema(refSchema(item)),
+		"total":       {Type: "integer"},
+		"next_cursor": stringSchema(),
+	}}
+}
+
+func objectSchema(properties map[string]*Schema, required ...string) *Schema {
+	return &Schema{Type: "object", Properties: properties, Required: required}
+}
+
+var peerStatuses = []string{string(PeerStatusPending), string(PeerStatusCreated), string(PeerStatusDeleting), string(PeerStatusFailed)}
+var networkStatuses = []string{string(NetworkStatusPending), string(NetworkStatusCreated), string(NetworkStatusDeleting), string(NetworkStatusFailed)}
+var accessRuleStatuses = []string{string(AccessRuleStatusPending), string(AccessRuleStatusCreated), string(AccessRuleStatusDeleting)}
+
+var portForwardStatuses = []string{string(PortForwardStatusPending), string(PortForwardStatusCreated), string(PortForwardStatusDeleting), string(PortForwardStatusFailed)}
+
+var apiSchemas = map[string]*Schema{
+	"Error": objectSchema(map[string]*Schema{
+		"code":    stringSchema(),
+		"message": stringSchema(),
+		"details": arraySchema(stringSchema()),
+	}, "code", "message"),
+	"Network": objectSchema(map[string]*Schema{
+		"id":          uuidSchema(),
+		"name":        stringSchema(),
+		"subnet":      stringSchema(),
+		"listen_port": {Type: "integer"},
+		"interface":   stringSchema(),
+		"chain":       stringSchema(),
+		"public_key":  stringSchema(),
+		"status":      enumSchema(networkStatuses...),
+		"created_at":  {Type: "string", Format: "date-time"},
+	}),
+	"Peer": objectSchema(map[string]*Schema{
+		"id":          uuidSchema(),
+		"network_id":  uuidSchema(),
+		"ip":          stringSchema(),
+		"public_key":  stringSchema(),
+		"private_key": stringSchema(),
+		"status":      enumSchema(peerStatuses...),
+		"name":        stringSchema(),
+		"label":       stringSchema(),
+		"created_at":  {Type: "string", Format: "date-time"},
+		"direct":      {Type: "boolean"},
+		"endpoint":    stringSchema(),
+		"routes":      arraySchema(stringSchema()),
+		"egress":      {Type: "boolean"},
+		// kbit/s, 0 is unlimited
+		"ingress_limit_kbit": {Type: "integer"},
+		"egress_limit_kbit":  {Type: "integer"},
+	}),
+	"PeerUsage": objectSchema(map[string]*Schema{
+		"peer_id":            uuidSchema(),
+		"ingress_bytes":      {Type: "integer"},
+		"egress_bytes":       {Type: "integer"},
+		"ingress_kbit":       {Type: "integer"},
+		"egress_kbit":        {Type: "integer"},
+		"ingress_limit_kbit": {Type: "integer"},
+		"egress_limit_kbit":  {Type: "integer"},
+		"updated_at":         {Type: "string", Format: "date-time"},
+	}),
+	"AccessRule": objectSchema(map[string]*Schema{
+		"id":          uuidSchema(),
+		"peer_a_id":   uuidSchema(),
+		"peer_b_id":   uuidSchema(),
+		"network_id":  uuidSchema(),
+		"peer_a_ip":   stringSchema(),
+		"peer_a_name": stringSchema(),
+		"peer_b_ip":   stringSchema(),
+		"peer_b_name": stringSchema(),
+		"status":      enumSchema(accessRuleStatuses...),
+		"created_at":  {Type: "string", Format: "date-time"},
+		"expires_at":  {Type: "string", Format: "date-time"},
+		"routes":      arraySchema(stringSchema()),
+	}),
+	"ReachablePeer": objectSchema(map[string]*Schema{
+		"peer_id":            uuidSchema(),
+		"ip":                 stringSchema(),
+		"name":               stringSchema(),
+		"label":              stringSchema(),
+		"access_rule_id":     uuidSchema(),
+		"access_rule_status": enumSchema(accessRuleStatuses...),
+	}),
+	"WireguardConfig": objectSchema(map[string]*Schema{
+		"private_key":      stringSchema(),
+		"public_key":       stringSchema(),
+		"ip":               stringSchema(),
+		"ip_with_mask":     stringSchema(),
+		"allowed_ips":      stringSchema(),
+		"relay_public_key": stringSchema(),
+		"endpoint":         stringSchema(),
+		"endpoints":        stringSchema(),
+		"direct_peers": arraySchema(objectSchema(map[string]*Schema{
+			"peer_id":     uuidSchema(),
+			"public_key":  stringSchema(),
+			"endpoint":    stringSchema(),
+			"allowed_ips": stringSchema(),
+		})),
+		"dns":        stringSchema(),
+		"dns_domain": stringSchema(),
+	}),
+	"Relay": objectSchema(map[string]*Schema{
+		"name":         stringSchema(),
+		"public_ip":    stringSchema(),
+		"region":       stringSchema(),
+		"role":         enumSchema(clusterRoleLeader, clusterRoleFollower),
+		"last_seen_at": {Type: "string", Format: "date-time"},
+	}),
+	"ClusterSnapshot": objectSchema(map[string]*Schema{
+		"networks":          arraySchema(refSchema("Network")),
+		"peers":             arraySchema(refSchema("Peer")),
+		"access_rules":      arraySchema(refSchema("AccessRule")),
+		"relays":            arraySchema(refSchema("Relay")),
+		"port_forwards":     arraySchema(refSchema("PortForward")),
+		"peer_token_hashes": {Type: "object", AdditionalProperties: stringSchema()},
+	}),
+	"PortForward": objectSchema(map[string]*Schema{
+		"id":          uuidSchema(),
+		"network_id":  uuidSchema(),
+		"peer_id":     uuidSchema(),
+		"protocol":    enumSchema("tcp", "udp"),
+		"public_port": {Type: "integer"},
+		"peer_port":   {Type: "integer"},
+		"status":      enumSchema(portForwardStatuses...),
+		"created_at":  {Type: "string", Format: "date-time"},
+	}),
+	"Webhook": objectSchema(map[string]*Schema{
+		"id":     uuidSchema(),
+		"url":    stringSchema(),
+		"secret": stringSchema(),
+		"events": stringSchema(),
+	}),
+	"EnrollmentToken": objectSchema(map[string]*Schema{
+		"id":                   uuidSchema(),
+		"token":                stringSchema(),
+		"name":                 stringSchema(),
+		"label":                stringSchema(),
+		"access_rule_peer_ids": arraySchema(uuidSchema()),
+		"network_id":           uuidSchema(),
+		"expires_at":           {Type: "string", Format: "date-time"},
+		"used_at":              {Type: "string", Format: "date-time", Nullable: true},
+		"peer_id":              stringSchema(),
+		"created_at":           {Type: "string", Format: "date-time"},
+	}),
+	"EnrollResponse": objectSchema(map[string]*Schema{
+		"peer":       refSchema("Peer"),
+		"config":     refSchema("WireguardConfig"),
+		"peer_token": stringSchema(),
+	}),
+	"BatchOperation": objectSchema(map[string]*Schema{
+		"op":         enumSchema(BatchOpCreatePeer, BatchOpUpdatePeer, BatchOpDeletePeer, BatchOpCreateAccessRule, BatchOpDeleteAccessRule),
+		"ref":        stringSchema(),
+		"network_id": uuidSchema(),
+		"name":       stringSchema(),
+		"label":      stringSchema(),
+		"peer_id":    stringSchema(),
+		"peer_a_id":  stringSchema(),
+		"peer_b_id":  stringSchema(),
+		"expires_at": {Type: "string", Format: "date-time", Nullable: true},
+		"routes":     arraySchema(stringSchema()),
+	}, "op"),
+	"BatchResponse": objectSchema(map[string]*Schema{
+		"success": {Type: "boolean"},
+		"results": arraySchema(objectSchema(map[string]*Schema{
+			"index":       {Type: "integer"},
+			"op":          stringSchema(),
+			"status":      enumSchema(BatchResultOK, BatchResultError, BatchResultRolledBack),
+			"code":        stringSchema(),
+			"error":       stringSchema(),
+			"peer":        refSchema("Peer"),
+			"access_rule": refSchema("AccessRule"),
+		})),
+	}),
+	"DesiredState": objectSchema(map[string]*Schema{
+		"network": stringSchema(),
+		"peers": arraySchema(objectSchema(map[string]*Schema{
+			"name":  stringSchema(),
+			"label": stringSchema(),
+		}, "name")),
+		"access_rules": arraySchema(objectSchema(map[string]*Schema{
+			"peer_a": stringSchema(),
+			"peer_b": stringSchema(),
+		}, "peer_a", "peer_b")),
+	}),
+	"StateResponse": objectSchema(map[string]*Schema{
+		"dry_run": {Type: "boolean"},
+		"plan": arraySchema(objectSchema(map[string]*Schema{
+			"action":  enumSchema("create", "update", "delete"),
+			"kind":    enumSchema("peer", "access_rule"),
+			"summary": stringSchema(),
+		})),
+		"results": refSchema("BatchResponse"),
+	}),
+}
+
+var apiOperations = []APIOperation{
+	{Method: http.MethodPost, Path: "/networks", Summary: "Create a network",
+		Parameters: []APIParameter{idempotencyKeyParam()},
+		RequestBody: objectSchema(map[string]*Schema{
+			"name":        stringSchema(),
+			"subnet":      stringSchema(),
+			"listen_port": {Type: "integer", Minimum: intPtr(1), Maximum: intPtr(65535)},
+			"interface":   stringSchema(),
+		}, "name", "subnet", "listen_port"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusCreated: refSchema("Network")}},
+	{Method: http.MethodGet, Path: "/networks", Summary: "List networks",
+		Responses: map[int]*Schema{http.StatusOK: arraySchema(refSchema("Network"))}},
+	{Method: http.MethodGet, Path: "/networks/:id", Summary: "Get a network",
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: refSchema("Network")}},
+	{Method: http.MethodDelete, Path: "/networks/:id", Summary: "Delete an empty network",
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusNoContent: nil}},
+	{Method: http.MethodPost, Path: "/peers", Summary: "Create a peer",
+		Parameters:  []APIParameter{idempotencyKeyParam()},
+		RequestBody: objectSchema(map[string]*Schema{"network_id": uuidSchema(), "name": stringSchema(), "label": stringSchema(), "public_key": stringSchema()}),
+		Responses:   map[int]*Schema{http.StatusCreated: refSchema("Peer")}},
+	{Method: http.MethodGet, Path: "/peers", Summary: "List peers",
+		Parameters: append(listQueryParams(peerSortColumns),
+			queryParam("network_id", uuidSchema()),
+			queryParam("status", enumSchema(peerStatuses...)),
+			queryParam("ip", stringSchema()),
+			queryParam("label", stringSchema()),
+			queryParam("name", stringSchema())),
+		Responses: map[int]*Schema{http.StatusOK: listSchema("Peer")}},
+	{Method: http.MethodGet, Path: "/peers/:id", Summary: "Get a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: refSchema("Peer")}},
+	{Method: http.MethodGet, Path: "/peers/:id/status", Summary: "Get the status of a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: objectSchema(map[string]*Schema{"status": enumSchema(peerStatuses...)})}},
+	{Method: http.MethodGet, Path: "/peers/:id/config", Summary: "Get the wireguard config of a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: refSchema("WireguardConfig")}},
+	{Method: http.MethodGet, Path: "/peers/:id/script", Summary: "Get the wireguard setup script of a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: stringSchema()}},
+	{Method: http.MethodGet, Path: "/peers/:id/access-rules", Summary: "List the access rules of a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: arraySchema(refSchema("AccessRule"))}},
+	{Method: http.MethodGet, Path: "/peers/:id/reachable-by", Summary: "List the peers which can reach a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: arraySchema(refSchema("ReachablePeer"))}},
+	{Method: http.MethodPut, Path: "/peers/:id/direct", Summary: "Opt a peer in or out of direct connections", PeerScoped: true,
+		Parameters:   []APIParameter{pathParam("id")},
+		RequestBody:  objectSchema(map[string]*Schema{"direct": {Type: "boolean"}}, "direct"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("Peer")}},
+	{Method: http.MethodPut, Path: "/peers/:id/routes", Summary: "Set the subnets a peer routes for the network",
+		Parameters:   []APIParameter{pathParam("id")},
+		RequestBody:  objectSchema(map[string]*Schema{"routes": arraySchema(stringSchema())}, "routes"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("Peer")}},
+	{Method: http.MethodPut, Path: "/peers/:id/egress", Summary: "Allow a peer to reach the internet through the relay",
+		Parameters:   []APIParameter{pathParam("id")},
+		RequestBody:  objectSchema(map[string]*Schema{"egress": {Type: "boolean"}}, "egress"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("Peer")}},
+	{Method: http.MethodPut, Path: "/peers/:id/limits", Summary: "Set the bandwidth limits of a peer",
+		Parameters: []APIParameter{pathParam("id")},
+		RequestBody: objectSchema(map[string]*Schema{
+			"ingress_limit_kbit": {Type: "integer", Minimum: intPtr(0), Maximum: intPtr(maxRateLimitKbit)},
+			"egress_limit_kbit":  {Type: "integer", Minimum: intPtr(0), Maximum: intPtr(maxRateLimitKbit)},
+		}),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("Peer")}},
+	{Method: http.MethodGet, Path: "/peers/:id/usage", Summary: "Get the traffic of a peer through the relay", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: refSchema("PeerUsage")}},
+	{Method: http.MethodGet, Path: "/peers/:id/events", Summary: "Stream the config changes of a peer as server-sent events", PeerScoped: true,
+		Parameters: []APIParameter{
+			pathParam("id"),
+			queryParam("cursor", &Schema{Type: "integer", Minimum: intPtr(0)}),
+		},
+		Responses:   map[int]*Schema{http.StatusOK: stringSchema()},
+		ContentType: "text/event-stream"},
+	{Method: http.MethodDelete, Path: "/peers/:id", Summary: "Delete a peer", PeerScoped: true,
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusNoContent: nil}},
+	{Method: http.MethodPost, Path: "/access-rule/:peer_a_id/:peer_b_id", Summary: "Allow two peers to reach each other",
+		Parameters: []APIParameter{pathParam("peer_a_id"), pathParam("peer_b_id"), idempotencyKeyParam()},
+		RequestBody: objectSchema(map[string]*Schema{
+			"expires_at": {Type: "string", Format: "date-time", Nullable: true},
+			"routes":     arraySchema(stringSchema()),
+		}),
+		Responses: map[int]*Schema{http.StatusCreated: refSchema("AccessRule")}},
+	{Method: http.MethodGet, Path: "/access-rule/:peer_a_id/:peer_b_id", Summary: "Get the access rule between two peers",
+		Parameters: []APIParameter{pathParam("peer_a_id"), pathParam("peer_b_id")},
+		Responses:  map[int]*Schema{http.StatusOK: refSchema("AccessRule")}},
+	{Method: http.MethodDelete, Path: "/access-rule/:peer_a_id/:peer_b_id", Summary: "Revoke the access rule between two peers",
+		Parameters: []APIParameter{pathParam("peer_a_id"), pathParam("peer_b_id")},
+		Responses:  map[int]*Schema{http.StatusNoContent: nil}},
+	{Method: http.MethodGet, Path: "/access-rules", Summary: "List access rules",
+		Parameters: append(listQueryParams(accessRuleSortColumns),
+			queryParam("network_id", uuidSchema()),
+			queryParam("status", enumSchema(accessRuleStatuses...)),
+			queryParam("peer_id", uuidSchema())),
+		Responses: map[int]*Schema{http.StatusOK: listSchema("AccessRule")}},
+	{Method: http.MethodPost, Path: "/batch", Summary: "Apply create and delete operations in one transaction",
+		Parameters: []APIParameter{idempotencyKeyParam()},
+		RequestBody: objectSchema(map[string]*Schema{
+			"atomic":     {Type: "boolean"},
+			"operations": arraySchema(refSchema("BatchOperation")),
+		}, "operations"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("BatchResponse"), http.StatusUnprocessableEntity: refSchema("BatchResponse")}},
+	{Method: http.MethodPut, Path: "/state", Summary: "Converge named peers and their access rules to the desired state",
+		Parameters:   []APIParameter{queryParam("dry_run", &Schema{Type: "boolean"})},
+		RequestBody:  refSchema("DesiredState"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("StateResponse"), http.StatusUnprocessableEntity: refSchema("StateResponse")}},
+	{Method: http.MethodGet, Path: "/events", Summary: "Stream events as server-sent events",
+		Parameters: []APIParameter{
+			queryParam("cursor", &Schema{Type: "integer", Minimum: intPtr(0)}),
+			queryParam("types", stringSchema()),
+		},
+		Responses:   map[int]*Schema{http.StatusOK: stringSchema()},
+		ContentType: "text/event-stream"},
+	{Method: http.MethodPost, Path: "/port-forwards", Summary: "Forward a port of the relay to a peer",
+		Parameters: []APIParameter{idempotencyKeyParam()},
+		RequestBody: objectSchema(map[string]*Schema{
+			"peer_id":     uuidSchema(),
+			"protocol":    enumSchema("tcp", "udp"),
+			"public_port": {Type: "integer", Minimum: intPtr(1), Maximum: intPtr(65535)},
+			"peer_port":   {Type: "integer", Minimum: intPtr(1), Maximum: intPtr(65535)},
+		}, "peer_id", "public_port"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusCreated: refSchema("PortForward")}},
+	{Method: http.MethodGet, Path: "/port-forwards", Summary: "List port forwards",
+		Parameters: []APIParameter{queryParam("peer_id", uuidSchema())},
+		Responses:  map[int]*Schema{http.StatusOK: arraySchema(refSchema("PortForward"))}},
+	{Method: http.MethodGet, Path: "/port-forwards/:id", Summary: "Get a port forward",
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusOK: refSchema("PortForward")}},
+	{Method: http.MethodDelete, Path: "/port-forwards/:id", Summary: "Delete a port forward",
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusNoContent: nil}},
+	{Method: http.MethodPost, Path: "/webhooks", Summary: "Subscribe a webhook to events",
+		Parameters: []APIParameter{idempotencyKeyParam()},
+		RequestBody: objectSchema(map[string]*Schema{
+			"url":    stringSchema(),
+			"secret": stringSchema(),
+			"events": arraySchema(enumSchema(eventTypes...)),
+		}, "url"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusCreated: refSchema("Webhook")}},
+	{Method: http.MethodGet, Path: "/webhooks", Summary: "List webhooks",
+		Responses: map[int]*Schema{http.StatusOK: arraySchema(refSchema("Webhook"))}},
+	{Method: http.MethodDelete, Path: "/webhooks/:id", Summary: "Delete a webhook",
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusNoContent: nil}},
+	{Method: http.MethodPost, Path: "/enrollment-tokens", Summary: "Mint a single use enrollment token",
+		RequestBody: objectSchema(map[string]*Schema{
+			"network_id":           uuidSchema(),
+			"name":                 stringSchema(),
+			"label":                stringSchema(),
+			"access_rule_peer_ids": arraySchema(uuidSchema()),
+			"expires_at":           {Type: "string", Format: "date-time", Nullable: true},
+		}),
+		Responses: map[int]*Schema{http.StatusCreated: refSchema("EnrollmentToken")}},
+	{Method: http.MethodGet, Path: "/enrollment-tokens", Summary: "List enrollment tokens",
+		Responses: map[int]*Schema{http.StatusOK: arraySchema(refSchema("EnrollmentToken"))}},
+	{Method: http.MethodDelete, Path: "/enrollment-tokens/:id", Summary: "Revoke an enrollment token",
+		Parameters: []APIParameter{pathParam("id")},
+		Responses:  map[int]*Schema{http.StatusNoContent: nil}},
+	{Method: http.MethodPost, Path: "/enroll", Summary: "Exchange an enrollment token for a peer", Public: true,
+		RequestBody: objectSchema(map[string]*Schema{
+			"token":      stringSchema(),
+			"public_key": stringSchema(),
+		}, "token"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusCreated: refSchema("EnrollResponse")}},
+	{Method: http.MethodGet, Path: "/cluster/snapshot", Summary: "Get the state followers replicate, network private keys included",
+		Responses: map[int]*Schema{http.StatusOK: refSchema("ClusterSnapshot")}},
+	{Method: http.MethodPost, Path: "/cluster/heartbeat", Summary: "Register a follower relay",
+		RequestBody: objectSchema(map[string]*Schema{
+			"name":      stringSchema(),
+			"public_ip": stringSchema(),
+			"region":    stringSchema(),
+		}, "name", "public_ip"),
+		BodyRequired: true,
+		Responses:    map[int]*Schema{http.StatusOK: refSchema("Relay")}},
+	{Method: http.MethodGet, Path: "/cluster/relays", Summary: "List the relays of the cluster",
+		Responses: map[int]*Schema{http.StatusOK: arraySchema(refSchema("Relay"))}},
+	{Method: http.MethodGet, Path: "/openapi.json", Summary: "This document", Public: true,
+		Responses: map[int]*Schema{http.StatusOK: {Type: "object"}}},
+}
+
+var echoPathParamRegex = regexp.MustCompile(`:([a-z_]+)`)
+
+func findAPIOperation(method, path string) *APIOperation {
+	for i := range apiOperations {
+		if apiOperations[i].Method == method && apiOperations[i].Path == path {
+			return &apiOperations[i]
+		}
+	}
+	return nil
+}
+
+// buildOpenAPISpec renders apiOperations as an OpenAPI 3 document
+func buildOpenAPISpec() map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, operation := range apiOperations {
+		path := echoPathParamRegex.ReplaceAllString(operation.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		contentType := operation.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		responses := map[string]interface{}{}
+		for status, schema := range operation.Responses {
+			response := map[string]interface{}{"description": http.StatusText(status)}
+			if schema != nil {
+				response["content"] = map[string]interface{}{contentType: map[string]interface{}{"schema": schema}}
+			}
+			responses[strconv.Itoa(status)] = response
+		}
+		responses["default"] = map[string]interface{}{
+			"description": "Error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": refSchema("Error")}},
+		}
+		spec := map[string]interface{}{
+			"summary":     operation.Summary,
+			"operationId": strings.ToLower(operation.Method) + strings.ReplaceAll(strings.ReplaceAll(path, "{", ""), "}", ""),
+			"responses":   responses,
+		}
+		if len(operation.Parameters) > 0 {
+			spec["parameters"] = operation.Parameters
+		}
+		if operation.RequestBody != nil {
+			spec["requestBody"] = map[string]interface{}{
+				"required": operation.BodyRequired,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": operation.RequestBody}},
+			}
+		}
+		if operation.Public {
+			spec["security"] = []interface{}{}
+		}
+		paths[path][strings.ToLower(operation.Method)] = spec
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Piko Tunnel API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+			"securitySchemes": map[string]interface{}{
+				"apiToken": map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"apiToken": []string{}}},
+	}
+}
+
+// checkOpenAPIRoutes makes sure every registered route is documented and the other way around
+func checkOpenAPIRoutes(e *echo.Echo) {
+	registered := map[string]bool{}
+	for _, route := range e.Routes() {
+		if strings.HasPrefix(route.Path, "/*") || route.Method == echo.RouteNotFound {
+			continue
+		}
+		registered[route.Method+" "+route.Path] = true
+		if findAPIOperation(route.Method, route.Path) == nil {
+			log.Fatalf("route %s %s is not documented in the openapi spec", route.Method, route.Path)
+		}
+	}
+	for _, operation := range apiOperations {
+		if !registered[operation.Method+" "+operation.Path] {
+			log.Fatalf("openapi spec documents %s %s which is not registered", operation.Method, operation.Path)
+		}
+	}
+}
+
+func getOpenAPISpec(c echo.Context) error {
+	return c.JSON(http.StatusOK, openAPISpec)
+}
+
+var openAPISpec = buildOpenAPISpec()
+
+// openAPIValidationMiddleware validates path params, query params and json bodies against apiOperations
+func openAPIValidationMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		operation := findAPIOperation(c.Request().Method, c.Path())
+		if operation == nil {
+			return next(c)
+		}
+		details := []string{}
+		for _, parameter := range operation.Parameters {
+			var value string
+			switch parameter.In {
+			case "path":
+				value = c.Param(parameter.Name)
+			case "header":
+				value = c.Request().Header.Get(parameter.Name)
+			default:
+				value = c.QueryParam(parameter.Name)
+			}
+			if value == "" {
+				if parameter.Required {
+					details = append(details, fmt.Sprintf("%s parameter %s is required", parameter.In, parameter.Name))
+				}
+				continue
+			}
+			if err := validateParameterValue(parameter.Schema, value); err != nil {
+				details = append(details, fmt.Sprintf("%s parameter %s %s", parameter.In, parameter.Name, err))
+			}
+		}
+		if operation.RequestBody != nil {
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return err
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			if len(bytes.TrimSpace(body)) == 0 {
+				if operation.BodyRequired {
+					details = append(details, "request body is required")
+				}
+			} else {
+				var value interface{}
+				if err := json.Unmarshal(body, &value); err != nil {
+					details = append(details, "request body is not valid json")
+				} else {
+					details = append(details, validateSchemaValue(operation.RequestBody, value, "body")...)
+				}
+			}
+		}
+		if len(details) > 0 {
+			return respondError(c, &DomainError{
+				Kind:    ErrorKindInvalid,
+				Code:    "invalid_request",
+				Message: "request does not match the api specification",
+				Details: details,
+			})
+		}
+		return next(c)
+	}
+}
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func validateParameterValue(schema *Schema, value string) error {
+	switch schema.Type {
+	case "integer":
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		return validateIntegerRange(schema, number)
+	case "boolean":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("must be true or false")
+		}
+	case "string":
+		return validateStringValue(schema, value)
+	}
+	return nil
+}
+
+func validateIntegerRange(schema *Schema, number int) error {
+	if schema.Minimum != nil && number < *schema.Minimum {
+		return fmt.Errorf("must be >= %d", *schema.Minimum)
+	}
+	if schema.Maximum != nil && number > *schema.Maximum {
+		return fmt.Errorf("must be <= %d", *schema.Maximum)
+	}
+	return nil
+}
+
+func validateStringValue(schema *Schema, value string) error {
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, value) {
+		return fmt.Errorf("must be one of %s", strings.Join(schema.Enum, ", "))
+	}
+	switch schema.Format {
+	case "uuid":
+		if !uuidRegex.MatchString(value) {
+			return fmt.Errorf("must be a uuid")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("must be a RFC3339 date-time")
+		}
+	}
+	return nil
+}
+
+func validateSchemaValue(schema *Schema, value interface{}, location string) []string {
+	if schema.Ref != "" {
+		schema = apiSchemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return []string{location + " must not be null"}
+	}
+	details := []string{}
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{location + " must be an object"}
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				details = append(details, location+"."+name+" is required")
+			}
+		}
+		// sorted so the error is stable
+		names := []string{}
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				details = append(details, validateSchemaValue(property, object[name], location+"."+name)...)
+			} else if schema.AdditionalProperties != nil {
+				details = append(details, validateSchemaValue(schema.AdditionalProperties, object[name], location+"."+name)...)
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return []string{location + " must be an array"}
+		}
+		for i, item := range items {
+			details = append(details, validateSchemaValue(schema.Items, item, fmt.Sprintf("%s[%d]", location, i))...)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return []string{location + " must be a string"}
+		}
+		if err := validateStringValue(schema, text); err != nil {
+			details = append(details, location+" "+err.Error())
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			details = append(details, location+" must be a boolean")
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int(number)) {
+			details = append(details, location+" must be an integer")
+		} else if err := validateIntegerRange(schema, int(number)); err != nil {
+			details = append(details, location+" "+err.Error())
+		}
+	}
+	return details
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIValidationRejectsOutOfRangeBodyIntegers(t *testing.T) {
+	e := newServer()
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		detail string
+	}{
+		{http.MethodPost, "/port-forwards", `{"peer_id":"7b0b7f5e-7f4e-4a39-9d51-3c9cb1f0a7d1","public_port":70000}`, "public_port must be <= 65535"},
+		{http.MethodPost, "/port-forwards", `{"peer_id":"7b0b7f5e-7f4e-4a39-9d51-3c9cb1f0a7d1","public_port":22,"peer_port":0}`, "peer_port must be >= 1"},
+		{http.MethodPost, "/networks", `{"name":"staging","subnet":"10.1.0.1/16","listen_port":0}`, "listen_port must be >= 1"},
+		{http.MethodPut, "/peers/7b0b7f5e-7f4e-4a39-9d51-3c9cb1f0a7d1/limits", `{"ingress_limit_kbit":-1,"egress_limit_kbit":0}`, "ingress_limit_kbit must be >= 0"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", config.APIToken)
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, request)
+		var response struct {
+			Code    string   `json:"code"`
+			Details []string `json:"details"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != http.StatusBadRequest || response.Code != "invalid_request" {
+			t.Fatalf("%s %s: expected 400 invalid_request, got %d %s", test.method, test.path, recorder.Code, recorder.Body)
+		}
+		if !strings.Contains(strings.Join(response.Details, "; "), test.detail) {
+			t.Fatalf("%s %s: expected %q in %v", test.method, test.path, test.detail, response.Details)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type ListOptions struct {
+	Limit         int
+	Cursor        *ListCursor
+	Sort          string
+	Desc          bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// ListCursor points at the last item of a page, keyed by the sort column value and the id
+type ListCursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+type ListResult[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func (c *ListCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(encoded string) (*ListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, invalidError("invalid_cursor", "invalid cursor")
+	}
+	var cursor ListCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" {
+		return nil, invalidError("invalid_cursor", "invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// parseListOptions reads limit, cursor, sort, order, created_after and created_before query params
+func parseListOptions(c echo.Context, sortColumns []string) (ListOptions, error) {
+	options := ListOptions{
+		Limit: defaultListLimit,
+		Sort:  sortColumns[0],
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxListLimit {
+			return options, invalidError("invalid_limit", "limit must be between 1 and %d", maxListLimit)
+		}
+		options.Limit = value
+	}
+	if sort := c.QueryParam("sort"); sort != "" {
+		if !slices.Contains(sortColumns, sort) {
+			return options, invalidError("invalid_sort", "sort must be one of %v", sortColumns)
+		}
+		options.Sort = sort
+	}
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		options.Desc = true
+	default:
+		return options, invalidError("invalid_order", "order must be asc or desc")
+	}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		decoded, err := decodeListCursor(cursor)
+		if err != nil {
+			return options, err
+		}
+		options.Cursor = decoded
+	}
+	for param, target := range map[string]**time.Time{
+		"created_after":  &options.CreatedAfter,
+		"created_before": &options.CreatedBefore,
+	} {
+		if value := c.QueryParam(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return options, invalidError("invalid_"+param, "%s must be a RFC3339 timestamp", param)
+			}
+			parsed = parsed.UTC()
+			*target = &parsed
+		}
+	}
+	return options, nil
+}
+
+// paginate counts the filtered query and fetches one page ordered by the sort column and id.
+// sortValue must return the value of the sort column of an item, in the format stored in the cursor.
+func paginate[T any](query *gorm.DB, options ListOptions, sortValue func(item *T) string, id func(item *T) string) (*ListResult[T], error) {
+	if options.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *options.CreatedAfter)
+	}
+	if options.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *options.CreatedBefore)
+	}
+	result := &ListResult[T]{Items: []T{}}
+	if err := query.Session(&gorm.Session{}).Count(&result.Total).Error; err != nil {
+		return nil, err
+	}
+
+	direction, operator := "ASC", ">"
+	if options.Desc {
+		direction, operator = "DESC", "<"
+	}
+	if options.Cursor != nil {
+		var cursorValue interface{} = options.Cursor.Value
+		if options.Sort == "created_at" {
+			parsed, err := time.Parse(time.RFC3339Nano, options.Cursor.Value)
+			if err != nil {
+				return nil, invalidError("invalid_cursor", "invalid cursor")
+			}
+			cursorValue = parsed.UTC()
+		}
+		query = query.Where(
+			fmt.Sprintf("((%s %s ?) OR (%s = ? AND id %s ?))", options.Sort, operator, options.Sort, operator),
+			cursorValue, cursorValue, options.Cursor.ID,
+		)
+	}
+	// fetch one extra row to know whether there is a next page
+	err := query.Order(options.Sort + " " + direction).Order("id " + direction).Limit(options.Limit + 1).Find(&result.Items).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) > options.Limit {
+		result.Items = result.Items[:options.Limit]
+		last := &result.Items[len(result.Items)-1]
+		result.NextCursor = (&ListCursor{Value: sortValue(last), ID: id(last)}).Encode()
+	}
+	return result, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+)
+
+// portForwardComment tags the iptables rules of a port forward, so stale ones can be found
+const portForwardComment = "pt-forward:"
+
+// iptablesRule is a rule of a table and chain, without the action
+type iptablesRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+// CreatePortForward stores a pending port forward to the peer, the worker installs its rules.
+// peerPort defaults to publicPort.
+func CreatePortForward(peerID string, protocol string, publicPort int, peerPort int) (*PortForward, error) {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, invalidError("invalid_protocol", "protocol must be tcp or udp")
+	}
+	if peerPort == 0 {
+		peerPort = publicPort
+	}
+	if publicPort < 1 || publicPort > 65535 || peerPort < 1 || peerPort > 65535 {
+		return nil, invalidError("invalid_port", "public_port and peer_port must be between 1 and 65535")
+	}
+	peer, err := GetPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if peer.Status == PeerStatusDeleting || peer.Status == PeerStatusFailed {
+		return nil, unprocessableError("peer_unavailable", "peer %s is %s", peer.ID, peer.Status)
+	}
+	if err := checkPublicPortFree(protocol, publicPort); err != nil {
+		return nil, err
+	}
+	forward := &PortForward{
+		ID:         uuid.New().String(),
+		NetworkID:  peer.NetworkID,
+		PeerID:     peer.ID,
+		Protocol:   protocol,
+		PublicPort: publicPort,
+		PeerPort:   peerPort,
+		Status:     PortForwardStatusPending,
+	}
+	err = GetDB().Create(forward).Error
+	if err == nil {
+		workerQueueChannel <- QueueJob{Type: "port_forward", ID: forward.ID}
+	}
+	return forward, err
+}
+
+func portConflictError(protocol string, port int, user string) *DomainError {
+	return conflictError("port_conflict", "%s port %d of the relay is used by %s", protocol, port, user)
+}
+
+// checkPublicPortFree rejects the ports of other forwards, of the wireguard networks, of the api and
+// of local daemons, the DNAT rule would take their traffic (e.g. the admin's ssh)
+func checkPublicPortFree(protocol string, port int) error {
+	var count int64
+	err := GetDB().Model(&PortForward{}).Where("protocol = ? AND public_port = ?", protocol, port).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return portConflictError(protocol, port, "another port forward")
+	}
+	if protocol == "udp" {
+		networks, err := GetNetworks()
+		if err != nil {
+			return err
+		}
+		for _, network := range networks {
+			if network.ListenPort == port {
+				return portConflictError(protocol, port, "network "+network.Name)
+			}
+		}
+	} else {
+		serverAddress := os.Getenv("SERVER_ADDRESS")
+		if serverAddress == "" {
+			serverAddress = ":8080"
+		}
+		if _, serverPort, err := net.SplitHostPort(serverAddress); err == nil && serverPort == strconv.Itoa(port) {
+			return portConflictError(protocol, port, "the api")
+		}
+	}
+	// inside a namespace the rules do not see the listeners of the host
+	if config.Netns == "" && localPortInUse(protocol, port) {
+		return portConflictError(protocol, port, "a local service")
+	}
+	return nil
+}
+
+// localPortInUse reports whether something on the relay listens on the port
+func localPortInUse(protocol string, port int) bool {
+	address := ":" + strconv.Itoa(port)
+	var closer io.Closer
+	var err error
+	if protocol == "udp" {
+		closer, err = net.ListenPacket("udp", address)
+	} else {
+		closer, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return errors.Is(err, syscall.EADDRINUSE)
+	}
+	closer.Close()
+	return false
+}
+
+// SchedulePortForwardDeletion marks the port forward for deletion, the worker removes its rules
+func SchedulePortForwardDeletion(id string) error {
+	forward, err := GetPortForward(id)
+	if err != nil {
+		return err
+	}
+	if forward.Status == PortForwardStatusDeleting {
+		return nil
+	}
+	err = UpdatePortForwardStatus(id, PortForwardStatusDeleting)
+	if err == nil {
+		workerQueueChannel <- QueueJob{Type: "port_forward", ID: id}
+	}
+	return err
+}
+
+// portForwardRules lists the rules of a port forward: connections to any local address of the
+// relay are sent to the peer and come from the relay address, so the peer answers through the
+// tunnel whatever its allowed ips, and both directions pass the FORWARD chain.
+func portForwardRules(network *Network, peerIP string, forward *PortForward) []iptablesRule {
+	iface := network.Interface
+	publicPort := strconv.Itoa(forward.PublicPort)
+	peerPort := strconv.Itoa(forward.PeerPort)
+	comment := []string{"-m", "comment", "--comment", portForwardComment + forward.ID}
+	return []iptablesRule{
+		{"nat", "PREROUTING", append([]string{"!", "-i", iface, "-p", forward.Protocol, "-m", "addrtype", "--dst-type", "LOCAL",
+			"--dport", publicPort, "-j", "DNAT", "--to-destination", peerIP + ":" + peerPort}, comment...)},
+		{"nat", "POSTROUTING", append([]string{"-o", iface, "-d", peerIP, "-p", forward.Protocol, "--dport", peerPort,
+			"-m", "conntrack", "--ctstate", "DNAT", "-j", "SNAT", "--to-source", network.RelayAddress()}, comment...)},
+		{"filter", "FORWARD", append([]string{"!", "-i", iface, "-o", iface, "-d", peerIP, "-p", forward.Protocol, "--dport", peerPort,
+			"-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"}, comment...)},
+		{"filter", "FORWARD", append([]string{"-i", iface, "!", "-o", iface, "-s", peerIP, "-p", forward.Protocol, "--sport", peerPort,
+			"-m", "conntrack", "--ctstate", "ESTABLISHED", "-j", "ACCEPT"}, comment...)},
+	}
+}
+
+// addPortForwardRules inserts the missing rules, the FORWARD ones go before the egress drop.
+// When a rule cannot be inserted the rules of the port forward are removed, none is left half done.
+func addPortForwardRules(network *Network, peerIP string, forward *PortForward) (bool, error) {
+	added := false
+	for _, rule := range portForwardRules(network, peerIP, forward) {
+		if dataPlaneCommand("iptables", append([]string{"-t", rule.table, "-C", rule.chain}, rule.args...)...).Run() == nil {
+			continue
+		}
+		out, err := dataPlaneCommand("iptables", append([]string{"-t", rule.table, "-I", rule.chain}, rule.args...)...).CombinedOutput()
+		if err != nil {
+			removePortForwardRules(network, peerIP, forward)
+			return false, fmt.Errorf("iptables -t %s -I %s: %s", rule.table, rule.chain, strings.TrimSpace(string(out)))
+		}
+		added = true
+	}
+	return added, nil
+}
+
+func removePortForwardRules(network *Network, peerIP string, forward *PortForward) {
+	for _, rule := range portForwardRules(network, peerIP, forward) {
+		dataPlaneCommand("iptables", append([]string{"-t", rule.table, "-D", rule.chain}, rule.args...)...).Run()
+	}
+}
+
+// getPortForwardRules returns the rules tagged with a port forward comment, keyed by port forward id
+func getPortForwardRules() map[string][]iptablesRule {
+	rules := map[string][]iptablesRule{}
+	for _, chain := range []iptablesRule{{table: "nat", chain: "PREROUTING"}, {table: "nat", chain: "POSTROUTING"}, {table: "filter", chain: "FORWARD"}} {
+		out, err := dataPlaneCommand("iptables", "-t", chain.table, "-S", chain.chain).Output()
+		if err != nil {
+			log.Printf("[ERROR] Failed to read the %s chain: %s", chain.chain, err)
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			index := strings.Index(line, portForwardComment)
+			if len(fields) < 2 || fields[0] != "-A" || index < 0 {
+				continue
+			}
+			id := strings.Trim(strings.Fields(line[index+len(portForwardComment):])[0], `"`)
+			// iptables -S quotes the comment, the quotes are not part of it
+			args := []string{}
+			for _, field := range fields[2:] {
+				args = append(args, strings.Trim(field, `"`))
+			}
+			rules[id] = append(rules[id], iptablesRule{table: chain.table, chain: chain.chain, args: args})
+		}
+	}
+	return rules
+}
+
+// reconcilePortForwards installs the rules of the created port forwards of the network and removes
+// the rules of port forwards which do not exist anymore, pending and deleting ones are left to the worker
+func reconcilePortForwards(network *Network, peersByID map[string]*Peer) error {
+	var forwards []PortForward
+	if err := GetDB().Find(&forwards).Error; err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	added, removed := 0, 0
+	for i, forward := range forwards {
+		known[forward.ID] = true
+		peer, ok := peersByID[forward.PeerID]
+		if forward.NetworkID != network.ID || forward.Status != PortForwardStatusCreated || !ok {
+			continue
+		}
+		ok, err := addPortForwardRules(network, peer.IP, &forwards[i])
+		if err != nil {
+			log.Printf("[ERROR] Failed to add the rules of port forward %s: %s", forward.ID, err)
+		} else if ok {
+			added++
+		}
+	}
+	for id, rules := range getPortForwardRules() {
+		if known[id] {
+			continue
+		}
+		for _, rule := range rules {
+			dataPlaneCommand("iptables", append([]string{"-t", rule.table, "-D", rule.chain}, rule.args...)...).Run()
+		}
+		removed++
+	}
+	if added > 0 || removed > 0 {
+		log.Printf("[DONE] Reconciled port forwards of network %s: %d added, %d removed", network.Name, added, removed)
+	}
+	return nil
+}
+
+func portForwardEventData(forward *PortForward) map[string]string {
+	return map[string]string{
+		"id":          forward.ID,
+		"peer_id":     forward.PeerID,
+		"protocol":    forward.Protocol,
+		"public_port": strconv.Itoa(forward.PublicPort),
+		"peer_port":   strconv.Itoa(forward.PeerPort),
+		"status":      string(forward.Status),
+	}
+}
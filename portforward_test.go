@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func expectPortConflict(t *testing.T, err error) {
+	t.Helper()
+	var domainError *DomainError
+	if !errors.As(err, &domainError) || domainError.Code != "port_conflict" {
+		t.Fatalf("expected a port_conflict error, got %v", err)
+	}
+}
+
+func TestNetworkListenPortHeldByPortForward(t *testing.T) {
+	forward := &PortForward{ID: uuid.New().String(), Protocol: "udp", PublicPort: 51821, PeerPort: 51821, Status: PortForwardStatusCreated}
+	if err := GetDB().Create(forward).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer DeletePortForward(forward.ID)
+	_, err := CreateNetwork("forwarded", "10.9.0.1/16", 51821, "")
+	expectPortConflict(t, err)
+}
+
+func TestPortForwardConflicts(t *testing.T) {
+	// the wireguard port of the default network
+	expectPortConflict(t, checkPublicPortFree("udp", config.WireguardListenPort))
+
+	// a local daemon, e.g. sshd
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	expectPortConflict(t, checkPublicPortFree("tcp", port))
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectPortConflict(t, checkPublicPortFree("udp", conn.LocalAddr().(*net.UDPAddr).Port))
+
+	// a free port
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	if err := checkPublicPortFree("tcp", freePort); err != nil {
+		t.Fatalf("expected port %d to be free, got %v", freePort, err)
+	}
+}
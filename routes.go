@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+func routesOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// normalizeRoutes parses ipv4 subnets and returns them in network form, e.g. 192.168.1.0/24
+func normalizeRoutes(routes []string) ([]string, error) {
+	result := []string{}
+	for _, route := range routes {
+		ip, ipnet, err := net.ParseCIDR(strings.TrimSpace(route))
+		if err != nil || ip.To4() == nil {
+			return nil, invalidError("invalid_route", "route %s must be an ipv4 subnet, e.g. 192.168.1.0/24", route)
+		}
+		if ones, _ := ipnet.Mask.Size(); ones < 8 {
+			return nil, invalidError("invalid_route", "route %s is wider than /8", route)
+		}
+		if !slices.Contains(result, ipnet.String()) {
+			result = append(result, ipnet.String())
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// SetPeerRoutes makes the peer the gateway of the routes, they cannot overlap the network
+// or the routes of another peer of the network
+func SetPeerRoutes(peerID string, routes []string) (*Peer, error) {
+	routes, err := normalizeRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := GetPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	network, err := GetNetwork(peer.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	var others []Peer
+	err = GetDB().Find(&others, "network_id = ? AND id <> ? AND routes <> ''", peer.NetworkID, peer.ID).Error
+	if err != nil {
+		return nil, err
+	}
+	_, subnet, _ := net.ParseCIDR(network.Subnet)
+	for _, route := range routes {
+		_, ipnet, _ := net.ParseCIDR(route)
+		if subnet != nil && routesOverlap(subnet, ipnet) {
+			return nil, conflictError("route_overlap", "route %s overlaps the subnet of network %s", route, network.Name)
+		}
+		for _, other := range others {
+			for _, otherRoute := range splitList(other.Routes) {
+				_, otherNet, err := net.ParseCIDR(otherRoute)
+				if err == nil && routesOverlap(otherNet, ipnet) {
+					return nil, conflictError("route_overlap", "route %s overlaps %s of peer %s", route, otherRoute, other.ID)
+				}
+			}
+		}
+	}
+	peer.Routes = strings.Join(routes, ",")
+	err = GetDB().Model(&Peer{}).Where("id = ?", peer.ID).Update("routes", peer.Routes).Error
+	if err != nil {
+		return nil, err
+	}
+	// the worker reconciles the allowed ips, kernel routes and rules of the network
+	workerQueueChannel <- QueueJob{Type: "network", ID: network.ID}
+	notifyDirectPartners(peer, "routes_changed")
+	return peer, nil
+}
+
+// relayAllowedIPs is what the relay sends to the peer: its address and the subnets it is a gateway for
+func (peer *Peer) relayAllowedIPs() []string {
+	return append([]string{peer.IP + "/32"}, splitList(peer.Routes)...)
+}
+
+// validateAccessRuleRoutes checks the routes are advertised by one of the peers of the rule
+func validateAccessRuleRoutes(routes []string, peerA *Peer, peerB *Peer) ([]string, error) {
+	routes, err := normalizeRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	advertised := append(splitList(peerA.Routes), splitList(peerB.Routes)...)
+	for _, route := range routes {
+		if !slices.Contains(advertised, route) {
+			return nil, unprocessableError("route_not_advertised", "route %s is not a route of peer %s or %s", route, peerA.ID, peerB.ID)
+		}
+	}
+	return routes, nil
+}
+
+// accessRulePairs lists the source and destination pairs an access rule accepts: both peers, and each
+// route it opens with the peer on the other side of the gateway. Routes the gateway no longer
+// advertises are left out.
+func accessRulePairs(rule *AccessRule, peerA *Peer, peerB *Peer) [][2]string {
+	pairs := [][2]string{{peerA.IP, peerB.IP}, {peerB.IP, peerA.IP}}
+	for _, route := range splitList(rule.Routes) {
+		var client *Peer
+		switch {
+		case slices.Contains(splitList(peerB.Routes), route):
+			client = peerA
+		case slices.Contains(splitList(peerA.Routes), route):
+			client = peerB
+		default:
+			continue
+		}
+		pairs = append(pairs, [2]string{client.IP, route}, [2]string{route, client.IP})
+	}
+	return pairs
+}
+
+// routesOpenedTo lists the routes of other peers the created access rules of the peer open to it
+func routesOpenedTo(peer *Peer) ([]string, error) {
+	rules, err := GetAccessRulesByPeerID(peer.ID)
+	if err != nil {
+		return nil, err
+	}
+	otherPeerIDs := []string{}
+	for _, rule := range rules {
+		if rule.Status == AccessRuleStatusCreated && rule.Routes != "" {
+			otherPeerIDs = append(otherPeerIDs, rule.OtherPeerID(peer.ID))
+		}
+	}
+	if len(otherPeerIDs) == 0 {
+		return nil, nil
+	}
+	peers, err := GetPeersByIDs(otherPeerIDs)
+	if err != nil {
+		return nil, err
+	}
+	routes := []string{}
+	for _, rule := range rules {
+		other, ok := peers[rule.OtherPeerID(peer.ID)]
+		if rule.Status != AccessRuleStatusCreated || !ok {
+			continue
+		}
+		for _, route := range splitList(rule.Routes) {
+			if slices.Contains(splitList(other.Routes), route) && !slices.Contains(routes, route) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	slices.Sort(routes)
+	return routes, nil
+}
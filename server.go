@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
@@ -14,105 +23,349 @@ type AccessRuleRequest struct {
 	PeerBID string `json:"peer_b_id"`
 }
 
-func startServer() {
+type CreatePeerRequest struct {
+	// NetworkID defaults to the default network
+	NetworkID string `json:"network_id"`
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	// PublicKey is set by peers which generate their own key pair, e.g. the agent
+	PublicKey string `json:"public_key"`
+}
+
+type CreateEnrollmentTokenRequest struct {
+	NetworkID         string     `json:"network_id"`
+	Name              string     `json:"name"`
+	Label             string     `json:"label"`
+	AccessRulePeerIDs []string   `json:"access_rule_peer_ids"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+}
+
+type EnrollRequest struct {
+	Token     string `json:"token"`
+	PublicKey string `json:"public_key"`
+}
+
+type CreateAccessRuleRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Routes are routed subnets of either peer the rule opens to the other one
+	Routes []string `json:"routes"`
+}
+
+type SetPeerDirectRequest struct {
+	Direct bool `json:"direct"`
+}
+
+type SetPeerRoutesRequest struct {
+	Routes []string `json:"routes"`
+}
+
+type SetPeerEgressRequest struct {
+	Egress bool `json:"egress"`
+}
+
+// SetPeerRateLimitsRequest limits are in kbit/s, 0 removes a limit
+type SetPeerRateLimitsRequest struct {
+	IngressLimitKbit int `json:"ingress_limit_kbit"`
+	EgressLimitKbit  int `json:"egress_limit_kbit"`
+}
+
+type CreatePortForwardRequest struct {
+	PeerID   string `json:"peer_id"`
+	Protocol string `json:"protocol"`
+	// PublicPort is the port of the relay, PeerPort defaults to it
+	PublicPort int `json:"public_port"`
+	PeerPort   int `json:"peer_port"`
+}
+
+type CreateNetworkRequest struct {
+	Name       string `json:"name"`
+	Subnet     string `json:"subnet"`
+	ListenPort int    `json:"listen_port"`
+	// Interface defaults to pt-<name>
+	Interface string `json:"interface"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// startServer serves the api until ctx is cancelled, then waits for in flight requests
+func startServer(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	e := newServer()
+	// requests inherit ctx, so event streams end when the shutdown starts
+	e.Server.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+
+	serverAddress := os.Getenv("SERVER_ADDRESS")
+	if serverAddress == "" {
+		serverAddress = ":8080"
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), getShutdownTimeout())
+		defer cancel()
+		if err := e.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[ERROR] Failed to shut down the api server: %s", err)
+		}
+	}()
+
+	if err := e.Start(serverAddress); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		e.Logger.Fatal(err)
+	}
+	<-stopped
+	log.Println("[DONE] Api server stopped")
+}
+
+func newServer() *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
+	e.HTTPErrorHandler = httpErrorHandler
 
 	// Auth middleware
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			if operation := findAPIOperation(c.Request().Method, c.Path()); operation != nil && operation.Public {
+				return next(c)
+			}
 			token := c.Request().Header.Get("Authorization")
-			if token != config.APIToken {
-				return c.JSON(http.StatusUnauthorized, "Unauthorized")
+			if token == config.APIToken {
+				return next(c)
+			}
+			// an enrolled peer can only read and delete itself
+			if operation := findAPIOperation(c.Request().Method, c.Path()); operation != nil && operation.PeerScoped && strings.HasPrefix(token, peerTokenPrefix) {
+				peer, err := GetPeerByTokenHash(hashToken(token))
+				if err == nil && peer.ID == c.Param("id") {
+					return next(c)
+				}
 			}
-			return next(c)
+			return respondError(c, &DomainError{Kind: ErrorKindUnauthorized, Code: "unauthorized", Message: "invalid api token"})
 		}
 	})
 
+	e.Use(openAPIValidationMiddleware)
+	e.Use(readOnlyFollowerMiddleware)
+
 	// Register routes
-	e.POST("/peers", createPeer)
+	e.GET("/openapi.json", getOpenAPISpec)
+
+	e.POST("/networks", createNetwork, idempotencyMiddleware)
+	e.GET("/networks", getNetworks)
+	e.GET("/networks/:id", getNetwork)
+	e.DELETE("/networks/:id", deleteNetwork)
+
+	e.POST("/peers", createPeer, idempotencyMiddleware)
 	e.GET("/peers", getPeers)
 	e.GET("/peers/:id", getPeer)
 	e.GET("/peers/:id/status", getPeerStatus)
 	e.GET("/peers/:id/config", getPeerWireguardConfig)
 	e.GET("/peers/:id/script", getPeerWireguardScript)
+	e.GET("/peers/:id/access-rules", getPeerAccessRules)
+	e.GET("/peers/:id/reachable-by", getPeerReachableBy)
+	e.PUT("/peers/:id/direct", setPeerDirect)
+	e.PUT("/peers/:id/routes", setPeerRoutes)
+	e.PUT("/peers/:id/egress", setPeerEgress)
+	e.PUT("/peers/:id/limits", setPeerRateLimits)
+	e.GET("/peers/:id/usage", getPeerUsage)
+	e.GET("/peers/:id/events", streamPeerEvents)
 	e.DELETE("/peers/:id", deletePeer)
 
-	e.POST("/access-rule/:peer_a_id/:peer_b_id", createAccessRule)
+	e.POST("/access-rule/:peer_a_id/:peer_b_id", createAccessRule, idempotencyMiddleware)
 	e.GET("/access-rule/:peer_a_id/:peer_b_id", getAccessRule)
 	e.DELETE("/access-rule/:peer_a_id/:peer_b_id", deleteAccessRule)
+	e.GET("/access-rules", getAccessRules)
 
-	serverAddress := os.Getenv("SERVER_ADDRESS")
-	if serverAddress == "" {
-		serverAddress = ":8080"
-	}
+	e.POST("/batch", executeBatch, idempotencyMiddleware)
+	e.PUT("/state", applyState)
 
-	if err := e.Start(serverAddress); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		e.Logger.Fatal(err)
-	}
-	globalWaitGroup.Done()
+	e.GET("/events", streamEvents)
+
+	e.POST("/port-forwards", createPortForward, idempotencyMiddleware)
+	e.GET("/port-forwards", getPortForwards)
+	e.GET("/port-forwards/:id", getPortForward)
+	e.DELETE("/port-forwards/:id", deletePortForward)
+
+	e.POST("/webhooks", createWebhook, idempotencyMiddleware)
+	e.GET("/webhooks", getWebhooks)
+	e.DELETE("/webhooks/:id", deleteWebhook)
+
+	// not idempotent, a stored response would keep the plain token in the database
+	e.POST("/enrollment-tokens", createEnrollmentToken)
+	e.GET("/enrollment-tokens", getEnrollmentTokens)
+	e.DELETE("/enrollment-tokens/:id", deleteEnrollmentToken)
+	e.POST("/enroll", enrollPeer)
+
+	e.GET("/cluster/snapshot", getClusterSnapshot)
+	e.POST("/cluster/heartbeat", postRelayHeartbeat)
+	e.GET("/cluster/relays", getRelays)
+
+	checkOpenAPIRoutes(e)
+	return e
 }
 
-func createPeer(c echo.Context) error {
-	peer, err := CreatePeer()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
-	}
-	return c.JSON(http.StatusCreated, map[string]string{
+func peerResponse(peer *Peer) map[string]interface{} {
+	return map[string]interface{}{
 		"id":          peer.ID,
+		"network_id":  peer.NetworkID,
 		"ip":          peer.IP,
 		"public_key":  peer.PublicKey,
 		"private_key": peer.PrivateKey,
 		"status":      string(peer.Status),
-	})
+		"name":        peer.Name,
+		"label":       peer.Label,
+		"created_at":  peer.CreatedAt.Format(time.RFC3339),
+		"direct":      peer.Direct,
+		"endpoint":    peer.Endpoint,
+		"routes":      splitList(peer.Routes),
+		"egress":      peer.Egress,
+		// limits are in kbit/s, 0 is unlimited
+		"ingress_limit_kbit": peer.IngressLimitKbit,
+		"egress_limit_kbit":  peer.EgressLimitKbit,
+	}
+}
+
+// accessRuleResponse renders an access rule, resolving the ip and name of both peers
+func accessRuleResponse(rule *AccessRule, peers map[string]*Peer) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":         rule.ID,
+		"peer_a_id":  rule.PeerAID,
+		"peer_b_id":  rule.PeerBID,
+		"network_id": rule.NetworkID,
+		"status":     string(rule.Status),
+		"created_at": rule.CreatedAt.Format(time.RFC3339),
+		"routes":     splitList(rule.Routes),
+	}
+	if rule.ExpiresAt != nil {
+		response["expires_at"] = rule.ExpiresAt.Format(time.RFC3339)
+	}
+	if peer, ok := peers[rule.PeerAID]; ok {
+		response["peer_a_ip"] = peer.IP
+		response["peer_a_name"] = peer.Name
+	}
+	if peer, ok := peers[rule.PeerBID]; ok {
+		response["peer_b_ip"] = peer.IP
+		response["peer_b_name"] = peer.Name
+	}
+	return response
+}
+
+func accessRulesResponse(rules []AccessRule) ([]map[string]interface{}, error) {
+	peerIDs := []string{}
+	for _, rule := range rules {
+		peerIDs = append(peerIDs, rule.PeerAID, rule.PeerBID)
+	}
+	peers, err := GetPeersByIDs(peerIDs)
+	if err != nil {
+		return nil, err
+	}
+	response := []map[string]interface{}{}
+	for _, rule := range rules {
+		response = append(response, accessRuleResponse(&rule, peers))
+	}
+	return response, nil
+}
+
+func createNetwork(c echo.Context) error {
+	var request CreateNetworkRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	network, err := CreateNetwork(request.Name, request.Subnet, request.ListenPort, request.Interface)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, network)
+}
+
+func getNetworks(c echo.Context) error {
+	networks, err := GetNetworks()
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, networks)
+}
+
+func getNetwork(c echo.Context) error {
+	network, err := GetNetwork(c.Param("id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, network)
+}
+
+// deleteNetwork only accepts empty networks, the worker removes the interface and the chain
+func deleteNetwork(c echo.Context) error {
+	err := ScheduleNetworkDeletion(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return respondError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func createPeer(c echo.Context) error {
+	var request CreatePeerRequest
+	// body is optional
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&request); err != nil {
+			return respondError(c, err)
+		}
+	}
+	peer, err := CreatePeer(request.NetworkID, request.Name, request.Label, request.PublicKey)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, peerResponse(peer))
 }
 
 func getPeer(c echo.Context) error {
 	id := c.Param("id")
 	peer, err := GetPeer(id)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Peer not found",
-		})
+		return respondError(c, err)
 	}
-	return c.JSON(http.StatusOK, map[string]string{
-		"id":          peer.ID,
-		"ip":          peer.IP,
-		"public_key":  peer.PublicKey,
-		"private_key": peer.PrivateKey,
-		"status":      string(peer.Status),
-	})
+	return c.JSON(http.StatusOK, peerResponse(peer))
 }
 
 func getPeers(c echo.Context) error {
-	peers, err := GetPeers()
+	options, err := parseListOptions(c, peerSortColumns)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return respondError(c, err)
 	}
-	response := []map[string]string{}
-	for _, peer := range peers {
-		response = append(response, map[string]string{
-			"id":          peer.ID,
-			"ip":          peer.IP,
-			"public_key":  peer.PublicKey,
-			"private_key": peer.PrivateKey,
-			"status":      string(peer.Status),
-		})
+	result, err := ListPeers(PeerFilter{
+		NetworkID: c.QueryParam("network_id"),
+		Status:    c.QueryParam("status"),
+		IP:        c.QueryParam("ip"),
+		Label:     c.QueryParam("label"),
+		Name:      c.QueryParam("name"),
+	}, options)
+	if err != nil {
+		return respondError(c, err)
 	}
-	return c.JSON(http.StatusOK, response)
+	items := []map[string]interface{}{}
+	for _, peer := range result.Items {
+		items = append(items, peerResponse(&peer))
+	}
+	return c.JSON(http.StatusOK, ListResult[map[string]interface{}]{
+		Items:      items,
+		Total:      result.Total,
+		NextCursor: result.NextCursor,
+	})
 }
 
 func getPeerStatus(c echo.Context) error {
 	id := c.Param("id")
 	status, err := GetPeerStatus(id)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Peer not found",
-		})
+		return respondError(c, err)
 	}
 	return c.JSON(http.StatusOK, map[string]string{"status": string(status)})
 }
@@ -121,20 +374,147 @@ func getPeerWireguardScript(c echo.Context) error {
 	id := c.Param("id")
 	peer, err := GetPeer(id)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, "Peer not found")
+		return respondError(c, err)
+	}
+	if peer.PrivateKey == "" {
+		return respondError(c, unprocessableError("private_key_unknown", "peer %s holds its own private key, use the agent or the config endpoint", id))
+	}
+	network, err := GetNetwork(peer.NetworkID)
+	if err != nil {
+		return respondError(c, err)
 	}
-	return c.JSON(http.StatusOK, peer.GenerateWireguardScript())
+	script, err := peer.GenerateWireguardScript(network)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, script)
 }
 
 func getPeerWireguardConfig(c echo.Context) error {
 	id := c.Param("id")
 	peer, err := GetPeer(id)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Peer not found",
-		})
+		return respondError(c, err)
+	}
+	network, err := GetNetwork(peer.NetworkID)
+	if err != nil {
+		return respondError(c, err)
+	}
+	wireguardConfig, err := peer.GetWireguardConfig(network)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, wireguardConfig)
+}
+
+func setPeerDirect(c echo.Context) error {
+	var request SetPeerDirectRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	id := c.Param("id")
+	previous, err := GetPeer(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	peer, err := SetPeerDirect(id, request.Direct)
+	if err != nil {
+		return respondError(c, err)
+	}
+	if previous.Direct != peer.Direct {
+		notifyDirectPartners(peer, "direct_changed")
+	}
+	return c.JSON(http.StatusOK, peerResponse(peer))
+}
+
+// setPeerRoutes makes the peer the gateway of the given subnets, an empty list removes them
+func setPeerRoutes(c echo.Context) error {
+	var request SetPeerRoutesRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	peer, err := SetPeerRoutes(c.Param("id"), request.Routes)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, peerResponse(peer))
+}
+
+// setPeerEgress grants or revokes the peer's internet access through the relay
+func setPeerEgress(c echo.Context) error {
+	var request SetPeerEgressRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	id := c.Param("id")
+	previous, err := GetPeer(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	peer, err := SetPeerEgress(id, request.Egress)
+	if err != nil {
+		return respondError(c, err)
+	}
+	if previous.Egress != peer.Egress {
+		// the worker reconciles the egress rules of the network
+		workerQueueChannel <- QueueJob{Type: "network", ID: peer.NetworkID}
+		notifyPeerConfigChanged("egress_changed", peer.ID)
+	}
+	return c.JSON(http.StatusOK, peerResponse(peer))
+}
+
+func setPeerRateLimits(c echo.Context) error {
+	var request SetPeerRateLimitsRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	id := c.Param("id")
+	previous, err := GetPeer(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	peer, err := SetPeerRateLimits(id, request.IngressLimitKbit, request.EgressLimitKbit)
+	if err != nil {
+		return respondError(c, err)
+	}
+	if previous.IngressLimitKbit != peer.IngressLimitKbit || previous.EgressLimitKbit != peer.EgressLimitKbit {
+		// the worker reconciles the tc classes and filters of the network
+		workerQueueChannel <- QueueJob{Type: "network", ID: peer.NetworkID}
+	}
+	return c.JSON(http.StatusOK, peerResponse(peer))
+}
+
+// getPeerUsage returns the traffic of the peer through this relay, as read by the telemetry collector
+func getPeerUsage(c echo.Context) error {
+	peer, err := GetPeer(c.Param("id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+	usage := GetPeerUsage(peer.PublicKey)
+	if usage == nil {
+		usage = &PeerUsage{}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"peer_id":            peer.ID,
+		"ingress_bytes":      usage.IngressBytes,
+		"egress_bytes":       usage.EgressBytes,
+		"ingress_kbit":       usage.IngressKbit,
+		"egress_kbit":        usage.EgressKbit,
+		"ingress_limit_kbit": peer.IngressLimitKbit,
+		"egress_limit_kbit":  peer.EgressLimitKbit,
+		"updated_at":         usage.UpdatedAt,
+	})
+}
+
+// streamPeerEvents is the event stream of a single peer, agents resync when their config changes
+func streamPeerEvents(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := GetPeer(id); err != nil {
+		return respondError(c, err)
 	}
-	return c.JSON(http.StatusOK, peer.GetWireguardConfig())
+	return serveEventStream(c, func(event Event) bool {
+		return eventConcernsPeer(event, id)
+	})
 }
 
 func deletePeer(c echo.Context) error {
@@ -144,9 +524,7 @@ func deletePeer(c echo.Context) error {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return c.NoContent(http.StatusNoContent)
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return respondError(c, err)
 	}
 	if status == PeerStatusDeleting {
 		return c.NoContent(http.StatusNoContent)
@@ -155,9 +533,10 @@ func deletePeer(c echo.Context) error {
 	// Worker will do their job
 	err = UpdatePeerStatus(id, PeerStatusDeleting)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return respondError(c, err)
+	}
+	if peer, err := GetPeer(id); err == nil {
+		emitEvent(EventPeerDeleting, peerEventData(peer))
 	}
 	return c.NoContent(http.StatusNoContent)
 }
@@ -165,18 +544,22 @@ func deletePeer(c echo.Context) error {
 func createAccessRule(c echo.Context) error {
 	peerAID := c.Param("peer_a_id")
 	peerBID := c.Param("peer_b_id")
-	rule, err := CreateAccessRule(peerAID, peerBID)
+	var request CreateAccessRuleRequest
+	// body is optional
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&request); err != nil {
+			return respondError(c, err)
+		}
+	}
+	rule, err := CreateAccessRule(peerAID, peerBID, request.ExpiresAt, request.Routes)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return respondError(c, err)
 	}
-	return c.JSON(http.StatusCreated, map[string]string{
-		"id":        rule.ID,
-		"peer_a_id": rule.PeerAID,
-		"peer_b_id": rule.PeerBID,
-		"status":    string(rule.Status),
-	})
+	response, err := accessRulesResponse([]AccessRule{*rule})
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, response[0])
 }
 
 func getAccessRule(c echo.Context) error {
@@ -184,15 +567,90 @@ func getAccessRule(c echo.Context) error {
 	peerBID := c.Param("peer_b_id")
 	rule, err := GetAccessRule(peerAID, peerBID)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Access rule not found",
+		return respondError(c, err)
+	}
+	response, err := accessRulesResponse([]AccessRule{*rule})
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, response[0])
+}
+
+func getPeerAccessRules(c echo.Context) error {
+	id := c.Param("id")
+	_, err := GetPeer(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	rules, err := GetAccessRulesByPeerID(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	response, err := accessRulesResponse(rules)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// getPeerReachableBy lists the peers which can reach the peer, access rules allow traffic both ways
+func getPeerReachableBy(c echo.Context) error {
+	id := c.Param("id")
+	_, err := GetPeer(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	rules, err := GetAccessRulesByPeerID(id)
+	if err != nil {
+		return respondError(c, err)
+	}
+	otherPeerIDs := []string{}
+	for _, rule := range rules {
+		otherPeerIDs = append(otherPeerIDs, rule.OtherPeerID(id))
+	}
+	peers, err := GetPeersByIDs(otherPeerIDs)
+	if err != nil {
+		return respondError(c, err)
+	}
+	response := []map[string]string{}
+	for _, rule := range rules {
+		peer, ok := peers[rule.OtherPeerID(id)]
+		if !ok {
+			continue
+		}
+		response = append(response, map[string]string{
+			"peer_id":            peer.ID,
+			"ip":                 peer.IP,
+			"name":               peer.Name,
+			"label":              peer.Label,
+			"access_rule_id":     rule.ID,
+			"access_rule_status": string(rule.Status),
 		})
 	}
-	return c.JSON(http.StatusOK, map[string]string{
-		"id":        rule.ID,
-		"peer_a_id": rule.PeerAID,
-		"peer_b_id": rule.PeerBID,
-		"status":    string(rule.Status),
+	return c.JSON(http.StatusOK, response)
+}
+
+func getAccessRules(c echo.Context) error {
+	options, err := parseListOptions(c, accessRuleSortColumns)
+	if err != nil {
+		return respondError(c, err)
+	}
+	result, err := ListAccessRules(AccessRuleFilter{
+		NetworkID: c.QueryParam("network_id"),
+		Status:    c.QueryParam("status"),
+		PeerID:    c.QueryParam("peer_id"),
+	}, options)
+	if err != nil {
+		return respondError(c, err)
+	}
+	items, err := accessRulesResponse(result.Items)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, ListResult[map[string]interface{}]{
+		Items:      items,
+		Total:      result.Total,
+		NextCursor: result.NextCursor,
 	})
 }
 
@@ -201,28 +659,310 @@ func deleteAccessRule(c echo.Context) error {
 	peerBID := c.Param("peer_b_id")
 	rule, err := GetAccessRule(peerAID, peerBID)
 	if err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Access rule not found",
-		})
+		return respondError(c, err)
 	}
-	peerAIP, err := GetPeerIP(rule.PeerAID)
+	err = revokeAccessRule(rule)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return respondError(c, err)
 	}
-	peerBIP, err := GetPeerIP(rule.PeerBID)
+	emitAccessRuleEvent(EventAccessRuleRevoked, rule)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func executeBatch(c echo.Context) error {
+	var request BatchRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	if err := request.Validate(); err != nil {
+		return respondError(c, err)
+	}
+	response, err := ExecuteBatch(request)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return respondError(c, err)
+	}
+	if request.Atomic && !response.Success {
+		return c.JSON(http.StatusUnprocessableEntity, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func applyState(c echo.Context) error {
+	var state DesiredState
+	if err := c.Bind(&state); err != nil {
+		return respondError(c, err)
 	}
-	removeIptablesRuleBetweenPeers(peerAIP, peerBIP)
-	err = DeleteAccessRule(rule.ID)
+	if err := state.Validate(); err != nil {
+		return respondError(c, err)
+	}
+	dryRun := c.QueryParam("dry_run") == "true"
+	response, err := ApplyState(state, dryRun)
+	if err != nil {
+		return respondError(c, err)
+	}
+	if response.Results != nil && !response.Results.Success {
+		return c.JSON(http.StatusUnprocessableEntity, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func createPortForward(c echo.Context) error {
+	var request CreatePortForwardRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	forward, err := CreatePortForward(request.PeerID, request.Protocol, request.PublicPort, request.PeerPort)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, forward)
+}
+
+func getPortForwards(c echo.Context) error {
+	forwards, err := GetPortForwards(c.QueryParam("peer_id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, forwards)
+}
+
+func getPortForward(c echo.Context) error {
+	forward, err := GetPortForward(c.Param("id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusOK, forward)
+}
+
+// deletePortForward is logical, the worker removes the rules then the port forward
+func deletePortForward(c echo.Context) error {
+	err := SchedulePortForwardDeletion(c.Param("id"))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
+		return respondError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func createWebhook(c echo.Context) error {
+	var request CreateWebhookRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	for _, event := range request.Events {
+		if !slices.Contains(eventTypes, event) {
+			return respondError(c, invalidError("unknown_event_type", "unknown event type %s", event))
+		}
+	}
+	webhook, err := CreateWebhook(request.URL, request.Secret, request.Events)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, webhook)
+}
+
+func getWebhooks(c echo.Context) error {
+	webhooks, err := GetWebhooks()
+	if err != nil {
+		return respondError(c, err)
+	}
+	response := []map[string]string{}
+	for _, webhook := range webhooks {
+		response = append(response, map[string]string{
+			"id":     webhook.ID,
+			"url":    webhook.URL,
+			"events": webhook.Events,
 		})
 	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func deleteWebhook(c echo.Context) error {
+	err := DeleteWebhook(c.Param("id"))
+	if err != nil {
+		return respondError(c, err)
+	}
 	return c.NoContent(http.StatusNoContent)
 }
+
+// streamEvents streams events as Server-Sent Events. Clients resume by sending
+// the last received id in the Last-Event-ID header or the cursor query param.
+func streamEvents(c echo.Context) error {
+	var types []string
+	if c.QueryParam("types") != "" {
+		types = strings.Split(c.QueryParam("types"), ",")
+	}
+	return serveEventStream(c, func(event Event) bool {
+		return len(types) == 0 || slices.Contains(types, event.Type)
+	})
+}
+
+// serveEventStream replays the events after the client's cursor, then streams the live ones, only
+// the events matching filter are sent
+func serveEventStream(c echo.Context, filter func(Event) bool) error {
+	cursorParam := c.Request().Header.Get("Last-Event-ID")
+	if cursorParam == "" {
+		cursorParam = c.QueryParam("cursor")
+	}
+	var cursor uint64
+	if cursorParam != "" {
+		var err error
+		cursor, err = strconv.ParseUint(cursorParam, 10, 64)
+		if err != nil {
+			return respondError(c, invalidError("invalid_cursor", "invalid cursor"))
+		}
+	}
+	// subscribe before replaying, so nothing emitted in between is lost
+	subscription := subscribeEvents()
+	defer unsubscribeEvents(subscription)
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set(echo.HeaderConnection, "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	writeEvent := func(event Event) error {
+		cursor = event.ID
+		if !filter(event) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(response, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		if err != nil {
+			return err
+		}
+		response.Flush()
+		return nil
+	}
+
+	// replay the backlog
+	for {
+		events, err := GetEventsAfter(cursor, 500)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := writeEvent(event); err != nil {
+				return nil
+			}
+		}
+		if len(events) < 500 {
+			break
+		}
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(response, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			response.Flush()
+		case event, ok := <-subscription:
+			if !ok {
+				// dropped for being too slow, the client reconnects with its cursor
+				return nil
+			}
+			if event.ID <= cursor {
+				continue
+			}
+			if err := writeEvent(event); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// enrollmentTokenResponse renders a token, the plain token is only known right after minting
+func enrollmentTokenResponse(token *EnrollmentToken, plainToken string) map[string]interface{} {
+	peerIDs := []string{}
+	if token.AccessRulePeerIDs != "" {
+		peerIDs = strings.Split(token.AccessRulePeerIDs, ",")
+	}
+	response := map[string]interface{}{
+		"id":                   token.ID,
+		"name":                 token.Name,
+		"label":                token.Label,
+		"access_rule_peer_ids": peerIDs,
+		"network_id":           token.NetworkID,
+		"expires_at":           token.ExpiresAt.Format(time.RFC3339),
+		"used_at":              nil,
+		"peer_id":              token.PeerID,
+		"created_at":           token.CreatedAt.Format(time.RFC3339),
+	}
+	if token.UsedAt != nil {
+		response["used_at"] = token.UsedAt.Format(time.RFC3339)
+	}
+	if plainToken != "" {
+		response["token"] = plainToken
+	}
+	return response
+}
+
+func createEnrollmentToken(c echo.Context) error {
+	var request CreateEnrollmentTokenRequest
+	// body is optional
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&request); err != nil {
+			return respondError(c, err)
+		}
+	}
+	token, plainToken, err := MintEnrollmentToken(request.NetworkID, request.Name, request.Label, request.AccessRulePeerIDs, request.ExpiresAt)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, enrollmentTokenResponse(token, plainToken))
+}
+
+func getEnrollmentTokens(c echo.Context) error {
+	tokens, err := GetEnrollmentTokens()
+	if err != nil {
+		return respondError(c, err)
+	}
+	response := []map[string]interface{}{}
+	for _, token := range tokens {
+		response = append(response, enrollmentTokenResponse(&token, ""))
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func deleteEnrollmentToken(c echo.Context) error {
+	err := DeleteEnrollmentToken(c.Param("id"))
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// enrollPeer is public, the enrollment token in the body is the credential
+func enrollPeer(c echo.Context) error {
+	var request EnrollRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, err)
+	}
+	peer, peerToken, err := EnrollPeer(request.Token, request.PublicKey)
+	if err != nil {
+		return respondError(c, err)
+	}
+	network, err := GetNetwork(peer.NetworkID)
+	if err != nil {
+		return respondError(c, err)
+	}
+	wireguardConfig, err := peer.GetWireguardConfig(network)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"peer":       peerResponse(peer),
+		"config":     wireguardConfig,
+		"peer_token": peerToken,
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Rate limits are enforced on the network interface with tc. Egress, the traffic the relay sends
+// to a peer, goes through an htb class of the peer with an fq_codel queue, unlimited peers are not
+// classified and leave unshaped. Ingress, the traffic a peer sends to the relay, is policed by a
+// filter of the ingress qdisc. Every limited peer has a traffic class, unique in its network, used
+// as htb class minor, leaf qdisc handle, filter priority and filter flowid on both qdiscs.
+const (
+	shapingRootHandle    = "1:"
+	shapingIngressHandle = "ffff:"
+	// class 1 is the htb root, ffff the ingress qdisc
+	minTrafficClass = 2
+	maxTrafficClass = 0xfffe
+	// maxRateLimitKbit is 10 Gbit/s
+	maxRateLimitKbit = 10000000
+)
+
+func trafficClassID(class int) string {
+	return fmt.Sprintf("1:%x", class)
+}
+
+// policeBurst is the burst of the ingress policer in bytes, 100ms of traffic and at least 16KiB
+func policeBurst(kbit int) string {
+	return strconv.Itoa(max(kbit*1000/8/10, 16*1024))
+}
+
+func (peer *Peer) rateLimited() bool {
+	return peer.IngressLimitKbit > 0 || peer.EgressLimitKbit > 0
+}
+
+// SetPeerRateLimits sets the limits of the peer in kbit/s, 0 removes a limit. A limited peer gets
+// the lowest free traffic class of its network, an unlimited one frees it.
+func SetPeerRateLimits(peerID string, ingressKbit int, egressKbit int) (*Peer, error) {
+	if ingressKbit < 0 || ingressKbit > maxRateLimitKbit || egressKbit < 0 || egressKbit > maxRateLimitKbit {
+		return nil, invalidError("invalid_rate_limit", "limits must be between 0 and %d kbit/s", maxRateLimitKbit)
+	}
+	var peer Peer
+	err := GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.First(&peer, "id = ?", peerID).Error
+		if err != nil {
+			return wrapNotFound(err, peerNotFoundError(peerID))
+		}
+		peer.IngressLimitKbit = ingressKbit
+		peer.EgressLimitKbit = egressKbit
+		if !peer.rateLimited() {
+			peer.TrafficClass = 0
+		} else if peer.TrafficClass == 0 {
+			var used []int
+			err := tx.Model(&Peer{}).Where("network_id = ? AND traffic_class > 0", peer.NetworkID).Pluck("traffic_class", &used).Error
+			if err != nil {
+				return err
+			}
+			peer.TrafficClass = lowestFreeTrafficClass(used)
+			if peer.TrafficClass == 0 {
+				return conflictError("traffic_classes_exhausted", "every traffic class of the network is used")
+			}
+		}
+		return tx.Model(&Peer{}).Where("id = ?", peerID).Updates(map[string]interface{}{
+			"ingress_limit_kbit": peer.IngressLimitKbit,
+			"egress_limit_kbit":  peer.EgressLimitKbit,
+			"traffic_class":      peer.TrafficClass,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// lowestFreeTrafficClass returns 0 when every class is used
+func lowestFreeTrafficClass(used []int) int {
+	taken := map[int]bool{}
+	for _, class := range used {
+		taken[class] = true
+	}
+	for class := minTrafficClass; class <= maxTrafficClass; class++ {
+		if !taken[class] {
+			return class
+		}
+	}
+	return 0
+}
+
+// setupShaping adds the htb root and the ingress qdisc to the interface, existing ones are kept
+// with their classes and filters
+func setupShaping(network *Network) {
+	iface := network.Interface
+	out, _ := dataPlaneCommand("tc", "qdisc", "show", "dev", iface, "root").Output()
+	if !strings.Contains(string(out), "htb "+shapingRootHandle) {
+		// unclassified traffic is sent without shaping
+		out, err := dataPlaneCommand("tc", "qdisc", "replace", "dev", iface, "root", "handle", shapingRootHandle, "htb").CombinedOutput()
+		if err != nil {
+			log.Printf("[ERROR] Failed to add the htb qdisc to %s: %s", iface, strings.TrimSpace(string(out)))
+		}
+	}
+	out, _ = dataPlaneCommand("tc", "qdisc", "show", "dev", iface, "ingress").Output()
+	if !strings.Contains(string(out), "ingress "+shapingIngressHandle) {
+		out, err := dataPlaneCommand("tc", "qdisc", "add", "dev", iface, "handle", shapingIngressHandle, "ingress").CombinedOutput()
+		if err != nil {
+			log.Printf("[ERROR] Failed to add the ingress qdisc to %s: %s", iface, strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// peerShapedSubnets is what the filters of a peer match: its address and the subnets it routes
+func peerShapedSubnets(peer *Peer) []string {
+	return append([]string{peer.IP + "/32"}, splitList(peer.Routes)...)
+}
+
+// applyPeerRateLimits installs the class and filters of the peer, replacing the ones of its
+// traffic class, so changed limits and routes are picked up
+func applyPeerRateLimits(network *Network, peer *Peer) {
+	if peer.TrafficClass == 0 {
+		return
+	}
+	iface := network.Interface
+	classID := trafficClassID(peer.TrafficClass)
+	prio := strconv.Itoa(peer.TrafficClass)
+	run := func(args ...string) {
+		out, err := dataPlaneCommand("tc", args...).CombinedOutput()
+		if err != nil {
+			log.Printf("[ERROR] Failed to apply the rate limits of peer %s: tc %s: %s", peer.ID, strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+	// the class is replaced in place, its queue is kept
+	dataPlaneCommand("tc", "filter", "del", "dev", iface, "parent", shapingRootHandle, "prio", prio).Run()
+	dataPlaneCommand("tc", "filter", "del", "dev", iface, "parent", shapingIngressHandle, "prio", prio).Run()
+	if peer.EgressLimitKbit == 0 {
+		dataPlaneCommand("tc", "class", "del", "dev", iface, "classid", classID).Run()
+	} else {
+		rate := strconv.Itoa(peer.EgressLimitKbit) + "kbit"
+		run("class", "replace", "dev", iface, "parent", shapingRootHandle, "classid", classID, "htb", "rate", rate, "ceil", rate)
+		run("qdisc", "replace", "dev", iface, "parent", classID, "handle", fmt.Sprintf("%x:", peer.TrafficClass), "fq_codel")
+		for _, subnet := range peerShapedSubnets(peer) {
+			run("filter", "add", "dev", iface, "parent", shapingRootHandle, "protocol", "ip", "prio", prio,
+				"u32", "match", "ip", "dst", subnet, "flowid", classID)
+		}
+	}
+	if peer.IngressLimitKbit > 0 {
+		rate := strconv.Itoa(peer.IngressLimitKbit) + "kbit"
+		for _, subnet := range peerShapedSubnets(peer) {
+			run("filter", "add", "dev", iface, "parent", shapingIngressHandle, "protocol", "ip", "prio", prio,
+				"u32", "match", "ip", "src", subnet, "police", "rate", rate, "burst", policeBurst(peer.IngressLimitKbit), "drop", "flowid", classID)
+		}
+	}
+}
+
+// removePeerRateLimits removes the filters and the class of a traffic class, missing ones are ignored
+func removePeerRateLimits(network *Network, class int) {
+	iface := network.Interface
+	prio := strconv.Itoa(class)
+	dataPlaneCommand("tc", "filter", "del", "dev", iface, "parent", shapingRootHandle, "prio", prio).Run()
+	dataPlaneCommand("tc", "filter", "del", "dev", iface, "parent", shapingIngressHandle, "prio", prio).Run()
+	dataPlaneCommand("tc", "class", "del", "dev", iface, "classid", trafficClassID(class)).Run()
+}
+
+// trafficClassState is what a traffic class installs on the interface, as read back from tc
+type trafficClassState struct {
+	egressKbit  int
+	ingressKbit int
+	// u32 matches as printed by tc, e.g. 0a000002/ffffffff at 16
+	egressMatches  []string
+	ingressMatches []string
+}
+
+func (state *trafficClassState) equal(other *trafficClassState) bool {
+	return state.egressKbit == other.egressKbit && state.ingressKbit == other.ingressKbit &&
+		slices.Equal(state.egressMatches, other.egressMatches) && slices.Equal(state.ingressMatches, other.ingressMatches)
+}
+
+// u32Matches are the matches of the subnets at the source (12) or destination (16) offset of the ip header
+func u32Matches(subnets []string, offset int) []string {
+	matches := []string{}
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil || ipnet.IP.To4() == nil {
+			continue
+		}
+		matches = append(matches, fmt.Sprintf("%s/%s at %d", hex.EncodeToString(ipnet.IP.To4()), ipnet.Mask.String(), offset))
+	}
+	slices.Sort(matches)
+	return matches
+}
+
+// desiredTrafficClass is what applyPeerRateLimits installs for the peer
+func desiredTrafficClass(peer *Peer) *trafficClassState {
+	state := &trafficClassState{}
+	if peer.EgressLimitKbit > 0 {
+		state.egressKbit = peer.EgressLimitKbit
+		state.egressMatches = u32Matches(peerShapedSubnets(peer), 16)
+	}
+	if peer.IngressLimitKbit > 0 {
+		state.ingressKbit = peer.IngressLimitKbit
+		state.ingressMatches = u32Matches(peerShapedSubnets(peer), 12)
+	}
+	return state
+}
+
+// parseTCRateKbit parses a rate printed by tc, e.g. 1500Kbit or 5Mbit
+func parseTCRateKbit(rate string) int {
+	multipliers := map[string]float64{"Tbit": 1e9, "Gbit": 1e6, "Mbit": 1e3, "Kbit": 1, "bit": 1e-3}
+	for _, unit := range []string{"Tbit", "Gbit", "Mbit", "Kbit", "bit"} {
+		if value, ok := strings.CutSuffix(rate, unit); ok {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0
+			}
+			return int(math.Round(number * multipliers[unit]))
+		}
+	}
+	return 0
+}
+
+// fieldAfter returns the field following name, or an empty string
+func fieldAfter(fields []string, name string) string {
+	index := slices.Index(fields, name)
+	if index < 0 || index+1 >= len(fields) {
+		return ""
+	}
+	return fields[index+1]
+}
+
+// getTrafficClasses reads the classes and filters pikotunnel installed on the interface, keyed by
+// traffic class
+func getTrafficClasses(network *Network) map[int]*trafficClassState {
+	classOutput, _ := dataPlaneCommand("tc", "class", "show", "dev", network.Interface).Output()
+	filterOutputs := map[string]string{}
+	for _, parent := range []string{shapingRootHandle, shapingIngressHandle} {
+		out, _ := dataPlaneCommand("tc", "filter", "show", "dev", network.Interface, "parent", parent).Output()
+		filterOutputs[parent] = string(out)
+	}
+	return parseTrafficClasses(string(classOutput), filterOutputs)
+}
+
+// parseTrafficClasses parses tc class show and the tc filter show of each parent. Only htb classes
+// in the traffic class range with the fq_codel leaf of their minor, and filters whose pref is in the
+// range and whose flowid is the class of that pref are ours, the rest of the tc config is left alone.
+func parseTrafficClasses(classOutput string, filterOutputs map[string]string) map[int]*trafficClassState {
+	classes := map[int]*trafficClassState{}
+	state := func(class int) *trafficClassState {
+		if classes[class] == nil {
+			classes[class] = &trafficClassState{}
+		}
+		return classes[class]
+	}
+	for _, line := range strings.Split(classOutput, "\n") {
+		// class htb 1:2 root leaf 2: prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "class" || fields[1] != "htb" || !strings.HasPrefix(fields[2], shapingRootHandle) {
+			continue
+		}
+		class, err := strconv.ParseInt(strings.TrimPrefix(fields[2], shapingRootHandle), 16, 32)
+		if err != nil || class < minTrafficClass || class > maxTrafficClass || fieldAfter(fields, "leaf") != fmt.Sprintf("%x:", class) {
+			continue
+		}
+		state(int(class)).egressKbit = parseTCRateKbit(fieldAfter(fields, "rate"))
+	}
+	for _, parent := range []string{shapingRootHandle, shapingIngressHandle} {
+		// filter parent 1: protocol ip pref 2 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1:2 not_in_hw
+		//   match 0a000002/ffffffff at 16
+		//  police 0x1 rate 1Mbit burst 16Kb mtu 2Kb action drop overhead 0b
+		current := 0
+		for _, line := range strings.Split(filterOutputs[parent], "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) > 0 && fields[0] == "filter":
+				current = 0
+				class, err := strconv.Atoi(fieldAfter(fields, "pref"))
+				if err == nil && class >= minTrafficClass && class <= maxTrafficClass && fieldAfter(fields, "flowid") == trafficClassID(class) {
+					current = class
+				}
+			case current == 0:
+			case len(fields) == 4 && fields[0] == "match" && parent == shapingRootHandle:
+				state(current).egressMatches = append(state(current).egressMatches, strings.Join(fields[1:], " "))
+			case len(fields) == 4 && fields[0] == "match":
+				state(current).ingressMatches = append(state(current).ingressMatches, strings.Join(fields[1:], " "))
+			case slices.Contains(fields, "police") && parent == shapingIngressHandle:
+				state(current).ingressKbit = parseTCRateKbit(fieldAfter(fields, "rate"))
+			}
+		}
+	}
+	for _, state := range classes {
+		slices.Sort(state.egressMatches)
+		slices.Sort(state.ingressMatches)
+	}
+	return classes
+}
+
+// reconcileRateLimits applies the limits of the created peers which differ from the interface and
+// removes the classes and filters nobody owns anymore, the limits of pending and deleting peers are
+// left to the worker. Peers whose limits are in place are not touched.
+func reconcileRateLimits(network *Network, peers []Peer) {
+	existing := getTrafficClasses(network)
+	known := map[int]bool{}
+	applied, removed := 0, 0
+	for i, peer := range peers {
+		if peer.TrafficClass == 0 {
+			continue
+		}
+		known[peer.TrafficClass] = true
+		if peer.Status != PeerStatusCreated {
+			continue
+		}
+		if state, ok := existing[peer.TrafficClass]; ok && state.equal(desiredTrafficClass(&peer)) {
+			continue
+		}
+		applyPeerRateLimits(network, &peers[i])
+		applied++
+	}
+	for class := range existing {
+		if !known[class] {
+			removePeerRateLimits(network, class)
+			removed++
+		}
+	}
+	if applied > 0 || removed > 0 {
+		log.Printf("[DONE] Reconciled rate limits of network %s: %d applied, %d removed", network.Name, applied, removed)
+	}
+}
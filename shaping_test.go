@@ -0,0 +1,156 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTCRateKbit(t *testing.T) {
+	tests := []struct {
+		rate string
+		kbit int
+	}{
+		{"1500Kbit", 1500},
+		{"5Mbit", 5000},
+		{"2.5Mbit", 2500},
+		{"1Gbit", 1000000},
+		{"1Tbit", 1000000000},
+		{"500bit", 1},
+		{"400bit", 0},
+		{"garbage", 0},
+		{"fastMbit", 0},
+		{"", 0},
+	}
+	for _, test := range tests {
+		if kbit := parseTCRateKbit(test.rate); kbit != test.kbit {
+			t.Errorf("parseTCRateKbit(%q) = %d, expected %d", test.rate, kbit, test.kbit)
+		}
+	}
+}
+
+func TestU32Matches(t *testing.T) {
+	tests := []struct {
+		subnets []string
+		offset  int
+		matches []string
+	}{
+		{[]string{"10.0.0.2/32"}, 16, []string{"0a000002/ffffffff at 16"}},
+		{[]string{"10.0.0.2/32", "192.168.1.0/24"}, 12, []string{"0a000002/ffffffff at 12", "c0a80100/ffffff00 at 12"}},
+		{[]string{"192.168.1.0/24", "10.0.0.2/32"}, 16, []string{"0a000002/ffffffff at 16", "c0a80100/ffffff00 at 16"}},
+		{[]string{"10.0.0.2/32", "not-a-subnet"}, 16, []string{"0a000002/ffffffff at 16"}},
+		{nil, 16, []string{}},
+	}
+	for _, test := range tests {
+		if matches := u32Matches(test.subnets, test.offset); !slices.Equal(matches, test.matches) {
+			t.Errorf("u32Matches(%v, %d) = %v, expected %v", test.subnets, test.offset, matches, test.matches)
+		}
+	}
+}
+
+func TestLowestFreeTrafficClass(t *testing.T) {
+	all := []int{}
+	for class := minTrafficClass; class <= maxTrafficClass; class++ {
+		all = append(all, class)
+	}
+	tests := []struct {
+		name  string
+		used  []int
+		class int
+	}{
+		{"none used", nil, minTrafficClass},
+		{"first ones used", []int{2, 3}, 4},
+		{"gap", []int{3, 4}, 2},
+		{"out of range ignored", []int{0, 1, 2}, 3},
+		{"exhausted", all, 0},
+	}
+	for _, test := range tests {
+		if class := lowestFreeTrafficClass(test.used); class != test.class {
+			t.Errorf("%s: lowestFreeTrafficClass = %d, expected %d", test.name, class, test.class)
+		}
+	}
+}
+
+const testTCClassOutput = `class htb 1:1 root rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b
+class htb 1:2 root leaf 2: prio 0 rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b
+class htb 1:a root leaf a: prio 0 rate 1500Kbit ceil 1500Kbit burst 1600b cburst 1600b
+class htb 1:5 root leaf 20: prio 0 rate 3Mbit ceil 3Mbit burst 1600b cburst 1600b
+class htb 1:fffff root leaf fffff: prio 0 rate 3Mbit ceil 3Mbit burst 1600b cburst 1600b
+class fq_codel 2:1 parent 2:
+`
+
+const testTCRootFilterOutput = `filter parent 1: protocol ip pref 2 u32 chain 0
+filter parent 1: protocol ip pref 2 u32 chain 0 fh 800: ht divisor 1
+filter parent 1: protocol ip pref 2 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1:2 not_in_hw
+  match c0a80100/ffffff00 at 16
+filter parent 1: protocol ip pref 2 u32 chain 0 fh 800::801 order 2049 key ht 800 bkt 0 flowid 1:2 not_in_hw
+  match 0a000002/ffffffff at 16
+filter parent 1: protocol ip pref 10 u32 chain 0 fh 801::800 order 2048 key ht 801 bkt 0 flowid 1:a
+  match 0a00000a/ffffffff at 16
+filter parent 1: protocol ip pref 5 u32 chain 0 fh 802::800 order 2048 key ht 802 bkt 0 flowid 1:1 not_in_hw
+  match 0a000005/ffffffff at 16
+filter parent 1: protocol ip pref 100 u32 chain 0 fh 803::800 order 2048 key ht 803 bkt 0 flowid 1:64
+filter parent 1: protocol ip pref 49152 u32 chain 0 fh 804::800 order 2048 key ht 804 bkt 0 flowid 1:1
+  match 0a000063/ffffffff at 16
+`
+
+const testTCIngressFilterOutput = `filter parent ffff: protocol ip pref 2 u32 chain 0
+filter parent ffff: protocol ip pref 2 u32 chain 0 fh 800: ht divisor 1
+filter parent ffff: protocol ip pref 2 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid 1:2 not_in_hw
+  match 0a000002/ffffffff at 12
+ police 0x1 rate 1Mbit burst 16Kb mtu 2Kb action drop overhead 0b
+	ref 1 bind 1
+filter parent ffff: protocol ip pref 2 u32 chain 0 fh 800::801 order 2049 key ht 800 bkt 0 flowid 1:2 not_in_hw
+  match c0a80100/ffffff00 at 12
+ police 0x2 rate 1Mbit burst 16Kb mtu 2Kb action drop overhead 0b
+	ref 1 bind 1
+filter parent ffff: protocol ip pref 7 u32 chain 0 fh 801::800 order 2048 key ht 801 bkt 0 flowid 1:7
+  match 0a000007/ffffffff at 12
+	action order 1:  police 0x3 rate 512Kbit burst 16Kb mtu 2Kb action drop overhead 0b
+filter parent ffff: protocol ip pref 8 u32 chain 0 fh 802::800 order 2048 key ht 802 bkt 0 flowid 1:9
+  match 0a000008/ffffffff at 12
+ police 0x4 rate 2Mbit burst 16Kb mtu 2Kb action drop overhead 0b
+`
+
+func TestParseTrafficClasses(t *testing.T) {
+	classes := parseTrafficClasses(testTCClassOutput, map[string]string{
+		shapingRootHandle:    testTCRootFilterOutput,
+		shapingIngressHandle: testTCIngressFilterOutput,
+	})
+
+	tests := []struct {
+		name  string
+		class int
+		state *trafficClassState
+	}{
+		{"class with both limits and a route", 2, desiredTrafficClass(&Peer{IP: "10.0.0.2", Routes: "192.168.1.0/24", EgressLimitKbit: 10000, IngressLimitKbit: 1000})},
+		{"class with an egress limit", 10, desiredTrafficClass(&Peer{IP: "10.0.0.10", EgressLimitKbit: 1500})},
+		{"ingress filter without class", 7, desiredTrafficClass(&Peer{IP: "10.0.0.7", IngressLimitKbit: 512})},
+	}
+	for _, test := range tests {
+		state := classes[test.class]
+		if state == nil {
+			t.Errorf("%s: class %d not found", test.name, test.class)
+			continue
+		}
+		if !state.equal(test.state) {
+			t.Errorf("%s: class %d is %+v, expected %+v", test.name, test.class, state, test.state)
+		}
+	}
+
+	// the root class, a class with a foreign leaf, a class out of range, filters with the flowid of
+	// another class and prefs out of range are not ours
+	for _, class := range []int{1, 5, 8, 100, 0xfffff, 49152} {
+		if state, ok := classes[class]; ok {
+			t.Errorf("class %d is not pikotunnel's, got %+v", class, state)
+		}
+	}
+	if len(classes) != len(tests) {
+		t.Errorf("expected %d classes, got %d", len(tests), len(classes))
+	}
+}
+
+func TestParseTrafficClassesEmpty(t *testing.T) {
+	if classes := parseTrafficClasses("", map[string]string{}); len(classes) != 0 {
+		t.Fatalf("expected no classes, got %+v", classes)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DesiredState is the full topology of one network managed by PUT /state. Peers are matched by
+// name, peers without a name, peers of other networks and their access rules are left untouched.
+type DesiredState struct {
+	// Network is the name of the network, the default network when empty
+	Network     string              `json:"network"`
+	Peers       []DesiredPeer       `json:"peers"`
+	AccessRules []DesiredAccessRule `json:"access_rules"`
+}
+
+type DesiredPeer struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+type DesiredAccessRule struct {
+	PeerA string `json:"peer_a"`
+	PeerB string `json:"peer_b"`
+}
+
+type StatePlanItem struct {
+	Action  string `json:"action"` // create, update, delete
+	Kind    string `json:"kind"`   // peer, access_rule
+	Summary string `json:"summary"`
+}
+
+type StateResponse struct {
+	DryRun  bool            `json:"dry_run"`
+	Plan    []StatePlanItem `json:"plan"`
+	Results *BatchResponse  `json:"results,omitempty"`
+}
+
+// accessRuleKey identifies a rule between two peer names regardless of direction
+func accessRuleKey(peerA, peerB string) string {
+	if peerA > peerB {
+		peerA, peerB = peerB, peerA
+	}
+	return peerA + "<->" + peerB
+}
+
+func (state *DesiredState) Validate() error {
+	if state.Network != "" && !peerNameRegex.MatchString(state.Network) {
+		return invalidError("invalid_state", "invalid network name %q", state.Network)
+	}
+	names := map[string]bool{}
+	for _, peer := range state.Peers {
+		if !peerNameRegex.MatchString(peer.Name) {
+			return invalidError("invalid_state", "invalid peer name %q, must be a lowercase dns label", peer.Name)
+		}
+		if names[peer.Name] {
+			return invalidError("invalid_state", "duplicate peer name %s", peer.Name)
+		}
+		names[peer.Name] = true
+	}
+	for _, rule := range state.AccessRules {
+		if !names[rule.PeerA] || !names[rule.PeerB] {
+			return invalidError("invalid_state", "access rule %s references a peer which is not in the state", accessRuleKey(rule.PeerA, rule.PeerB))
+		}
+		if rule.PeerA == rule.PeerB {
+			return invalidError("invalid_state", "access rule peers cannot be the same: %s", rule.PeerA)
+		}
+	}
+	return nil
+}
+
+// PlanState diffs the desired state against the database and returns the batch operations to converge
+func PlanState(state DesiredState) ([]StatePlanItem, []BatchOperation, error) {
+	networkName := state.Network
+	if networkName == "" {
+		networkName = defaultNetworkName
+	}
+	var network Network
+	err := GetDB().First(&network, "name = ?", networkName).Error
+	if err != nil {
+		return nil, nil, wrapNotFound(err, networkNotFoundError(networkName))
+	}
+	var peers []Peer
+	err = GetDB().Find(&peers, "network_id = ? AND name <> '' AND status <> ?", network.ID, PeerStatusDeleting).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	existingPeers := map[string]*Peer{}
+	peerNames := map[string]string{}
+	for i := range peers {
+		existingPeers[peers[i].Name] = &peers[i]
+		peerNames[peers[i].ID] = peers[i].Name
+	}
+
+	plan := []StatePlanItem{}
+	operations := []BatchOperation{}
+	desiredPeers := map[string]bool{}
+	for _, desired := range state.Peers {
+		desiredPeers[desired.Name] = true
+		existing, ok := existingPeers[desired.Name]
+		if !ok {
+			plan = append(plan, StatePlanItem{Action: "create", Kind: "peer", Summary: desired.Name})
+			operations = append(operations, BatchOperation{Op: BatchOpCreatePeer, Ref: desired.Name, NetworkID: network.ID, Name: desired.Name, Label: desired.Label})
+			continue
+		}
+		if existing.Label != strings.TrimSpace(desired.Label) {
+			plan = append(plan, StatePlanItem{Action: "update", Kind: "peer", Summary: fmt.Sprintf("%s label %q -> %q", desired.Name, existing.Label, desired.Label)})
+			operations = append(operations, BatchOperation{Op: BatchOpUpdatePeer, PeerID: existing.ID, Label: desired.Label})
+		}
+	}
+
+	// resolves a peer name to its id, or to the batch ref if it is created by this plan
+	peerRef := func(name string) string {
+		if existing, ok := existingPeers[name]; ok {
+			return existing.ID
+		}
+		return "$" + name
+	}
+
+	var rules []AccessRule
+	err = GetDB().Find(&rules, "network_id = ? AND status <> ?", network.ID, AccessRuleStatusDeleting).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	existingRules := map[string]bool{}
+	for _, rule := range rules {
+		peerA, okA := peerNames[rule.PeerAID]
+		peerB, okB := peerNames[rule.PeerBID]
+		if !okA || !okB {
+			// involves an unmanaged peer
+			continue
+		}
+		existingRules[accessRuleKey(peerA, peerB)] = true
+	}
+	desiredRules := map[string]bool{}
+	for _, desired := range state.AccessRules {
+		key := accessRuleKey(desired.PeerA, desired.PeerB)
+		if desiredRules[key] {
+			continue
+		}
+		desiredRules[key] = true
+		if existingRules[key] {
+			continue
+		}
+		plan = append(plan, StatePlanItem{Action: "create", Kind: "access_rule", Summary: key})
+		operations = append(operations, BatchOperation{Op: BatchOpCreateAccessRule, PeerAID: peerRef(desired.PeerA), PeerBID: peerRef(desired.PeerB)})
+	}
+	for _, rule := range rules {
+		peerA, okA := peerNames[rule.PeerAID]
+		peerB, okB := peerNames[rule.PeerBID]
+		if !okA || !okB {
+			continue
+		}
+		key := accessRuleKey(peerA, peerB)
+		// rules of deleted peers are removed by the worker along with the peer
+		if desiredRules[key] || !desiredPeers[peerA] || !desiredPeers[peerB] {
+			continue
+		}
+		plan = append(plan, StatePlanItem{Action: "delete", Kind: "access_rule", Summary: key})
+		operations = append(operations, BatchOperation{Op: BatchOpDeleteAccessRule, PeerAID: rule.PeerAID, PeerBID: rule.PeerBID})
+	}
+
+	// delete peers last so the plan reads top down
+	names := []string{}
+	for name := range existingPeers {
+		if !desiredPeers[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		plan = append(plan, StatePlanItem{Action: "delete", Kind: "peer", Summary: name})
+		operations = append(operations, BatchOperation{Op: BatchOpDeletePeer, PeerID: existingPeers[name].ID})
+	}
+	return plan, operations, nil
+}
+
+// ApplyState converges the database to the desired state in a single atomic batch
+func ApplyState(state DesiredState, dryRun bool) (*StateResponse, error) {
+	plan, operations, err := PlanState(state)
+	if err != nil {
+		return nil, err
+	}
+	response := &StateResponse{DryRun: dryRun, Plan: plan}
+	if dryRun || len(operations) == 0 {
+		return response, nil
+	}
+	response.Results, err = ExecuteBatch(BatchRequest{Atomic: true, Operations: operations})
+	return response, err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func testPublicKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestDeletingPeerFreesItsName(t *testing.T) {
+	old, err := createPeerTx(GetDB(), "", "state-web", "", testPublicKey(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeletePeer(old.ID)
+	var domainError *DomainError
+	if _, err := createPeerTx(GetDB(), "", "state-web", "", testPublicKey(t), nil); !errors.As(err, &domainError) || domainError.Code != "peer_name_taken" {
+		t.Fatalf("expected peer_name_taken, got %v", err)
+	}
+
+	if err := UpdatePeerStatus(old.ID, PeerStatusDeleting); err != nil {
+		t.Fatal(err)
+	}
+	plan, operations, err := PlanState(DesiredState{Peers: []DesiredPeer{{Name: "state-web"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || plan[0].Action != "create" || operations[0].Op != BatchOpCreatePeer {
+		t.Fatalf("expected the peer to be recreated, got %+v", plan)
+	}
+	recreated, err := createPeerTx(GetDB(), "", "state-web", "", testPublicKey(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeletePeer(recreated.ID)
+	if found, err := GetPeerByName(recreated.NetworkID, "state-web"); err != nil || found == nil || found.ID != recreated.ID {
+		t.Fatalf("expected the name to resolve to %s, got %+v %v", recreated.ID, found, err)
+	}
+}
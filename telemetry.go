@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const telemetryPollInterval = 10 * time.Second
+
+// PeerUsage is the traffic of a peer through this relay, ingress is what the peer sent and egress
+// what it received. Counters restart when the peer is added to the interface again.
+type PeerUsage struct {
+	IngressBytes uint64 `json:"ingress_bytes"`
+	EgressBytes  uint64 `json:"egress_bytes"`
+	// IngressKbit and EgressKbit are the average rates over the last telemetry poll
+	IngressKbit uint64    `json:"ingress_kbit"`
+	EgressKbit  uint64    `json:"egress_kbit"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var (
+	// peerUsages is keyed by public key
+	peerUsages      = map[string]PeerUsage{}
+	peerUsagesMutex sync.Mutex
+)
+
+// GetPeerUsage returns the usage of the peer, nil before its first transfer was read
+func GetPeerUsage(publicKey string) *PeerUsage {
+	peerUsagesMutex.Lock()
+	defer peerUsagesMutex.Unlock()
+	usage, ok := peerUsages[publicKey]
+	if !ok {
+		return nil
+	}
+	return &usage
+}
+
+// usageRateKbit is the rate between two readings of a counter, a counter which went back
+// restarted and its current value is what was transferred since
+func usageRateKbit(previous uint64, current uint64, elapsed time.Duration) uint64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	transferred := current
+	if current >= previous {
+		transferred = current - previous
+	}
+	return uint64(float64(transferred*8) / 1000 / elapsed.Seconds())
+}
+
+// recordPeerUsage replaces the usage with the transfer counters read at now, peers which are not
+// on an interface anymore are dropped
+func recordPeerUsage(transfer map[string][2]uint64, now time.Time) {
+	peerUsagesMutex.Lock()
+	defer peerUsagesMutex.Unlock()
+	usage := map[string]PeerUsage{}
+	for publicKey, counters := range transfer {
+		current := PeerUsage{IngressBytes: counters[0], EgressBytes: counters[1], UpdatedAt: now}
+		if previous, ok := peerUsages[publicKey]; ok {
+			elapsed := now.Sub(previous.UpdatedAt)
+			current.IngressKbit = usageRateKbit(previous.IngressBytes, current.IngressBytes, elapsed)
+			current.EgressKbit = usageRateKbit(previous.EgressBytes, current.EgressBytes, elapsed)
+		}
+		usage[publicKey] = current
+	}
+	peerUsages = usage
+}
+
+func runTelemetryCollector(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	// public keys which already had their first handshake recorded
+	seenPublicKeys := map[string]bool{}
+	// last endpoint recorded per public key
+	knownEndpoints := map[string]string{}
+	ticker := time.NewTicker(telemetryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		networks, err := GetNetworks()
+		if err != nil {
+			log.Printf("[ERROR] Failed to get networks: %s", err)
+			continue
+		}
+		handshakes := map[string]time.Time{}
+		endpoints := map[string]string{}
+		transfer := map[string][2]uint64{}
+		for i := range networks {
+			if networks[i].Status != NetworkStatusCreated {
+				continue
+			}
+			networkHandshakes, err := getWireguardLatestHandshakes(&networks[i])
+			if err != nil {
+				log.Printf("[ERROR] Failed to read wireguard handshakes of %s: %s", networks[i].Interface, err)
+				continue
+			}
+			for publicKey, handshakeAt := range networkHandshakes {
+				handshakes[publicKey] = handshakeAt
+			}
+			networkEndpoints, err := getWireguardEndpoints(&networks[i])
+			if err != nil {
+				log.Printf("[ERROR] Failed to read wireguard endpoints of %s: %s", networks[i].Interface, err)
+				continue
+			}
+			for publicKey, endpoint := range networkEndpoints {
+				endpoints[publicKey] = endpoint
+			}
+			networkTransfer, err := getWireguardTransfer(&networks[i])
+			if err != nil {
+				log.Printf("[ERROR] Failed to read wireguard transfer of %s: %s", networks[i].Interface, err)
+				continue
+			}
+			for publicKey, counters := range networkTransfer {
+				transfer[publicKey] = counters
+			}
+		}
+		recordPeerUsage(transfer, time.Now())
+		for publicKey, endpoint := range endpoints {
+			if knownEndpoints[publicKey] == endpoint {
+				continue
+			}
+			peer, err := SetPeerEndpoint(publicKey, endpoint)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					knownEndpoints[publicKey] = endpoint
+				} else {
+					log.Printf("[ERROR] Failed to record endpoint of %s: %s", publicKey, err)
+				}
+				continue
+			}
+			knownEndpoints[publicKey] = endpoint
+			// direct peers dial this address, they need the new one
+			if peer.Direct {
+				notifyPeerConfigChanged("endpoint_changed", peer.ID)
+				notifyDirectPartners(peer, "endpoint_changed")
+			}
+		}
+		for publicKey, handshakeAt := range handshakes {
+			if seenPublicKeys[publicKey] {
+				continue
+			}
+			peer, err := SetPeerFirstHandshake(publicKey, handshakeAt)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					seenPublicKeys[publicKey] = true
+				} else {
+					log.Printf("[ERROR] Failed to record first handshake of %s: %s", publicKey, err)
+				}
+				continue
+			}
+			seenPublicKeys[publicKey] = true
+			emitEvent(EventPeerFirstHandshake, peerEventData(peer))
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	webhookMaxAttempts  = 12
+	webhookMaxBackoff   = time.Hour
+	webhookPollInterval = time.Second
+	webhookBatchSize    = 50
+)
+
+var webhookHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func (w *Webhook) IsSubscribedTo(eventType string) bool {
+	if w.Events == "" {
+		return true
+	}
+	return slices.Contains(strings.Split(w.Events, ","), eventType)
+}
+
+// queueWebhookDeliveries persists one delivery per matching subscription,
+// the dispatcher picks them up from the database
+func queueWebhookDeliveries(event Event) error {
+	webhooks, err := GetWebhooks()
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if !webhook.IsSubscribedTo(event.Type) {
+			continue
+		}
+		deliveryID := uuid.New().String()
+		payload, err := json.Marshal(map[string]interface{}{
+			"id":        deliveryID,
+			"event_id":  event.ID,
+			"type":      event.Type,
+			"timestamp": event.Timestamp,
+			"data":      event.Data,
+		})
+		if err != nil {
+			return err
+		}
+		err = GetDB().Create(&WebhookDelivery{
+			ID:            deliveryID,
+			WebhookID:     webhook.ID,
+			Event:         event.Type,
+			Payload:       string(payload),
+			Status:        WebhookDeliveryStatusPending,
+			NextAttemptAt: time.Now().UTC(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func runWebhookDispatcher(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dispatchDueWebhookDeliveries()
+	}
+}
+
+func dispatchDueWebhookDeliveries() {
+	deliveries, err := GetDueWebhookDeliveries(webhookBatchSize)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch webhook deliveries: %s", err)
+		return
+	}
+	for _, delivery := range deliveries {
+		webhook, err := GetWebhook(delivery.WebhookID)
+		if err != nil {
+			// subscription has been removed, nothing to deliver to
+			delivery.Status = WebhookDeliveryStatusFailed
+			delivery.LastError = "webhook not found"
+			saveWebhookDelivery(&delivery)
+			continue
+		}
+		err = deliverWebhook(webhook, &delivery)
+		delivery.Attempts++
+		if err == nil {
+			delivery.Status = WebhookDeliveryStatusDelivered
+			delivery.LastError = ""
+		} else if delivery.Attempts >= webhookMaxAttempts {
+			log.Printf("[ERROR] Giving up webhook delivery %s to %s: %s", delivery.ID, webhook.URL, err)
+			delivery.Status = WebhookDeliveryStatusFailed
+			delivery.LastError = err.Error()
+		} else {
+			backoff := time.Duration(1<<delivery.Attempts) * time.Second
+			if backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+			delivery.NextAttemptAt = time.Now().UTC().Add(backoff)
+			delivery.LastError = err.Error()
+		}
+		saveWebhookDelivery(&delivery)
+	}
+}
+
+func deliverWebhook(webhook *Webhook, delivery *WebhookDelivery) error {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pikotunnel-Event", delivery.Event)
+	req.Header.Set("X-Pikotunnel-Delivery", delivery.ID)
+	req.Header.Set("X-Pikotunnel-Signature", signWebhookPayload(webhook.Secret, payload))
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func saveWebhookDelivery(delivery *WebhookDelivery) {
+	err := GetDB().Save(delivery).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to update webhook delivery %s: %s", delivery.ID, err)
+	}
+}
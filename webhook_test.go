@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	body    []byte
+	headers http.Header
+}
+
+func TestWebhookDeliveryIsSignedAndRetried(t *testing.T) {
+	var mutex sync.Mutex
+	received := []receivedWebhook{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, receivedWebhook{body: body, headers: r.Header.Clone()})
+		attempt := len(received)
+		mutex.Unlock()
+		// the first attempt fails, the retry succeeds
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	webhook, err := CreateWebhook(receiver.URL, "test-secret", []string{EventPeerCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteWebhook(webhook.ID)
+	event := Event{ID: 42, Type: EventPeerCreated, Timestamp: time.Now().UTC(), Data: json.RawMessage(`{"id":"peer-1"}`)}
+	if err := queueWebhookDeliveries(event); err != nil {
+		t.Fatal(err)
+	}
+	// not subscribed, nothing is queued
+	if err := queueWebhookDeliveries(Event{ID: 43, Type: EventPeerDeleted, Timestamp: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatchDueWebhookDeliveries()
+	var delivery WebhookDelivery
+	if err := GetDB().First(&delivery, "webhook_id = ?", webhook.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != WebhookDeliveryStatusPending || delivery.Attempts != 1 || !delivery.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("expected a pending delivery scheduled for a retry, got %+v", delivery)
+	}
+
+	// skip the backoff
+	GetDB().Model(&WebhookDelivery{}).Where("id = ?", delivery.ID).Update("next_attempt_at", time.Now().UTC().Add(-time.Second))
+	dispatchDueWebhookDeliveries()
+	if err := GetDB().First(&delivery, "id = ?", delivery.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != WebhookDeliveryStatusDelivered || delivery.Attempts != 2 {
+		t.Fatalf("expected the retry to be delivered, got %+v", delivery)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(received))
+	}
+	var count int64
+	GetDB().Model(&WebhookDelivery{}).Where("webhook_id = ?", webhook.ID).Count(&count)
+	if count != 1 {
+		t.Fatalf("expected 1 delivery, got %d", count)
+	}
+	for _, request := range received {
+		mac := hmac.New(sha256.New, []byte("test-secret"))
+		mac.Write(request.body)
+		if signature := request.headers.Get("X-Pikotunnel-Signature"); signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Fatalf("invalid signature %q", signature)
+		}
+		if request.headers.Get("X-Pikotunnel-Event") != EventPeerCreated || request.headers.Get("X-Pikotunnel-Delivery") != delivery.ID {
+			t.Fatalf("unexpected headers %v", request.headers)
+		}
+	}
+	var payload struct {
+		ID      string          `json:"id"`
+		EventID uint64          `json:"event_id"`
+		Type    string          `json:"type"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(received[1].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != delivery.ID || payload.EventID != 42 || payload.Type != EventPeerCreated || string(payload.Data) != `{"id":"peer-1"}` {
+		t.Fatalf("unexpected payload %s", received[1].body)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
+	"time"
 )
 
 type QueueJob struct {
-	Type string //  peer, access_rule
+	Type string //  network, peer, access_rule
 	ID   string
 }
 
@@ -15,19 +17,84 @@ func init() {
 	workerQueueChannel = make(chan QueueJob, 20000)
 }
 
-func runWorkers() {
-	process()
-	globalWaitGroup.Done()
+func runWorkers(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	process(ctx)
 }
 
-func process() {
-	for job := range workerQueueChannel {
-		switch job.Type {
-		case "peer":
-			processPeer(job.ID)
-		case "access_rule":
-			processAccessRule(job.ID)
+// process runs jobs until ctx is cancelled. The job in progress is finished, queued jobs are
+// left alone: their peers and access rules keep the pending or deleting status, so
+// queuePendingTasks picks them up again on the next start.
+func process(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if queued := len(workerQueueChannel); queued > 0 {
+				log.Printf("[INFO] Worker stopped with %d queued job(s), they will be resumed on the next start", queued)
+			}
+			return
+		case job := <-workerQueueChannel:
+			switch job.Type {
+			case "network":
+				processNetwork(job.ID)
+			case "peer":
+				processPeer(job.ID)
+			case "access_rule":
+				processAccessRule(job.ID)
+			case "port_forward":
+				processPortForward(job.ID)
+			}
+		}
+	}
+}
+
+func processNetwork(id string) {
+	network, err := GetNetwork(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting network %s: %s", id, err)
+		return
+	}
+	switch network.Status {
+	case NetworkStatusPending:
+		processNetworkPending(network)
+	case NetworkStatusCreated:
+		// queued when the routes of a peer change
+		if err := reconcileNetwork(network); err != nil {
+			log.Printf("[ERROR] Error reconciling network %s: %s", network.Name, err)
 		}
+	case NetworkStatusDeleting:
+		processNetworkDeleting(network)
+	}
+}
+
+func processNetworkPending(network *Network) {
+	networks, err := getActiveNetworks()
+	if err != nil {
+		log.Printf("[ERROR] Error getting networks: %s", err)
+		return
+	}
+	status := NetworkStatusCreated
+	err = setupNetwork(network, networks)
+	if err != nil {
+		log.Printf("[ERROR] Error setting up network %s: %s", network.Name, err)
+		status = NetworkStatusFailed
+	}
+	err = UpdateNetworkStatus(network.ID, status)
+	if err != nil {
+		log.Printf("[ERROR] Error updating network %s status to %s: %s", network.ID, status, err)
+	}
+}
+
+func processNetworkDeleting(network *Network) {
+	networks, err := getActiveNetworks()
+	if err != nil {
+		log.Printf("[ERROR] Error getting networks: %s", err)
+		return
+	}
+	teardownNetwork(network, networks)
+	err = DeleteNetwork(network.ID)
+	if err != nil {
+		log.Printf("[ERROR] Error deleting network %s: %s", network.ID, err)
 	}
 }
 
@@ -37,23 +104,48 @@ func processPeer(id string) {
 		log.Printf("[ERROR] Error getting peer %s: %s", id, err)
 		return
 	}
+	network, err := GetNetwork(peer.NetworkID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting network of peer %s: %s", id, err)
+		return
+	}
 	switch peer.Status {
 	case PeerStatusPending:
-		processPeerPending(peer)
+		processPeerPending(network, peer)
 	case PeerStatusDeleting:
-		processPeerDeleting(peer)
+		processPeerDeleting(network, peer)
 	}
 }
 
-func processPeerPending(peer *Peer) {
-	addWireguardPeer(peer.PublicKey, peer.IP)
+func processPeerPending(network *Network, peer *Peer) {
+	addErr := addWireguardPeer(network, peer)
+	if addErr != nil {
+		log.Printf("[ERROR] Error adding peer %s to wireguard: %s", peer.ID, addErr)
+		err := UpdatePeerStatus(peer.ID, PeerStatusFailed)
+		if err != nil {
+			log.Printf("[ERROR] Error updating peer %s status to failed: %s", peer.ID, err)
+			return
+		}
+		peer.Status = PeerStatusFailed
+		data := peerEventData(peer)
+		data["error"] = addErr.Error()
+		emitEvent(EventPeerFailed, data)
+		return
+	}
+	if peer.Egress {
+		addEgressRule(network, peer.IP)
+	}
+	applyPeerRateLimits(network, peer)
 	err := UpdatePeerStatus(peer.ID, PeerStatusCreated)
 	if err != nil {
 		log.Printf("[ERROR] Error updating peer %s status to created: %s", peer.ID, err)
+		return
 	}
+	peer.Status = PeerStatusCreated
+	emitEvent(EventPeerCreated, peerEventData(peer))
 }
 
-func processPeerDeleting(peer *Peer) {
+func processPeerDeleting(network *Network, peer *Peer) {
 	// find out access rules that are using this peer
 	accessRules, err := GetAccessRulesByPeerID(peer.ID)
 	if err != nil {
@@ -61,33 +153,49 @@ func processPeerDeleting(peer *Peer) {
 		return
 	}
 	for _, accessRule := range accessRules {
-		// find out other peer's ip
-		if accessRule.PeerAID == peer.ID {
-			peerBIP, err := GetPeerIP(accessRule.PeerBID)
-			if err != nil {
-				log.Printf("[ERROR] Error getting peer %s IP: %s", accessRule.PeerBID, err)
-				return
-			}
-			removeIptablesRuleBetweenPeers(peer.IP, peerBIP)
-		} else {
-			peerAIP, err := GetPeerIP(accessRule.PeerAID)
-			if err != nil {
-				log.Printf("[ERROR] Error getting peer %s IP: %s", accessRule.PeerAID, err)
-				return
-			}
-			removeIptablesRuleBetweenPeers(peerAIP, peer.IP)
+		err = removeAccessRuleIptables(network, &accessRule)
+		if err != nil {
+			log.Printf("[ERROR] Error removing iptables rules of access rule %s: %s", accessRule.ID, err)
+			return
 		}
 		// delete access rule
 		err = DeleteAccessRule(accessRule.ID)
 		if err != nil {
 			log.Printf("[ERROR] Error deleting access rule %s: %s", accessRule.ID, err)
+			continue
 		}
+		emitAccessRuleEvent(EventAccessRuleRevoked, &accessRule)
+	}
+	forwards, err := GetPortForwards(peer.ID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting port forwards for peer %s: %s", peer.ID, err)
+		return
+	}
+	for _, forward := range forwards {
+		removePortForwardRules(network, peer.IP, &forward)
+		err = DeletePortForward(forward.ID)
+		if err != nil {
+			log.Printf("[ERROR] Error deleting port forward %s: %s", forward.ID, err)
+			continue
+		}
+		emitEvent(EventPortForwardDeleted, portForwardEventData(&forward))
+	}
+	removeWireguardPeer(network, peer.PublicKey)
+	if peer.Egress {
+		removeEgressRule(network, peer.IP)
+	}
+	if peer.TrafficClass != 0 {
+		removePeerRateLimits(network, peer.TrafficClass)
+	}
+	for _, route := range splitList(peer.Routes) {
+		dataPlaneCommand("ip", "route", "delete", route, "dev", network.Interface).Run()
 	}
-	removeWireguardPeer(peer.PublicKey)
 	err = DeletePeer(peer.ID)
 	if err != nil {
 		log.Printf("[ERROR] Error deleting peer %s: %s", peer.ID, err)
+		return
 	}
+	emitEvent(EventPeerDeleted, peerEventData(peer))
 }
 
 func processAccessRule(id string) {
@@ -96,26 +204,138 @@ func processAccessRule(id string) {
 		log.Printf("[ERROR] Error getting access rule %s: %s", id, err)
 		return
 	}
-	peerAIP, err := GetPeerIP(accessRule.PeerAID)
+	switch accessRule.Status {
+	case AccessRuleStatusPending:
+		processAccessRulePending(accessRule)
+	case AccessRuleStatusDeleting:
+		processAccessRuleDeleting(accessRule)
+	}
+}
+
+func processAccessRulePending(accessRule *AccessRule) {
+	network, err := GetNetwork(accessRule.NetworkID)
 	if err != nil {
-		log.Printf("[ERROR] Error getting peer %s IP: %s", accessRule.PeerAID, err)
+		log.Printf("[ERROR] Error getting network of access rule %s: %s", accessRule.ID, err)
 		return
 	}
-	peerBIP, err := GetPeerIP(accessRule.PeerBID)
+	err = addAccessRuleIptables(network, accessRule)
 	if err != nil {
-		log.Printf("[ERROR] Error getting peer %s IP: %s", accessRule.PeerBID, err)
+		log.Printf("[ERROR] Error adding iptables rules of access rule %s: %s", accessRule.ID, err)
 		return
 	}
-	addIptablesRuleBetweenPeers(peerAIP, peerBIP)
 	err = UpdateAccessRuleStatus(accessRule.ID, AccessRuleStatusCreated)
 	if err != nil {
 		log.Printf("[ERROR] Error updating access rule %s status to created: %s", accessRule.ID, err)
+		return
+	}
+	accessRule.Status = AccessRuleStatusCreated
+	emitAccessRuleEvent(EventAccessRuleCreated, accessRule)
+}
+
+func processAccessRuleDeleting(accessRule *AccessRule) {
+	err := revokeAccessRule(accessRule)
+	if err != nil {
+		log.Printf("[ERROR] Error revoking access rule %s: %s", accessRule.ID, err)
+		return
+	}
+	emitAccessRuleEvent(EventAccessRuleRevoked, accessRule)
+}
+
+// revokeAccessRule removes the iptables rules of an access rule and deletes it
+func revokeAccessRule(accessRule *AccessRule) error {
+	network, err := GetNetwork(accessRule.NetworkID)
+	if err != nil {
+		return err
+	}
+	if err := removeAccessRuleIptables(network, accessRule); err != nil {
+		return err
+	}
+	return DeleteAccessRule(accessRule.ID)
+}
+
+func processPortForward(id string) {
+	forward, err := GetPortForward(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting port forward %s: %s", id, err)
+		return
+	}
+	network, err := GetNetwork(forward.NetworkID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting network of port forward %s: %s", id, err)
+		return
+	}
+	peer, err := GetPeer(forward.PeerID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting peer of port forward %s: %s", id, err)
+		return
+	}
+	switch forward.Status {
+	case PortForwardStatusPending:
+		_, err = addPortForwardRules(network, peer.IP, forward)
+		if err != nil {
+			log.Printf("[ERROR] Error adding the rules of port forward %s: %s", forward.ID, err)
+			err = UpdatePortForwardStatus(forward.ID, PortForwardStatusFailed)
+			if err != nil {
+				log.Printf("[ERROR] Error updating port forward %s status to failed: %s", forward.ID, err)
+				return
+			}
+			forward.Status = PortForwardStatusFailed
+			emitEvent(EventPortForwardFailed, portForwardEventData(forward))
+			return
+		}
+		err = UpdatePortForwardStatus(forward.ID, PortForwardStatusCreated)
+		if err != nil {
+			log.Printf("[ERROR] Error updating port forward %s status to created: %s", forward.ID, err)
+			return
+		}
+		forward.Status = PortForwardStatusCreated
+		emitEvent(EventPortForwardCreated, portForwardEventData(forward))
+	case PortForwardStatusDeleting:
+		removePortForwardRules(network, peer.IP, forward)
+		err = DeletePortForward(forward.ID)
+		if err != nil {
+			log.Printf("[ERROR] Error deleting port forward %s: %s", forward.ID, err)
+			return
+		}
+		emitEvent(EventPortForwardDeleted, portForwardEventData(forward))
+	}
+}
+
+func runAccessRuleExpiry(ctx context.Context) {
+	defer globalWaitGroup.Done()
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		accessRules, err := GetExpiredAccessRules()
+		if err != nil {
+			log.Printf("[ERROR] Error getting expired access rules: %s", err)
+			continue
+		}
+		for _, accessRule := range accessRules {
+			err = revokeAccessRule(&accessRule)
+			if err != nil {
+				log.Printf("[ERROR] Error revoking expired access rule %s: %s", accessRule.ID, err)
+				continue
+			}
+			emitAccessRuleEvent(EventAccessRuleExpired, &accessRule)
+		}
 	}
 }
 
 func queuePendingTasks() {
+	// networks first, their peers need the interface
+	networks := []Network{}
+	err := GetDB().Model(&Network{}).Select("id").Where("status IN ?", []NetworkStatus{NetworkStatusPending, NetworkStatusDeleting}).Find(&networks).Error
+	if err != nil {
+		panic(err)
+	}
 	pendingPeers := []Peer{}
-	err := GetDB().Model(&Peer{}).Select("id").Where("status = ?", PeerStatusPending).Find(&pendingPeers).Error
+	err = GetDB().Model(&Peer{}).Select("id").Where("status = ?", PeerStatusPending).Find(&pendingPeers).Error
 	if err != nil {
 		panic(err)
 	}
@@ -129,7 +349,20 @@ func queuePendingTasks() {
 	if err != nil {
 		panic(err)
 	}
+	deletingAccessRules := []AccessRule{}
+	err = GetDB().Model(&AccessRule{}).Select("id").Where("status = ?", AccessRuleStatusDeleting).Find(&deletingAccessRules).Error
+	if err != nil {
+		panic(err)
+	}
+	portForwards := []PortForward{}
+	err = GetDB().Model(&PortForward{}).Select("id").Where("status IN ?", []PortForwardStatus{PortForwardStatusPending, PortForwardStatusDeleting}).Find(&portForwards).Error
+	if err != nil {
+		panic(err)
+	}
 
+	for _, network := range networks {
+		workerQueueChannel <- QueueJob{Type: "network", ID: network.ID}
+	}
 	for _, peer := range pendingPeers {
 		workerQueueChannel <- QueueJob{Type: "peer", ID: peer.ID}
 	}
@@ -139,4 +372,10 @@ func queuePendingTasks() {
 	for _, accessRule := range pendingAccessRules {
 		workerQueueChannel <- QueueJob{Type: "access_rule", ID: accessRule.ID}
 	}
+	for _, accessRule := range deletingAccessRules {
+		workerQueueChannel <- QueueJob{Type: "access_rule", ID: accessRule.ID}
+	}
+	for _, forward := range portForwards {
+		workerQueueChannel <- QueueJob{Type: "port_forward", ID: forward.ID}
+	}
 }
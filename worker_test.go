@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFailedPeerEventCarriesTheError(t *testing.T) {
+	// without wg on the path the peer cannot be added
+	t.Setenv("PATH", t.TempDir())
+	peer, err := createPeerTx(GetDB(), "", "", "", testPublicKey(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeletePeer(peer.ID)
+	network, err := GetNetwork(peer.NetworkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := subscribeEvents()
+	defer unsubscribeEvents(events)
+
+	processPeerPending(network, peer)
+	if status, _ := GetPeerStatus(peer.ID); status != PeerStatusFailed {
+		t.Fatalf("expected the peer to fail, got %s", status)
+	}
+	event := <-events
+	var data map[string]string
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventPeerFailed || data["id"] != peer.ID || data["error"] == "" {
+		t.Fatalf("expected a peer.failed event with the error, got %s %s", event.Type, event.Data)
+	}
+}